@@ -2,11 +2,14 @@ package application
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"sync"
+	"time"
 
+	geth "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 
 	"github.com/F0rzend/demo_ethereum_payment/internal/common"
@@ -14,51 +17,391 @@ import (
 	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
 )
 
+type Repository interface {
+	WebhookRepository
+	DiscrepancyRepository
+
+	GetID(ctx context.Context) (domain.ID, error)
+	Save(ctx context.Context, invoice *domain.Invoice) error
+	GetByID(ctx context.Context, id domain.ID) (*domain.Invoice, error)
+	GetByAddress(ctx context.Context, address *geth.Address) (*domain.Invoice, error)
+	GetUnconfirmed(ctx context.Context) ([]*domain.Invoice, error)
+	GetByBlockHash(ctx context.Context, hash geth.Hash) ([]*domain.Invoice, error)
+	GetOverdue(ctx context.Context, now time.Time) ([]*domain.Invoice, error)
+	GetWithPendingTransfers(ctx context.Context) ([]*domain.Invoice, error)
+	GetUnswept(ctx context.Context) ([]*domain.Invoice, error)
+	GetCheckpoint(ctx context.Context) (infrastructure.Checkpoint, error)
+	SaveCheckpoint(ctx context.Context, checkpoint infrastructure.Checkpoint) error
+}
+
+// RateProvider returns the current price of one ether in the fiat currency.
+// It returns an error flagged with common.FlagNotFound for unsupported currencies.
+type RateProvider interface {
+	GetRate(ctx context.Context, currency string) (domain.ExchangeRate, error)
+}
+
+const (
+	RetryInterval           = 5 * time.Second
+	ExpirationCheckInterval = time.Minute
+)
+
 type Application struct {
 	ethereum   *infrastructure.Ethereum
-	repository *infrastructure.Repository
+	repository Repository
+
+	requiredConfirmations uint64
+	tolerance             domain.Tolerance
+	// invoiceTTL is the lifetime of invoices created without an explicit expiration time.
+	// Zero means that such invoices never expire.
+	invoiceTTL time.Duration
+	// treasury receives swept funds. Sweeping is disabled if it is nil.
+	treasury *geth.Address
+	// rates converts fiat prices to wei. Fiat invoices are disabled if it is nil.
+	rates RateProvider
+	// traceInternalCalls enables detection of ether sent to invoices by contracts.
+	// It requires the debug namespace on the endpoint.
+	traceInternalCalls bool
+
+	eventHandlers []EventHandler
+
+	// invoiceLocks serializes changes of each invoice, all of them are made with updateInvoice.
+	invoiceLocks invoiceLocks
+
+	mu sync.Mutex
+	// reconciliation is the report of the last reconciliation of invoice balances.
+	reconciliation *ReconciliationReport
+	// signing holds the invoices which transfers are being signed, see reserveTransfer.
+	signing map[domain.ID]struct{}
 }
 
 func NewApplication(
 	ethereum *infrastructure.Ethereum,
-	repository *infrastructure.Repository,
+	repository Repository,
+	requiredConfirmations uint64,
+	tolerance domain.Tolerance,
+	invoiceTTL time.Duration,
+	treasury *geth.Address,
+	rates RateProvider,
+	traceInternalCalls bool,
 ) *Application {
 	return &Application{
-		ethereum:   ethereum,
-		repository: repository,
+		ethereum:              ethereum,
+		repository:            repository,
+		requiredConfirmations: requiredConfirmations,
+		tolerance:             tolerance,
+		invoiceTTL:            invoiceTTL,
+		treasury:              treasury,
+		rates:                 rates,
+		traceInternalCalls:    traceInternalCalls,
+		signing:               make(map[domain.ID]struct{}),
 	}
 }
 
 func (a *Application) RunTransactionHandler(ctx context.Context) common.ErrorGroupGoroutine {
 	return func() error {
-		transactions, err := a.ethereum.SubscribeConfirmedTransactions(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to subscribe to confirmed transactions: %w", err)
+		checkpoint, err := a.repository.GetCheckpoint(ctx)
+		if err != nil && !common.IsFlaggedError(err, common.FlagNotFound) {
+			return fmt.Errorf("failed to get checkpoint: %w", err)
 		}
 
-		log.Println("start handling new confirmed transactions")
-		wg := new(sync.WaitGroup)
-		for tx := range transactions {
-			wg.Add(1)
-			go func(tx *types.Transaction) {
-				defer wg.Done()
+		events, err := a.ethereum.SubscribeBlocks(ctx, checkpoint)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to blocks: %w", err)
+		}
 
-				if err := a.handleTransaction(tx); err != nil {
-					log.Printf("failed to handle transaction: %s\n", err)
+		log.Println("start handling new blocks")
+		for event := range events {
+			if event.Removed {
+				if err := a.revertBlock(ctx, event.Hash); err != nil {
+					log.Printf("failed to revert block %d: %s\n", event.Number, err)
 				}
-			}(tx)
-		}
 
-		wg.Wait()
+				continue
+			}
+
+			if err := a.handleBlock(ctx, event.Block); err != nil {
+				log.Printf("failed to handle block %d: %s\n", event.Number, err)
 
-		log.Println("handling new confirmed transactions stopped")
+				continue
+			}
+
+			checkpoint := infrastructure.Checkpoint{
+				Number:    event.Number,
+				Hash:      event.Hash,
+				Ancestors: nil,
+			}
+			if err := a.repository.SaveCheckpoint(ctx, checkpoint); err != nil {
+				log.Printf("failed to save checkpoint: %s\n", err)
+			}
+		}
+
+		log.Println("handling new blocks stopped")
 
 		return nil
 	}
 }
 
-func (a *Application) CreateInvoice(price domain.WEI) (domain.ID, error) {
-	id := a.repository.GetID()
+// RunExpirationJob periodically moves overdue pending invoices to the expired status.
+func (a *Application) RunExpirationJob(ctx context.Context) common.ErrorGroupGoroutine {
+	return func() error {
+		ticker := time.NewTicker(ExpirationCheckInterval)
+		defer ticker.Stop()
+
+		log.Println("start expiring overdue invoices")
+		for {
+			if err := a.expireInvoices(ctx, time.Now()); err != nil {
+				log.Printf("failed to expire invoices: %s\n", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				log.Println("expiring overdue invoices stopped")
+
+				return nil
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+func (a *Application) expireInvoices(ctx context.Context, now time.Time) error {
+	invoices, err := a.repository.GetOverdue(ctx, now)
+	if err != nil {
+		return fmt.Errorf("cannot get overdue invoices: %w", err)
+	}
+
+	for _, overdue := range invoices {
+		// The invoice may have been paid since it was loaded, so it is expired only if it still can.
+		invoice, expired, err := a.updateInvoice(ctx, overdue.ID(), func(invoice *domain.Invoice) (bool, error) {
+			return invoice.Expire(now), nil
+		})
+		if err != nil {
+			return err
+		}
+		if !expired {
+			continue
+		}
+
+		a.publish(ctx, Event{
+			Type:      EventInvoiceExpired,
+			InvoiceID: invoice.ID(),
+			Status:    invoice.Status(),
+			CreatedAt: now,
+		})
+	}
+
+	return nil
+}
+
+// handleBlock handles every transaction and token transfer of the block in order
+// and then updates confirmations of the payments from the previous blocks.
+// A transaction that failed to be handled is retried until it succeeds,
+// so the checkpoint never moves past an unhandled payment.
+func (a *Application) handleBlock(ctx context.Context, block *types.Block) error {
+	for _, tx := range block.Transactions() {
+		err := retry(ctx, func() error {
+			return a.handleTransaction(ctx, block, tx)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to handle transaction %s: %w", tx.Hash(), err)
+		}
+	}
+
+	// Already detected transfers are ignored, so the whole block can be retried.
+	err := retry(ctx, func() error {
+		return a.handleTokenTransfers(ctx, block)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to handle token transfers: %w", err)
+	}
+
+	if a.traceInternalCalls {
+		err := retry(ctx, func() error {
+			return a.handleInternalTransfers(ctx, block)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to handle internal transfers: %w", err)
+		}
+	}
+
+	if err := a.updateConfirmations(ctx, block.NumberU64()); err != nil {
+		return fmt.Errorf("failed to update confirmations: %w", err)
+	}
+
+	if err := a.updateTransfers(ctx, block.NumberU64()); err != nil {
+		return fmt.Errorf("failed to update transfers: %w", err)
+	}
+
+	return nil
+}
+
+// revertBlock reverts payments from the block orphaned by a chain reorganization.
+func (a *Application) revertBlock(ctx context.Context, hash geth.Hash) error {
+	var invoices []*domain.Invoice
+
+	err := retry(ctx, func() error {
+		var err error
+
+		invoices, err = a.repository.GetByBlockHash(ctx, hash)
+
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot get invoices by block hash: %w", err)
+	}
+
+	for _, orphaned := range invoices {
+		var (
+			invoice  *domain.Invoice
+			reverted []*domain.Payment
+		)
+
+		err := retry(ctx, func() error {
+			var err error
+
+			invoice, _, err = a.updateInvoice(ctx, orphaned.ID(), func(invoice *domain.Invoice) (bool, error) {
+				reverted = invoice.Revert(hash)
+
+				return len(reverted) > 0, nil
+			})
+
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, payment := range reverted {
+			a.publish(ctx, Event{
+				Type:      EventPaymentReverted,
+				InvoiceID: invoice.ID(),
+				Status:    invoice.Status(),
+				TxHash:    payment.TxHash(),
+				Value:     payment.Value(),
+				CreatedAt: time.Now(),
+			})
+		}
+	}
+
+	return nil
+}
+
+// retry calls f until it succeeds or the context is done.
+func retry(ctx context.Context, f func() error) error {
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+
+		log.Printf("operation failed, retrying in %s: %s\n", RetryInterval, err)
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(RetryInterval):
+		}
+	}
+}
+
+func (a *Application) updateConfirmations(ctx context.Context, headNumber uint64) error {
+	invoices, err := a.repository.GetUnconfirmed(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get invoices with unconfirmed payments: %w", err)
+	}
+
+	for _, unconfirmed := range invoices {
+		var wasSettled bool
+
+		invoice, changed, err := a.updateInvoice(ctx, unconfirmed.ID(), func(invoice *domain.Invoice) (bool, error) {
+			wasSettled = invoice.IsSettled()
+
+			return invoice.UpdateConfirmations(headNumber), nil
+		})
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+
+		a.publishIfPaid(ctx, invoice, wasSettled)
+	}
+
+	return nil
+}
+
+// CreateInvoice creates an invoice which expires at the given time.
+// If expiresAt is nil, the default invoice TTL is used.
+// If tokenAddress is set, the invoice is paid in the ERC-20 token
+// and the price is in the smallest unit of the token.
+func (a *Application) CreateInvoice(
+	ctx context.Context,
+	price domain.WEI,
+	expiresAt *time.Time,
+	tokenAddress *geth.Address,
+) (domain.ID, error) {
+	var token *domain.Token
+	tolerance := a.tolerance.For(price)
+
+	if tokenAddress != nil {
+		var err error
+
+		token, err = a.ethereum.GetToken(ctx, *tokenAddress)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get token: %w", err)
+		}
+
+		if !a.tolerance.IsRelative() {
+			tolerance = new(big.Int)
+		}
+	}
+
+	return a.createInvoice(ctx, price, tolerance, expiresAt, token, nil)
+}
+
+// CreateFiatInvoice creates an invoice priced in the fiat currency.
+// The amount is converted to wei with the current exchange rate,
+// which is stored on the invoice.
+func (a *Application) CreateFiatInvoice(
+	ctx context.Context,
+	amount *big.Rat,
+	currency string,
+	expiresAt *time.Time,
+) (domain.ID, error) {
+	if a.rates == nil {
+		return 0, common.FlagError(fmt.Errorf("exchange rate provider is not configured"), common.FlagConflict)
+	}
+
+	rate, err := a.rates.GetRate(ctx, currency)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get exchange rate: %w", err)
+	}
+
+	price := rate.ToWEI(amount)
+
+	return a.createInvoice(ctx, price, a.tolerance.For(price), expiresAt, nil, domain.NewFiatPrice(amount, rate))
+}
+
+func (a *Application) createInvoice(
+	ctx context.Context,
+	price domain.WEI,
+	tolerance domain.WEI,
+	expiresAt *time.Time,
+	token *domain.Token,
+	fiat *domain.FiatPrice,
+) (domain.ID, error) {
+	now := time.Now().UTC()
+
+	if expiresAt == nil && a.invoiceTTL > 0 {
+		defaultExpiresAt := now.Add(a.invoiceTTL)
+		expiresAt = &defaultExpiresAt
+	}
+
+	id, err := a.repository.GetID(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get invoice id: %w", err)
+	}
 
 	invoiceAddress, err := a.ethereum.GetInvoiceAccount(id)
 	if err != nil {
@@ -70,22 +413,119 @@ func (a *Application) CreateInvoice(price domain.WEI) (domain.ID, error) {
 		price,
 		big.NewInt(0),
 		invoiceAddress,
+		token,
+		fiat,
 		domain.InvoiceStatusPending,
+		tolerance,
+		a.requiredConfirmations,
+		now,
+		expiresAt,
+		nil,
+		nil,
 	)
 
-	a.repository.Save(invoice)
+	if err := a.repository.Save(ctx, invoice); err != nil {
+		return 0, fmt.Errorf("failed to save invoice: %w", err)
+	}
+
+	a.publish(ctx, Event{
+		Type:      EventInvoiceCreated,
+		InvoiceID: invoice.ID(),
+		Status:    invoice.Status(),
+		Value:     invoice.Price(),
+		CreatedAt: now,
+	})
 
 	return invoice.ID(), nil
 }
 
-func (a *Application) handleTransaction(tx *types.Transaction) error {
+func (a *Application) handleTransaction(ctx context.Context, block *types.Block, tx *types.Transaction) error {
 	if tx.To() == nil {
 		return nil
 	}
 
-	value := tx.Value()
+	invoice, err := a.repository.GetByAddress(ctx, tx.To())
+	if common.IsFlaggedError(err, common.FlagNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot get invoice by address: %w", err)
+	}
+
+	if !invoice.Accepts(domain.PaymentKindTransaction, nil) {
+		if tx.Value().Sign() > 0 {
+			log.Printf("ether sent by transaction %s to token invoice %d, skipping it\n", tx.Hash(), invoice.ID())
+		}
+
+		return nil
+	}
+
+	receipt, verified, err := a.ethereum.GetVerifiedReceipt(ctx, block, tx.Hash())
+	if common.IsFlaggedError(err, common.FlagNotFound) {
+		// The block is no longer canonical, its replacement will be handled after the reorganization.
+		log.Printf("receipt of transaction %s not found, skipping it\n", tx.Hash())
+
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot get transaction receipt: %w", err)
+	}
+
+	if receipt.BlockHash != block.Hash() {
+		log.Printf("transaction %s was moved to block %s, skipping it\n", tx.Hash(), receipt.BlockHash)
+
+		return nil
+	}
+
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		log.Printf("transaction %s to invoice %d failed, skipping it\n", tx.Hash(), invoice.ID())
+
+		return nil
+	}
+
+	sender, err := a.ethereum.GetSender(tx)
+	if err != nil {
+		return fmt.Errorf("cannot get transaction sender: %w", err)
+	}
+
+	payment := domain.NewDetectedPayment(
+		tx.Hash(),
+		domain.PaymentKindTransaction,
+		0,
+		block.NumberU64(),
+		block.Hash(),
+		sender,
+		tx.Value(),
+		time.Unix(int64(block.Time()), 0).UTC(),
+		receipt.GasUsed,
+		effectiveGasPrice(tx, receipt, block.BaseFee()),
+		verified,
+	)
+
+	return a.detectPayment(ctx, invoice.ID(), payment)
+}
+
+func (a *Application) handleTokenTransfers(ctx context.Context, block *types.Block) error {
+	transfers, err := a.ethereum.GetTokenTransfers(ctx, block.Hash())
+	if err != nil {
+		return err
+	}
+
+	for _, transfer := range transfers {
+		if err := a.handleTokenTransfer(ctx, block, transfer); err != nil {
+			return fmt.Errorf("failed to handle transfer %d of transaction %s: %w", transfer.LogIndex, transfer.TxHash, err)
+		}
+	}
+
+	return nil
+}
 
-	invoice, err := a.repository.GetByAddress(tx.To())
+func (a *Application) handleTokenTransfer(
+	ctx context.Context,
+	block *types.Block,
+	transfer infrastructure.TokenTransfer,
+) error {
+	invoice, err := a.repository.GetByAddress(ctx, &transfer.To)
 	if common.IsFlaggedError(err, common.FlagNotFound) {
 		return nil
 	}
@@ -93,15 +533,199 @@ func (a *Application) handleTransaction(tx *types.Transaction) error {
 		return fmt.Errorf("cannot get invoice by address: %w", err)
 	}
 
-	invoice.Deposit(value)
+	if !invoice.Accepts(domain.PaymentKindTokenTransfer, &transfer.Token) {
+		log.Printf(
+			"transfer of token %s by transaction %s is not accepted by invoice %d, skipping it\n",
+			transfer.Token, transfer.TxHash, invoice.ID(),
+		)
+
+		return nil
+	}
+
+	tx := block.Transaction(transfer.TxHash)
+	if tx == nil {
+		return fmt.Errorf("transaction %s not found in block %s", transfer.TxHash, block.Hash())
+	}
 
-	a.repository.Save(invoice)
+	receipt, verified, err := a.ethereum.GetVerifiedReceipt(ctx, block, transfer.TxHash)
+	if common.IsFlaggedError(err, common.FlagNotFound) {
+		log.Printf("receipt of transaction %s not found, skipping it\n", transfer.TxHash)
+
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot get transaction receipt: %w", err)
+	}
+
+	if receipt.BlockHash != block.Hash() {
+		log.Printf("transaction %s was moved to block %s, skipping it\n", transfer.TxHash, receipt.BlockHash)
+
+		return nil
+	}
+
+	// Logs are returned separately from receipts, so the transfer must be checked against the verified receipt.
+	if verified && !transfer.IncludedIn(receipt) {
+		return fmt.Errorf("transfer %d is not included in the receipt of transaction %s", transfer.LogIndex, transfer.TxHash)
+	}
+
+	payment := domain.NewDetectedPayment(
+		transfer.TxHash,
+		domain.PaymentKindTokenTransfer,
+		transfer.LogIndex,
+		block.NumberU64(),
+		block.Hash(),
+		transfer.From,
+		transfer.Value,
+		time.Unix(int64(block.Time()), 0).UTC(),
+		receipt.GasUsed,
+		effectiveGasPrice(tx, receipt, block.BaseFee()),
+		verified,
+	)
+
+	return a.detectPayment(ctx, invoice.ID(), payment)
+}
+
+func (a *Application) handleInternalTransfers(ctx context.Context, block *types.Block) error {
+	transfers, err := a.ethereum.GetInternalTransfers(ctx, block)
+	if err != nil {
+		return err
+	}
+
+	for _, transfer := range transfers {
+		if err := a.handleInternalTransfer(ctx, block, transfer); err != nil {
+			return fmt.Errorf("failed to handle call %d of transaction %s: %w", transfer.Index, transfer.TxHash, err)
+		}
+	}
 
 	return nil
 }
 
-func (a *Application) GetInvoice(id domain.ID) (*domain.Invoice, error) {
-	invoice, err := a.repository.GetByID(id)
+func (a *Application) handleInternalTransfer(
+	ctx context.Context,
+	block *types.Block,
+	transfer infrastructure.InternalTransfer,
+) error {
+	invoice, err := a.repository.GetByAddress(ctx, &transfer.To)
+	if common.IsFlaggedError(err, common.FlagNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot get invoice by address: %w", err)
+	}
+
+	if !invoice.Accepts(domain.PaymentKindInternalCall, nil) {
+		log.Printf("ether sent by internal call in transaction %s to token invoice %d, skipping it\n", transfer.TxHash, invoice.ID())
+
+		return nil
+	}
+
+	tx := block.Transaction(transfer.TxHash)
+	if tx == nil {
+		return fmt.Errorf("transaction %s not found in block %s", transfer.TxHash, block.Hash())
+	}
+
+	receipt, _, err := a.ethereum.GetVerifiedReceipt(ctx, block, transfer.TxHash)
+	if common.IsFlaggedError(err, common.FlagNotFound) {
+		log.Printf("receipt of transaction %s not found, skipping it\n", transfer.TxHash)
+
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot get transaction receipt: %w", err)
+	}
+
+	if receipt.BlockHash != block.Hash() {
+		log.Printf("transaction %s was moved to block %s, skipping it\n", transfer.TxHash, receipt.BlockHash)
+
+		return nil
+	}
+
+	// Traces of failed transactions are skipped, but the receipt is authoritative.
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return nil
+	}
+
+	// The payment is not verified even if the receipt is, because the block header
+	// commits to no trace data, so the internal call itself is unproven.
+	payment := domain.NewDetectedPayment(
+		transfer.TxHash,
+		domain.PaymentKindInternalCall,
+		transfer.Index,
+		block.NumberU64(),
+		block.Hash(),
+		transfer.From,
+		transfer.Value,
+		time.Unix(int64(block.Time()), 0).UTC(),
+		receipt.GasUsed,
+		effectiveGasPrice(tx, receipt, block.BaseFee()),
+		false,
+	)
+
+	return a.detectPayment(ctx, invoice.ID(), payment)
+}
+
+// detectPayment records the payment on the invoice and publishes events about it.
+func (a *Application) detectPayment(ctx context.Context, id domain.ID, payment *domain.Payment) error {
+	var (
+		wasSettled bool
+		recorded   *domain.Payment
+	)
+
+	invoice, detected, err := a.updateInvoice(ctx, id, func(invoice *domain.Invoice) (bool, error) {
+		wasSettled = invoice.IsSettled()
+
+		// The invoice keeps and updates the recorded payment, so a repeated change starts from a fresh copy.
+		payment := *payment
+		recorded = &payment
+
+		return invoice.Detect(recorded), nil
+	})
+	if err != nil {
+		return err
+	}
+	if !detected {
+		return nil
+	}
+
+	eventType := EventPaymentReceived
+	if recorded.IsLate() {
+		eventType = EventPaymentLate
+	}
+
+	a.publish(ctx, Event{
+		Type:      eventType,
+		InvoiceID: invoice.ID(),
+		Status:    invoice.Status(),
+		TxHash:    recorded.TxHash(),
+		Value:     recorded.Value(),
+		CreatedAt: time.Now(),
+	})
+	a.publishIfPaid(ctx, invoice, wasSettled)
+
+	return nil
+}
+
+// effectiveGasPrice returns the price per gas paid by the sender of the transaction.
+// It is calculated from the block base fee if the node did not return it in the receipt.
+func effectiveGasPrice(tx *types.Transaction, receipt *types.Receipt, baseFee *big.Int) *big.Int {
+	if receipt.EffectiveGasPrice != nil {
+		return receipt.EffectiveGasPrice
+	}
+
+	if baseFee == nil {
+		return tx.GasPrice()
+	}
+
+	tip, err := tx.EffectiveGasTip(baseFee)
+	if err != nil {
+		return tx.GasPrice()
+	}
+
+	return tip.Add(tip, baseFee)
+}
+
+func (a *Application) GetInvoice(ctx context.Context, id domain.ID) (*domain.Invoice, error) {
+	invoice, err := a.repository.GetByID(ctx, id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get invoice: %w", err)
 	}
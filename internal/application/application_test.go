@@ -0,0 +1,595 @@
+package application_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/application"
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+const testMnemonic = "tag volcano eight thank tide danger coast health above argue embrace heavy"
+
+// overdueHookRepository calls onOverdue after the overdue invoices are loaded and before they are expired.
+type overdueHookRepository struct {
+	*infrastructure.SQLiteRepository
+
+	onOverdue func()
+}
+
+func (r *overdueHookRepository) GetOverdue(ctx context.Context, now time.Time) ([]*domain.Invoice, error) {
+	invoices, err := r.SQLiteRepository.GetOverdue(ctx, now)
+	r.onOverdue()
+
+	return invoices, err
+}
+
+func TestApplication_ExpireInvoicesWhileDetectingPayment(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	repository, err := infrastructure.NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "invoices.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, repository.Close()) })
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	expiresAt := time.Unix(100, 0).UTC()
+	invoice := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 2, time.Time{}, &expiresAt, nil, nil,
+	)
+	require.NoError(t, repository.Save(ctx, invoice))
+
+	hooked := &overdueHookRepository{SQLiteRepository: repository}
+	sut := application.NewApplication(nil, hooked, 2, domain.Tolerance{}, 0, nil, nil, false)
+
+	// The payment made in time is detected while the expiration job holds the overdue invoice.
+	hooked.onOverdue = func() {
+		var wg sync.WaitGroup
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			payment := domain.NewDetectedPayment(
+				geth.Hash{1}, domain.PaymentKindTransaction, 0, 10, geth.Hash{2},
+				address, big.NewInt(2), time.Unix(10, 0).UTC(), 21_000, big.NewInt(1), true,
+			)
+			assert.NoError(t, application.DetectPayment(sut, ctx, 1, payment))
+		}()
+
+		wg.Wait()
+	}
+
+	require.NoError(t, application.ExpireInvoices(sut, ctx, expiresAt.Add(time.Second)))
+
+	saved, err := repository.GetByID(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, domain.InvoiceStatusDetected, saved.Status())
+	assert.Len(t, saved.Payments(), 1)
+}
+
+func TestApplication_ConcurrentRefunds(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	node := newFakeNode(t)
+
+	endpoints, err := infrastructure.DialEndpoints(ctx, []string{node.URL}, time.Minute, time.Second)
+	require.NoError(t, err)
+
+	wallet, err := infrastructure.NewHDWallet(testMnemonic)
+	require.NoError(t, err)
+
+	address, err := wallet.GetInvoiceAccount(1)
+	require.NoError(t, err)
+
+	repository := infrastructure.NewRepository()
+	invoice := domain.NewInvoice(
+		1, big.NewInt(1_000), big.NewInt(1_000), address, nil, nil, domain.InvoiceStatusPaid, big.NewInt(0), 1, time.Time{}, nil, nil, nil,
+	)
+	require.NoError(t, repository.Save(ctx, invoice))
+
+	ethereum := infrastructure.NewEthereum(endpoints, nil, wallet, wallet, time.Second)
+	sut := application.NewApplication(ethereum, repository, 1, domain.Tolerance{}, 0, nil, nil, false)
+
+	destination := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	errs := make(chan error, 2)
+
+	callParallelAndWait(2, func() {
+		_, err := sut.RefundInvoice(ctx, 1, big.NewInt(600), &destination, false)
+		errs <- err
+	})
+	close(errs)
+
+	var conflicts int
+	for err := range errs {
+		if err != nil {
+			assert.True(t, common.IsFlaggedError(err, common.FlagConflict), err)
+			conflicts++
+		}
+	}
+
+	assert.Equal(t, 1, conflicts)
+	assert.Equal(t, int32(1), node.sent.Load())
+
+	saved, err := repository.GetByID(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, saved.Transfers(), 1)
+	assert.Equal(t, big.NewInt(600), saved.Refunded())
+}
+
+// approvalSigner calls onSign before signing, like a remote signer waiting for an operator approval.
+type approvalSigner struct {
+	*infrastructure.HDWallet
+
+	signed atomic.Int32
+	onSign func()
+}
+
+func (s *approvalSigner) SignInvoiceTransaction(
+	ctx context.Context,
+	id domain.ID,
+	tx *types.Transaction,
+	signer types.Signer,
+) (*types.Transaction, error) {
+	s.signed.Add(1)
+	s.onSign()
+
+	return s.HDWallet.SignInvoiceTransaction(ctx, id, tx, signer)
+}
+
+func TestApplication_RefundSignedWhileInvoiceChanges(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	node := newFakeNode(t)
+
+	endpoints, err := infrastructure.DialEndpoints(ctx, []string{node.URL}, time.Minute, time.Second)
+	require.NoError(t, err)
+
+	wallet, err := infrastructure.NewHDWallet(testMnemonic)
+	require.NoError(t, err)
+
+	address, err := wallet.GetInvoiceAccount(1)
+	require.NoError(t, err)
+
+	repository := infrastructure.NewRepository()
+	invoice := domain.NewInvoice(
+		1, big.NewInt(1_000), big.NewInt(1_000), address, nil, nil, domain.InvoiceStatusPaid, big.NewInt(0), 1, time.Time{}, nil, nil, nil,
+	)
+	require.NoError(t, repository.Save(ctx, invoice))
+
+	signer := &approvalSigner{HDWallet: wallet}
+	ethereum := infrastructure.NewEthereum(endpoints, nil, wallet, signer, time.Second)
+	sut := application.NewApplication(ethereum, repository, 1, domain.Tolerance{}, 0, nil, nil, false)
+
+	destination := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+
+	// A payment is detected while the refund waits for the approval, so the invoice is not locked meanwhile.
+	signer.onSign = func() {
+		payment := domain.NewDetectedPayment(
+			geth.Hash{1}, domain.PaymentKindTransaction, 0, 10, geth.Hash{2},
+			destination, big.NewInt(2), time.Unix(10, 0).UTC(), 21_000, big.NewInt(1), true,
+		)
+		assert.NoError(t, application.DetectPayment(sut, ctx, 1, payment))
+
+		_, err := sut.RefundInvoice(ctx, 1, big.NewInt(100), &destination, false)
+		assert.True(t, common.IsFlaggedError(err, common.FlagConflict), err)
+	}
+
+	_, err = sut.RefundInvoice(ctx, 1, big.NewInt(600), &destination, false)
+	assert.True(t, common.IsFlaggedError(err, common.FlagConflict), err)
+
+	assert.Equal(t, int32(1), signer.signed.Load())
+	assert.Equal(t, int32(0), node.sent.Load())
+
+	saved, err := repository.GetByID(ctx, 1)
+	require.NoError(t, err)
+	assert.Empty(t, saved.Transfers())
+	assert.Len(t, saved.Payments(), 1)
+}
+
+func TestApplication_RefundSendErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		sendError error
+		status    domain.TransferStatus
+	}{
+		{
+			name:      "rejected",
+			sendError: errors.New("insufficient funds for gas * price + value"),
+			status:    domain.TransferStatusFailed,
+		},
+		{
+			name:      "already known",
+			sendError: errors.New("already known"),
+			status:    domain.TransferStatusPending,
+		},
+		{
+			name:      "timeout",
+			sendError: errors.New("request timed out"),
+			status:    domain.TransferStatusPending,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			node := newFakeNode(t)
+			node.sendError = tt.sendError
+
+			endpoints, err := infrastructure.DialEndpoints(ctx, []string{node.URL}, time.Minute, time.Second)
+			require.NoError(t, err)
+
+			wallet, err := infrastructure.NewHDWallet(testMnemonic)
+			require.NoError(t, err)
+
+			address, err := wallet.GetInvoiceAccount(1)
+			require.NoError(t, err)
+
+			repository := infrastructure.NewRepository()
+			invoice := domain.NewInvoice(
+				1, big.NewInt(1_000), big.NewInt(1_000), address, nil, nil, domain.InvoiceStatusPaid, big.NewInt(0), 1, time.Time{}, nil, nil, nil,
+			)
+			require.NoError(t, repository.Save(ctx, invoice))
+
+			ethereum := infrastructure.NewEthereum(endpoints, nil, wallet, wallet, time.Second)
+			sut := application.NewApplication(ethereum, repository, 1, domain.Tolerance{}, 0, nil, nil, false)
+
+			destination := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+			_, err = sut.RefundInvoice(ctx, 1, big.NewInt(600), &destination, false)
+			require.Error(t, err)
+
+			saved, err := repository.GetByID(ctx, 1)
+			require.NoError(t, err)
+			require.Len(t, saved.Transfers(), 1)
+			assert.Equal(t, tt.status, saved.Transfers()[0].Status())
+		})
+	}
+}
+
+func callParallelAndWait(times int, f func()) {
+	wg := new(sync.WaitGroup)
+	wg.Add(times)
+
+	for i := 0; i < times; i++ {
+		go func() {
+			defer wg.Done()
+
+			f()
+		}()
+	}
+
+	wg.Wait()
+}
+
+// fakeNode serves the JSON-RPC methods used to build and send transfers and to recover invoices.
+// Every address has a balance of one ether unless it is set in balances, and no transactions.
+// The chain starts with an empty genesis block and is extended by mine.
+type fakeNode struct {
+	URL string
+	// balances holds *big.Int balances by geth.Address.
+	balances sync.Map
+	// nonces holds uint64 nonces by geth.Address.
+	nonces sync.Map
+	// tokenBalances holds *big.Int balances of the fakeToken by geth.Address.
+	tokenBalances sync.Map
+	// sent is the number of transactions sent to the node.
+	sent atomic.Int32
+	// sendError is returned for sent transactions if it is set.
+	sendError error
+
+	mu       sync.Mutex
+	blocks   []*types.Block
+	receipts map[geth.Hash][]*types.Receipt
+	traces   map[geth.Hash][]fakeTrace
+}
+
+// fakeToken is the only contract of the fakeNode, an ERC-20 token with 6 decimals.
+var fakeToken = geth.HexToAddress("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+
+// fakeTrace is a transaction trace returned by the callTracer.
+type fakeTrace struct {
+	TxHash geth.Hash `json:"txHash"`
+	Result fakeCall  `json:"result"`
+}
+
+type fakeCall struct {
+	Type  string       `json:"type"`
+	From  geth.Address `json:"from"`
+	To    geth.Address `json:"to"`
+	Value *hexutil.Big `json:"value,omitempty"`
+	Calls []fakeCall   `json:"calls,omitempty"`
+}
+
+func newFakeNode(t *testing.T) *fakeNode {
+	t.Helper()
+
+	node := &fakeNode{
+		receipts: make(map[geth.Hash][]*types.Receipt),
+		traces:   make(map[geth.Hash][]fakeTrace),
+	}
+	node.mine(nil, nil)
+
+	server := rpc.NewServer()
+	require.NoError(t, server.RegisterName("eth", &fakeEthAPI{node: node}))
+	require.NoError(t, server.RegisterName("debug", &fakeDebugAPI{node: node}))
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	t.Cleanup(server.Stop)
+
+	node.URL = httpServer.URL
+
+	return node
+}
+
+// mine appends a block with the transactions and their receipts to the chain.
+// Transactions without traces are traced as calls without internal calls.
+func (n *fakeNode) mine(txs []*types.Transaction, receipts []*types.Receipt, traces ...fakeTrace) *types.Block {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	number := uint64(len(n.blocks))
+	header := &types.Header{
+		Difficulty: new(big.Int),
+		Number:     new(big.Int).SetUint64(number),
+		GasLimit:   30_000_000,
+		Time:       uint64(time.Now().Unix()),
+		BaseFee:    big.NewInt(1),
+	}
+	if number > 0 {
+		header.ParentHash = n.blocks[number-1].Hash()
+	}
+
+	for i, receipt := range receipts {
+		receipt.TxHash = txs[i].Hash()
+		if receipt.Logs == nil {
+			receipt.Logs = []*types.Log{}
+		}
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+	}
+
+	block := types.NewBlock(header, txs, nil, receipts, trie.NewStackTrie(nil))
+
+	for i, receipt := range receipts {
+		receipt.BlockHash = block.Hash()
+		receipt.BlockNumber = block.Number()
+		receipt.TransactionIndex = uint(i)
+	}
+
+	for len(traces) < len(txs) {
+		traces = append(traces, fakeTrace{
+			TxHash: txs[len(traces)].Hash(),
+			Result: fakeCall{Type: "CALL"},
+		})
+	}
+
+	n.blocks = append(n.blocks, block)
+	n.receipts[block.Hash()] = receipts
+	n.traces[block.Hash()] = traces
+
+	return block
+}
+
+type fakeEthAPI struct {
+	node *fakeNode
+}
+
+func (api *fakeEthAPI) ChainId() *hexutil.Big { //nolint:revive,stylecheck // must match eth_chainId
+	return (*hexutil.Big)(big.NewInt(1337))
+}
+
+func (api *fakeEthAPI) GetBalance(address geth.Address, _ rpc.BlockNumberOrHash) *hexutil.Big {
+	if balance, ok := api.node.balances.Load(address); ok {
+		if balance, ok := balance.(*big.Int); ok {
+			return (*hexutil.Big)(balance)
+		}
+	}
+
+	return (*hexutil.Big)(big.NewInt(1_000_000_000_000_000_000))
+}
+
+func (api *fakeEthAPI) GetTransactionCount(address geth.Address, _ rpc.BlockNumberOrHash) hexutil.Uint64 {
+	if nonce, ok := api.node.nonces.Load(address); ok {
+		if nonce, ok := nonce.(uint64); ok {
+			return hexutil.Uint64(nonce)
+		}
+	}
+
+	return 0
+}
+
+func (api *fakeEthAPI) GetBlockByNumber(number rpc.BlockNumber, fullTx bool) (map[string]any, error) {
+	api.node.mu.Lock()
+	defer api.node.mu.Unlock()
+
+	if number < 0 {
+		number = rpc.BlockNumber(len(api.node.blocks) - 1)
+	}
+	if int(number) >= len(api.node.blocks) {
+		return nil, nil
+	}
+
+	return marshalBlock(api.node.blocks[number], fullTx)
+}
+
+func (api *fakeEthAPI) GetBlockReceipts(blockNrOrHash rpc.BlockNumberOrHash) ([]*types.Receipt, error) {
+	api.node.mu.Lock()
+	defer api.node.mu.Unlock()
+
+	hash, ok := blockNrOrHash.Hash()
+	if !ok {
+		return nil, errors.New("only block hashes are supported")
+	}
+
+	return api.node.receipts[hash], nil
+}
+
+// fakeFilter is the filter of eth_getLogs, only block ranges and recipients of transfers are supported.
+type fakeFilter struct {
+	FromBlock hexutil.Uint64 `json:"fromBlock"`
+	ToBlock   hexutil.Uint64 `json:"toBlock"`
+	Topics    [][]geth.Hash  `json:"topics"`
+}
+
+func (api *fakeEthAPI) GetLogs(filter fakeFilter) ([]*types.Log, error) {
+	api.node.mu.Lock()
+	defer api.node.mu.Unlock()
+
+	recipients := make(map[geth.Hash]bool)
+	if len(filter.Topics) > 2 {
+		for _, topic := range filter.Topics[2] {
+			recipients[topic] = true
+		}
+	}
+
+	logs := make([]*types.Log, 0)
+
+	for number := uint64(filter.FromBlock); number <= uint64(filter.ToBlock) && number < uint64(len(api.node.blocks)); number++ {
+		for _, receipt := range api.node.receipts[api.node.blocks[number].Hash()] {
+			for _, log := range receipt.Logs {
+				if len(recipients) > 0 && !recipients[log.Topics[2]] {
+					continue
+				}
+
+				matched := *log
+				matched.BlockNumber = number
+				matched.BlockHash = receipt.BlockHash
+				logs = append(logs, &matched)
+			}
+		}
+	}
+
+	return logs, nil
+}
+
+func (api *fakeEthAPI) GetCode(address geth.Address, _ rpc.BlockNumberOrHash) hexutil.Bytes {
+	if address == fakeToken {
+		return hexutil.Bytes{0x60}
+	}
+
+	return hexutil.Bytes{}
+}
+
+type fakeCallArgs struct {
+	To    geth.Address  `json:"to"`
+	Input hexutil.Bytes `json:"input"`
+}
+
+// Call implements the symbol, decimals and balanceOf methods of the fakeToken.
+func (api *fakeEthAPI) Call(args fakeCallArgs, _ rpc.BlockNumberOrHash) (hexutil.Bytes, error) {
+	if args.To != fakeToken || len(args.Input) < 4 {
+		return nil, errors.New("execution reverted")
+	}
+
+	switch string(args.Input[:4]) {
+	case string(crypto.Keccak256([]byte("decimals()"))[:4]):
+		return geth.LeftPadBytes([]byte{6}, 32), nil
+	case string(crypto.Keccak256([]byte("symbol()"))[:4]):
+		symbol := []byte("USDT")
+
+		return append(append(geth.LeftPadBytes([]byte{32}, 32), geth.LeftPadBytes([]byte{byte(len(symbol))}, 32)...),
+			geth.RightPadBytes(symbol, 32)...), nil
+	case string(crypto.Keccak256([]byte("balanceOf(address)"))[:4]):
+		balance := new(big.Int)
+		if stored, ok := api.node.tokenBalances.Load(geth.BytesToAddress(args.Input[4:])); ok {
+			if stored, ok := stored.(*big.Int); ok {
+				balance = stored
+			}
+		}
+
+		return geth.LeftPadBytes(balance.Bytes(), 32), nil
+	default:
+		return nil, errors.New("execution reverted")
+	}
+}
+
+func (api *fakeEthAPI) MaxPriorityFeePerGas() *hexutil.Big {
+	return (*hexutil.Big)(big.NewInt(1))
+}
+
+func (api *fakeEthAPI) SendRawTransaction(raw hexutil.Bytes) (geth.Hash, error) {
+	var tx types.Transaction
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		return geth.Hash{}, err
+	}
+
+	api.node.sent.Add(1)
+
+	if api.node.sendError != nil {
+		return geth.Hash{}, api.node.sendError
+	}
+
+	return tx.Hash(), nil
+}
+
+type fakeDebugAPI struct {
+	node *fakeNode
+}
+
+func (api *fakeDebugAPI) TraceBlockByHash(hash geth.Hash, _ map[string]any) ([]fakeTrace, error) {
+	api.node.mu.Lock()
+	defer api.node.mu.Unlock()
+
+	traces, ok := api.node.traces[hash]
+	if !ok {
+		return nil, fmt.Errorf("block %s not found", hash)
+	}
+
+	return traces, nil
+}
+
+func marshalBlock(block *types.Block, fullTx bool) (map[string]any, error) {
+	header, err := json.Marshal(block.Header())
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(header, &fields); err != nil {
+		return nil, err
+	}
+
+	transactions := make([]any, 0, len(block.Transactions()))
+	for _, tx := range block.Transactions() {
+		if fullTx {
+			transactions = append(transactions, tx)
+		} else {
+			transactions = append(transactions, tx.Hash())
+		}
+	}
+
+	fields["hash"] = block.Hash()
+	fields["transactions"] = transactions
+	fields["uncles"] = []any{}
+
+	return fields, nil
+}
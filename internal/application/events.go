@@ -0,0 +1,63 @@
+package application
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+type EventType string
+
+const (
+	EventInvoiceCreated  EventType = "invoice.created"
+	EventInvoicePaid     EventType = "invoice.paid"
+	EventInvoiceExpired  EventType = "invoice.expired"
+	EventPaymentReceived EventType = "payment.received"
+	EventPaymentLate     EventType = "payment.late"
+	EventPaymentReverted EventType = "payment.reverted"
+
+	EventTransferConfirmed EventType = "transfer.confirmed"
+	EventTransferFailed    EventType = "transfer.failed"
+)
+
+type Event struct {
+	Type      EventType
+	InvoiceID domain.ID
+	Status    domain.InvoiceStatus
+	TxHash    domain.Hash
+	Value     domain.WEI
+	CreatedAt time.Time
+}
+
+type EventHandler func(ctx context.Context, event Event)
+
+// OnEvent registers a handler which is called for every published event.
+// Handlers must be registered before the application is run.
+func (a *Application) OnEvent(handler EventHandler) {
+	a.eventHandlers = append(a.eventHandlers, handler)
+}
+
+// publishIfPaid publishes EventInvoicePaid if the invoice has just been settled.
+func (a *Application) publishIfPaid(ctx context.Context, invoice *domain.Invoice, wasSettled bool) {
+	if wasSettled || !invoice.IsSettled() {
+		return
+	}
+
+	a.publish(ctx, Event{
+		Type:      EventInvoicePaid,
+		InvoiceID: invoice.ID(),
+		Status:    invoice.Status(),
+		Value:     invoice.Balance(),
+		CreatedAt: time.Now(),
+	})
+}
+
+func (a *Application) publish(ctx context.Context, event Event) {
+	log.Printf("event %s for invoice %d with status %s\n", event.Type, event.InvoiceID, event.Status)
+
+	for _, handler := range a.eventHandlers {
+		handler(ctx, event)
+	}
+}
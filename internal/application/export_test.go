@@ -0,0 +1,13 @@
+package application
+
+// The jobs are run by the block watcher and the expiration ticker, the tests call them directly.
+var (
+	ExpireInvoices = (*Application).expireInvoices
+	DetectPayment  = (*Application).detectPayment
+	Reconcile      = (*Application).reconcile
+)
+
+var (
+	WebhookBackoff = webhookBackoff
+	DeliverWebhook = (*Webhooks).deliver
+)
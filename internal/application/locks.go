@@ -0,0 +1,90 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+// invoiceLocks serializes changes of each invoice within the instance.
+// The zero value is ready to use.
+type invoiceLocks struct {
+	mu    sync.Mutex
+	locks map[domain.ID]*invoiceLock
+}
+
+type invoiceLock struct {
+	sync.Mutex
+	// holders is the number of goroutines holding or waiting for the lock.
+	holders int
+}
+
+// lock blocks until the invoice is not changed by anyone else and returns the function releasing it.
+func (l *invoiceLocks) lock(id domain.ID) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[domain.ID]*invoiceLock)
+	}
+
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = new(invoiceLock)
+		l.locks[id] = lock
+	}
+	lock.holders++
+	l.mu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		lock.holders--
+		if lock.holders == 0 {
+			delete(l.locks, id)
+		}
+	}
+}
+
+// updateInvoice applies the change to the current state of the invoice and saves it
+// if the change reports that the invoice has changed.
+// Changes of one invoice are serialized within the instance,
+// and the change is applied again to the reloaded invoice if it has been saved by another instance,
+// so concurrent changes never overwrite each other.
+// It returns the invoice after the change and whether it has been saved.
+func (a *Application) updateInvoice(
+	ctx context.Context,
+	id domain.ID,
+	change func(invoice *domain.Invoice) (bool, error),
+) (*domain.Invoice, bool, error) {
+	unlock := a.invoiceLocks.lock(id)
+	defer unlock()
+
+	for {
+		invoice, err := a.repository.GetByID(ctx, id)
+		if err != nil {
+			return nil, false, fmt.Errorf("cannot get invoice: %w", err)
+		}
+
+		changed, err := change(invoice)
+		if err != nil || !changed {
+			return invoice, false, err
+		}
+
+		err = a.repository.Save(ctx, invoice)
+		if errors.Is(err, domain.ErrConcurrentUpdate) {
+			continue
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("cannot save invoice: %w", err)
+		}
+
+		return invoice, true, nil
+	}
+}
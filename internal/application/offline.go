@@ -0,0 +1,189 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+// ExportSweeps builds unsigned sweeps of the unswept invoices to the treasury address,
+// so they can be signed on a machine holding the keys.
+// Nothing is recorded until the signed bundle is imported.
+// Invoices which can't be swept now, e.g. because their balance does not cover the fee, are skipped.
+func (a *Application) ExportSweeps(ctx context.Context) (*infrastructure.UnsignedBundle, error) {
+	if a.treasury == nil {
+		return nil, common.FlagError(fmt.Errorf("treasury address is not configured"), common.FlagConflict)
+	}
+
+	invoices, err := a.repository.GetUnswept(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unswept invoices: %w", err)
+	}
+
+	bundle := infrastructure.NewUnsignedBundle(a.ethereum.ChainID(), time.Now().UTC())
+
+	for _, invoice := range invoices {
+		err := a.exportTransfer(ctx, bundle, invoice, domain.TransferKindSweep, *a.treasury, nil, true)
+		if common.IsFlaggedError(err, common.FlagConflict) {
+			log.Printf("skipping sweep of invoice %d: %s\n", invoice.ID(), err)
+
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return bundle, nil
+}
+
+// ExportRefund builds an unsigned refund from the invoice address to be signed offline.
+// The arguments are the same as for RefundInvoice.
+func (a *Application) ExportRefund(
+	ctx context.Context,
+	id domain.ID,
+	amount domain.WEI,
+	destination *geth.Address,
+	subtractFee bool,
+) (*infrastructure.UnsignedBundle, error) {
+	invoice, err := a.repository.GetByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invoice: %w", err)
+	}
+
+	to, err := refundDestination(invoice, amount, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := infrastructure.NewUnsignedBundle(a.ethereum.ChainID(), time.Now().UTC())
+
+	if err := a.exportTransfer(ctx, bundle, invoice, domain.TransferKindRefund, to, amount, subtractFee); err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+func (a *Application) exportTransfer(
+	ctx context.Context,
+	bundle *infrastructure.UnsignedBundle,
+	invoice *domain.Invoice,
+	kind domain.TransferKind,
+	to geth.Address,
+	amount domain.WEI,
+	subtractFee bool,
+) error {
+	if err := checkTransferable(invoice); err != nil {
+		return err
+	}
+
+	tx, err := a.ethereum.BuildTransfer(ctx, invoice.ID(), to, amount, subtractFee)
+	if err != nil {
+		return fmt.Errorf("failed to build transfer: %w", err)
+	}
+
+	bundle.Add(invoice.ID(), kind, *invoice.Address(), tx)
+
+	return nil
+}
+
+// ImportSigned records the transfers signed offline on their invoices and broadcasts them.
+// Every transfer must be sent from the address of its invoice,
+// and sweeps must be sent to the treasury address.
+// Transfers which have already been imported are returned as they are, so a bundle can be imported again.
+func (a *Application) ImportSigned(ctx context.Context, bundle *infrastructure.SignedBundle) ([]*domain.Transfer, error) {
+	if bundle.Version != infrastructure.BundleVersion {
+		return nil, common.FlagError(fmt.Errorf("unsupported bundle version %d", bundle.Version), common.FlagConflict)
+	}
+
+	transfers := make([]*domain.Transfer, 0, len(bundle.Transactions))
+
+	for _, signed := range bundle.Transactions {
+		transfer, err := a.importSignedTransaction(ctx, signed)
+		if err != nil {
+			return transfers, fmt.Errorf("failed to import transfer of invoice %d: %w", signed.InvoiceID, err)
+		}
+
+		transfers = append(transfers, transfer)
+	}
+
+	return transfers, nil
+}
+
+func (a *Application) importSignedTransaction(
+	ctx context.Context,
+	signed infrastructure.SignedTransaction,
+) (*domain.Transfer, error) {
+	tx, sender, err := a.ethereum.DecodeSignedTransaction(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		transfer *domain.Transfer
+		imported bool
+	)
+
+	_, _, err = a.updateInvoice(ctx, signed.InvoiceID, func(invoice *domain.Invoice) (bool, error) {
+		if sender != *invoice.Address() {
+			return false, common.FlagError(
+				fmt.Errorf("transaction %s is sent from %s instead of %s", tx.Hash(), sender, invoice.Address()),
+				common.FlagConflict,
+			)
+		}
+
+		for _, existing := range invoice.Transfers() {
+			if existing.TxHash() == tx.Hash() {
+				transfer, imported = existing, true
+
+				return false, nil
+			}
+		}
+
+		switch signed.Kind {
+		case domain.TransferKindSweep:
+			if a.treasury == nil || *tx.To() != *a.treasury {
+				return false, common.FlagError(
+					fmt.Errorf("sweep %s is not sent to the treasury address", tx.Hash()),
+					common.FlagConflict,
+				)
+			}
+		case domain.TransferKindRefund:
+			if tx.Value().Cmp(invoice.Refundable()) > 0 {
+				return false, common.FlagError(
+					fmt.Errorf("invoice %d: %w %s", invoice.ID(), domain.ErrRefundExceedsBalance, invoice.Refundable()),
+					common.FlagConflict,
+				)
+			}
+		default:
+			return false, common.FlagError(fmt.Errorf("unknown transfer kind %q", signed.Kind), common.FlagConflict)
+		}
+
+		if err := checkTransferable(invoice); err != nil {
+			return false, err
+		}
+
+		var err error
+
+		transfer, err = recordTransfer(invoice, signed.Kind, tx)
+
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// A transfer imported before has already been sent.
+	if imported {
+		return transfer, nil
+	}
+
+	return a.sendTransfer(ctx, signed.InvoiceID, transfer, tx)
+}
@@ -0,0 +1,139 @@
+package application_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/application"
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestApplication_ImportSigned(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	node := newFakeNode(t)
+
+	endpoints, err := infrastructure.DialEndpoints(ctx, []string{node.URL}, time.Minute, time.Second)
+	require.NoError(t, err)
+
+	wallet, err := infrastructure.NewHDWallet(testMnemonic)
+	require.NoError(t, err)
+
+	repository := infrastructure.NewRepository()
+	for id := domain.ID(1); id <= 2; id++ {
+		address, err := wallet.GetInvoiceAccount(id)
+		require.NoError(t, err)
+
+		invoice := domain.NewInvoice(
+			id, big.NewInt(1_000), big.NewInt(1_000), address, nil, nil, domain.InvoiceStatusPaid, big.NewInt(0), 1, time.Time{}, nil, nil, nil,
+		)
+		require.NoError(t, repository.Save(ctx, invoice))
+	}
+
+	treasury := geth.HexToAddress("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	payer := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+
+	ethereum := infrastructure.NewEthereum(endpoints, nil, wallet, nil, time.Second)
+	sut := application.NewApplication(ethereum, repository, 1, domain.Tolerance{}, 0, &treasury, nil, false)
+
+	// sign signs the transfer with the key of the invoice keyID for the chain.
+	sign := func(id, keyID domain.ID, kind domain.TransferKind, to geth.Address, value int64, chainID int64) *infrastructure.SignedBundle {
+		tx := types.NewTx(&types.DynamicFeeTx{
+			ChainID:   big.NewInt(chainID),
+			Nonce:     0,
+			GasTipCap: big.NewInt(1),
+			GasFeeCap: big.NewInt(2),
+			Gas:       infrastructure.TransferGasLimit,
+			To:        &to,
+			Value:     big.NewInt(value),
+		})
+
+		tx, err := wallet.SignInvoiceTransaction(ctx, keyID, tx, types.LatestSignerForChainID(big.NewInt(chainID)))
+		require.NoError(t, err)
+
+		raw, err := tx.MarshalBinary()
+		require.NoError(t, err)
+
+		return &infrastructure.SignedBundle{
+			Version: infrastructure.BundleVersion,
+			ChainID: big.NewInt(chainID),
+			Transactions: []infrastructure.SignedTransaction{
+				{InvoiceID: id, Kind: kind, Raw: raw},
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		bundle *infrastructure.SignedBundle
+		err    string
+	}{
+		{
+			name:   "wrong sender",
+			bundle: sign(1, 2, domain.TransferKindRefund, payer, 600, 1337),
+			err:    "instead of " + invoiceAddress(t, wallet, 1).Hex(),
+		},
+		{
+			name:   "sweep not to treasury",
+			bundle: sign(1, 1, domain.TransferKindSweep, payer, 900, 1337),
+			err:    "is not sent to the treasury address",
+		},
+		{
+			name:   "refund above refundable",
+			bundle: sign(1, 1, domain.TransferKindRefund, payer, 1_001, 1337),
+			err:    domain.ErrRefundExceedsBalance.Error(),
+		},
+		{
+			name:   "wrong chain",
+			bundle: sign(1, 1, domain.TransferKindRefund, payer, 600, 1),
+			err:    "is signed for chain 1 instead of 1337",
+		},
+	}
+
+	for _, tt := range tests {
+		transfers, err := sut.ImportSigned(ctx, tt.bundle)
+		assert.True(t, common.IsFlaggedError(err, common.FlagConflict), "%s: %v", tt.name, err)
+		assert.ErrorContains(t, err, tt.err, tt.name)
+		assert.Empty(t, transfers, tt.name)
+	}
+
+	assert.Equal(t, int32(0), node.sent.Load())
+
+	bundle := sign(1, 1, domain.TransferKindRefund, payer, 600, 1337)
+
+	transfers, err := sut.ImportSigned(ctx, bundle)
+	require.NoError(t, err)
+	require.Len(t, transfers, 1)
+	assert.Equal(t, domain.TransferStatusPending, transfers[0].Status())
+	assert.Equal(t, int32(1), node.sent.Load())
+
+	// The bundle imported again returns the recorded transfer without broadcasting it again.
+	reimported, err := sut.ImportSigned(ctx, bundle)
+	require.NoError(t, err)
+	require.Len(t, reimported, 1)
+	assert.Equal(t, transfers[0].TxHash(), reimported[0].TxHash())
+	assert.Equal(t, int32(1), node.sent.Load())
+
+	saved, err := repository.GetByID(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, saved.Transfers(), 1)
+}
+
+func invoiceAddress(t *testing.T, wallet *infrastructure.HDWallet, id domain.ID) geth.Address {
+	t.Helper()
+
+	address, err := wallet.GetInvoiceAccount(id)
+	require.NoError(t, err)
+
+	return *address
+}
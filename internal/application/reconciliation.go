@@ -0,0 +1,257 @@
+package application
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+// ReconciliationLoadAttempts is how many times open invoices are loaded
+// before the reconciliation is postponed because blocks are handled too fast.
+const ReconciliationLoadAttempts = 3
+
+// balanceMismatches counts invoice addresses which balance did not match the expected one.
+var balanceMismatches = expvar.NewInt("reconciliation_mismatches")
+
+type DiscrepancyRepository interface {
+	GetOpen(ctx context.Context) ([]*domain.Invoice, error)
+	SaveDiscrepancy(ctx context.Context, discrepancy *domain.Discrepancy) error
+	GetDiscrepancy(ctx context.Context, id uint64) (*domain.Discrepancy, error)
+	GetDiscrepancies(ctx context.Context, status domain.DiscrepancyStatus) ([]*domain.Discrepancy, error)
+}
+
+// ReconciliationReport is the result of a single reconciliation of invoice balances.
+type ReconciliationReport struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// BlockNumber is the last handled block, at which balances are compared.
+	BlockNumber uint64
+	Checked     int
+	// Skipped invoices have pending transfers, so their expected balance is not known yet,
+	// or changes from the block being handled, so it is not comparable with the balance at the checkpoint.
+	Skipped    int
+	Failed     int
+	Mismatches []BalanceMismatch
+}
+
+type BalanceMismatch struct {
+	InvoiceID domain.ID
+	Address   geth.Address
+	Expected  domain.WEI
+	Actual    domain.WEI
+}
+
+// RunReconciler periodically compares on-chain balances of open invoice addresses
+// with the balances expected from the recorded payments and transfers.
+// Mismatches are logged and reported, and if openDiscrepancies is set,
+// a discrepancy is opened for every mismatched invoice until an operator resolves it.
+func (a *Application) RunReconciler(
+	ctx context.Context,
+	interval time.Duration,
+	openDiscrepancies bool,
+) common.ErrorGroupGoroutine {
+	return func() error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		log.Println("start reconciling invoice balances")
+		for {
+			select {
+			case <-ctx.Done():
+				log.Println("reconciling invoice balances stopped")
+
+				return nil
+			case <-ticker.C:
+			}
+
+			if err := a.reconcile(ctx, openDiscrepancies); err != nil {
+				log.Printf("failed to reconcile invoice balances: %s\n", err)
+			}
+		}
+	}
+}
+
+func (a *Application) reconcile(ctx context.Context, openDiscrepancies bool) error {
+	checkpoint, invoices, err := a.getOpenAtCheckpoint(ctx)
+	if common.IsFlaggedError(err, common.FlagNotFound) {
+		// No block has been handled yet.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	report := &ReconciliationReport{
+		StartedAt:   time.Now().UTC(),
+		BlockNumber: checkpoint.Number,
+	}
+
+	for _, invoice := range invoices {
+		if invoice.PendingTransfer() != nil || invoice.ChangedAfter(checkpoint.Number) {
+			report.Skipped++
+
+			continue
+		}
+
+		actual, err := a.ethereum.GetBalance(ctx, *invoice.Address(), invoice.Token(), checkpoint.Number)
+		if err != nil {
+			log.Printf("failed to get balance of invoice %d: %s\n", invoice.ID(), err)
+			report.Failed++
+
+			continue
+		}
+
+		report.Checked++
+
+		expected := invoice.ExpectedBalance()
+		if actual.Cmp(expected) == 0 {
+			continue
+		}
+
+		balanceMismatches.Add(1)
+		log.Printf(
+			"balance of invoice %d address %s is %s instead of %s at block %d\n",
+			invoice.ID(), invoice.Address(), actual, expected, checkpoint.Number,
+		)
+
+		mismatch := BalanceMismatch{
+			InvoiceID: invoice.ID(),
+			Address:   *invoice.Address(),
+			Expected:  expected,
+			Actual:    actual,
+		}
+		report.Mismatches = append(report.Mismatches, mismatch)
+
+		if openDiscrepancies {
+			if err := a.openDiscrepancy(ctx, mismatch, checkpoint.Number); err != nil {
+				log.Printf("failed to open discrepancy of invoice %d: %s\n", invoice.ID(), err)
+			}
+		}
+	}
+
+	report.FinishedAt = time.Now().UTC()
+
+	a.mu.Lock()
+	a.reconciliation = report
+	a.mu.Unlock()
+
+	log.Printf(
+		"reconciled %d invoices at block %d: %d mismatched, %d skipped, %d failed\n",
+		report.Checked, report.BlockNumber, len(report.Mismatches), report.Skipped, report.Failed,
+	)
+
+	return nil
+}
+
+// getOpenAtCheckpoint returns the open invoices together with the checkpoint their state corresponds to.
+// Invoices are saved while blocks are handled, before the checkpoint is moved to the handled block,
+// so the invoices are loaded again if the checkpoint has moved while they were loaded.
+// The loaded invoices still may have changes from the block after the checkpoint, which is being handled.
+func (a *Application) getOpenAtCheckpoint(ctx context.Context) (infrastructure.Checkpoint, []*domain.Invoice, error) {
+	for attempt := 0; attempt < ReconciliationLoadAttempts; attempt++ {
+		checkpoint, err := a.repository.GetCheckpoint(ctx)
+		if err != nil {
+			return checkpoint, nil, fmt.Errorf("cannot get checkpoint: %w", err)
+		}
+
+		invoices, err := a.repository.GetOpen(ctx)
+		if err != nil {
+			return checkpoint, nil, fmt.Errorf("cannot get open invoices: %w", err)
+		}
+
+		current, err := a.repository.GetCheckpoint(ctx)
+		if err != nil {
+			return checkpoint, nil, fmt.Errorf("cannot get checkpoint: %w", err)
+		}
+
+		if current.Number == checkpoint.Number && current.Hash == checkpoint.Hash {
+			return checkpoint, invoices, nil
+		}
+	}
+
+	return infrastructure.Checkpoint{}, nil, fmt.Errorf(
+		"checkpoint has moved while loading open invoices %d times", ReconciliationLoadAttempts,
+	)
+}
+
+// openDiscrepancy opens a discrepancy for the mismatch or updates the open one of the invoice.
+func (a *Application) openDiscrepancy(ctx context.Context, mismatch BalanceMismatch, blockNumber uint64) error {
+	open, err := a.repository.GetDiscrepancies(ctx, domain.DiscrepancyStatusOpen)
+	if err != nil {
+		return fmt.Errorf("cannot get open discrepancies: %w", err)
+	}
+
+	var discrepancy *domain.Discrepancy
+
+	for _, existing := range open {
+		if existing.InvoiceID() == mismatch.InvoiceID {
+			discrepancy = existing
+			discrepancy.Recheck(mismatch.Expected, mismatch.Actual, blockNumber)
+
+			break
+		}
+	}
+
+	if discrepancy == nil {
+		discrepancy = domain.NewOpenDiscrepancy(
+			mismatch.InvoiceID, mismatch.Address, mismatch.Expected, mismatch.Actual, blockNumber, time.Now().UTC(),
+		)
+	}
+
+	if err := a.repository.SaveDiscrepancy(ctx, discrepancy); err != nil {
+		return fmt.Errorf("cannot save discrepancy: %w", err)
+	}
+
+	return nil
+}
+
+// GetReconciliationReport returns the report of the last reconciliation or nil if there was none.
+func (a *Application) GetReconciliationReport() *ReconciliationReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.reconciliation
+}
+
+// GetDiscrepancies returns discrepancies with the status or all of them if the status is empty.
+func (a *Application) GetDiscrepancies(
+	ctx context.Context,
+	status domain.DiscrepancyStatus,
+) ([]*domain.Discrepancy, error) {
+	discrepancies, err := a.repository.GetDiscrepancies(ctx, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get discrepancies: %w", err)
+	}
+
+	return discrepancies, nil
+}
+
+// ResolveDiscrepancy closes the open discrepancy with the note of the operator.
+func (a *Application) ResolveDiscrepancy(
+	ctx context.Context,
+	id uint64,
+	resolution string,
+) (*domain.Discrepancy, error) {
+	discrepancy, err := a.repository.GetDiscrepancy(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get discrepancy: %w", err)
+	}
+
+	if err := discrepancy.Resolve(resolution, time.Now().UTC()); err != nil {
+		return nil, common.FlagError(fmt.Errorf("discrepancy %d: %w", id, err), common.FlagConflict)
+	}
+
+	if err := a.repository.SaveDiscrepancy(ctx, discrepancy); err != nil {
+		return nil, fmt.Errorf("failed to save discrepancy: %w", err)
+	}
+
+	return discrepancy, nil
+}
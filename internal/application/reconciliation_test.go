@@ -0,0 +1,108 @@
+package application_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/application"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestApplication_Reconcile(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	node := newFakeNode(t)
+
+	endpoints, err := infrastructure.DialEndpoints(ctx, []string{node.URL}, time.Minute, time.Second)
+	require.NoError(t, err)
+
+	repository := infrastructure.NewRepository()
+	ethereum := infrastructure.NewEthereum(endpoints, nil, nil, nil, time.Second)
+	sut := application.NewApplication(ethereum, repository, 1, domain.Tolerance{}, 0, nil, nil, false)
+
+	// No block has been handled yet.
+	require.NoError(t, application.Reconcile(sut, ctx, true))
+	assert.Nil(t, sut.GetReconciliationReport())
+
+	saveInvoice := func(id domain.ID, blockNumber uint64, transfers ...*domain.Transfer) geth.Address {
+		address := geth.BigToAddress(big.NewInt(int64(id)))
+		payment := domain.NewDetectedPayment(
+			geth.BigToHash(big.NewInt(int64(id))), domain.PaymentKindTransaction, 0, blockNumber, geth.Hash{1},
+			geth.Address{1}, big.NewInt(1_000), time.Unix(10, 0).UTC(), 21_000, big.NewInt(1), true,
+		)
+		invoice := domain.NewInvoice(
+			id, big.NewInt(1_000), big.NewInt(1_000), &address, nil, nil, domain.InvoiceStatusPaid, big.NewInt(0), 1,
+			time.Unix(1, 0).UTC(), nil, []*domain.Payment{payment}, transfers,
+		)
+		require.NoError(t, repository.Save(ctx, invoice))
+		node.balances.Store(address, big.NewInt(1_000))
+
+		return address
+	}
+
+	saveInvoice(1, 5)
+	mismatched := saveInvoice(2, 5)
+	saveInvoice(3, 11)
+	saveInvoice(4, 5, domain.NewPendingTransfer(
+		domain.TransferKindSweep, geth.Hash{4}, geth.Address{2}, big.NewInt(900), 0, big.NewInt(100), time.Unix(20, 0).UTC(),
+	))
+
+	node.balances.Store(mismatched, big.NewInt(400))
+	require.NoError(t, repository.SaveCheckpoint(ctx, infrastructure.Checkpoint{Number: 10, Hash: geth.Hash{10}, Ancestors: nil}))
+	require.NoError(t, application.Reconcile(sut, ctx, true))
+
+	// The invoice with the payment after the checkpoint and the one with the pending transfer are skipped.
+	report := sut.GetReconciliationReport()
+	require.NotNil(t, report)
+	assert.Equal(t, uint64(10), report.BlockNumber)
+	assert.Equal(t, 2, report.Checked)
+	assert.Equal(t, 2, report.Skipped)
+	assert.Equal(t, []application.BalanceMismatch{{
+		InvoiceID: 2,
+		Address:   mismatched,
+		Expected:  big.NewInt(1_000),
+		Actual:    big.NewInt(400),
+	}}, report.Mismatches)
+
+	discrepancies, err := sut.GetDiscrepancies(ctx, domain.DiscrepancyStatusOpen)
+	require.NoError(t, err)
+	require.Len(t, discrepancies, 1)
+	opened := discrepancies[0]
+	assert.Equal(t, domain.ID(2), opened.InvoiceID())
+	assert.Equal(t, big.NewInt(400), opened.Actual())
+	assert.Equal(t, uint64(10), opened.BlockNumber())
+
+	// The repeated mismatch updates the open discrepancy instead of opening another one.
+	node.balances.Store(mismatched, big.NewInt(300))
+	require.NoError(t, repository.SaveCheckpoint(ctx, infrastructure.Checkpoint{Number: 11, Hash: geth.Hash{11}, Ancestors: nil}))
+	require.NoError(t, application.Reconcile(sut, ctx, true))
+
+	report = sut.GetReconciliationReport()
+	assert.Equal(t, 3, report.Checked)
+	assert.Equal(t, 1, report.Skipped)
+	require.Len(t, report.Mismatches, 1)
+
+	discrepancies, err = sut.GetDiscrepancies(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, discrepancies, 1)
+	assert.Equal(t, opened.ID(), discrepancies[0].ID())
+	assert.Equal(t, big.NewInt(300), discrepancies[0].Actual())
+	assert.Equal(t, uint64(11), discrepancies[0].BlockNumber())
+
+	resolved, err := sut.ResolveDiscrepancy(ctx, opened.ID(), "refunded by the payer")
+	require.NoError(t, err)
+	assert.Equal(t, domain.DiscrepancyStatusResolved, resolved.Status())
+	assert.Equal(t, "refunded by the payer", resolved.Resolution())
+	assert.NotNil(t, resolved.ResolvedAt())
+
+	_, err = sut.ResolveDiscrepancy(ctx, opened.ID(), "again")
+	assert.ErrorIs(t, err, domain.ErrDiscrepancyResolved)
+}
@@ -0,0 +1,643 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+// RecoveryProgressInterval is the number of scanned blocks between progress messages.
+const RecoveryProgressInterval = 10_000
+
+// RecoveryReport summarizes invoices rebuilt from the chain.
+type RecoveryReport struct {
+	// HeadNumber is the block up to which the chain was scanned.
+	HeadNumber uint64
+	// Checked is the number of derivation indices whose addresses were checked.
+	Checked   uint64
+	Recovered []domain.ID
+	// Skipped invoices already exist in the repository and are left untouched.
+	Skipped []domain.ID
+	// Unexplained invoices have less on their addresses than the scanned blocks explain,
+	// so they are not saved and must be recovered manually.
+	Unexplained []domain.ID
+	Payments    int
+	Transfers   int
+}
+
+// recoveredAccount is an invoice address with activity on the chain.
+type recoveredAccount struct {
+	id      domain.ID
+	address geth.Address
+	balance *big.Int
+	nonce   uint64
+	// token is the contract of the first token received by the address, nil if none was received.
+	token *geth.Address
+	// tokenTransfers are all token transfers received by the address in the scanned blocks.
+	tokenTransfers []infrastructure.TokenTransfer
+
+	payments  []*domain.Payment
+	transfers []*domain.Transfer
+}
+
+// Recover rebuilds invoices from the chain when the repository is lost.
+// Invoice addresses are derived by their ids in order until gapLimit consecutive addresses
+// have no balance, no sent transactions and no received tokens.
+// Blocks from fromBlock to the head are then scanned for deposits to the used addresses
+// and for transfers sent from them. Deposits made before fromBlock are not found,
+// so the rest of the balance is recorded as the opening balance of the invoice.
+// The price of the original invoice is lost, so the recovered invoice is priced at its deposits less refunds.
+// Invoices which are already in the repository are skipped, so the recovery can be repeated.
+func (a *Application) Recover(ctx context.Context, gapLimit uint64, fromBlock uint64) (*RecoveryReport, error) {
+	if gapLimit == 0 {
+		return nil, fmt.Errorf("gap limit must be positive")
+	}
+
+	head, err := a.ethereum.GetBlock(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get head block: %w", err)
+	}
+	if fromBlock > head.NumberU64() {
+		return nil, fmt.Errorf("block %d is after the head block %d", fromBlock, head.NumberU64())
+	}
+
+	report := &RecoveryReport{
+		HeadNumber: head.NumberU64(),
+	}
+
+	accounts, err := a.findUsedAccounts(ctx, gapLimit, fromBlock, head.NumberU64(), report)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("found %d used invoice addresses of %d checked\n", len(accounts), report.Checked)
+
+	if err := a.scanHistory(ctx, accounts, fromBlock, head.NumberU64()); err != nil {
+		return nil, err
+	}
+
+	openingNumber := fromBlock
+	if openingNumber > 0 {
+		openingNumber--
+	}
+
+	opening, err := a.ethereum.GetBlock(ctx, new(big.Int).SetUint64(openingNumber))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get opening block %d: %w", openingNumber, err)
+	}
+
+	for _, account := range accounts {
+		if err := a.saveRecovered(ctx, account, opening, head, report); err != nil {
+			return nil, fmt.Errorf("failed to save invoice %d: %w", account.id, err)
+		}
+	}
+
+	if len(accounts) > 0 {
+		if err := a.reserveIDs(ctx, accounts[len(accounts)-1].id); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.recoverCheckpoint(ctx, head); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// findUsedAccounts checks invoice addresses in batches of gapLimit
+// until gapLimit consecutive addresses are unused.
+func (a *Application) findUsedAccounts(
+	ctx context.Context,
+	gapLimit uint64,
+	fromBlock uint64,
+	headNumber uint64,
+	report *RecoveryReport,
+) ([]*recoveredAccount, error) {
+	var (
+		accounts []*recoveredAccount
+		gap      uint64
+	)
+
+	// Invoice ids start from one.
+	for next := domain.ID(1); gap < gapLimit; next += domain.ID(gapLimit) {
+		batch := make([]*recoveredAccount, 0, gapLimit)
+		addresses := make([]geth.Address, 0, gapLimit)
+
+		for id := next; id < next+domain.ID(gapLimit); id++ {
+			address, err := a.ethereum.GetInvoiceAccount(id)
+			if err != nil {
+				return nil, fmt.Errorf("failed to derive address of invoice %d: %w", id, err)
+			}
+
+			batch = append(batch, &recoveredAccount{id: id, address: *address})
+			addresses = append(addresses, *address)
+		}
+
+		transfers, err := a.ethereum.GetTokenTransfersTo(ctx, addresses, fromBlock, headNumber)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, account := range batch {
+			if gap >= gapLimit {
+				break
+			}
+
+			report.Checked++
+
+			used, err := a.checkAccount(ctx, account, transfers, headNumber)
+			if err != nil {
+				return nil, err
+			}
+
+			if !used {
+				gap++
+
+				continue
+			}
+
+			gap = 0
+			accounts = append(accounts, account)
+		}
+	}
+
+	return accounts, nil
+}
+
+// checkAccount reports whether the address of the account has ever been used.
+func (a *Application) checkAccount(
+	ctx context.Context,
+	account *recoveredAccount,
+	transfers []infrastructure.TokenTransfer,
+	headNumber uint64,
+) (bool, error) {
+	for _, transfer := range transfers {
+		if transfer.To != account.address {
+			continue
+		}
+
+		if account.token == nil {
+			token := transfer.Token
+			account.token = &token
+		}
+
+		account.tokenTransfers = append(account.tokenTransfers, transfer)
+	}
+
+	balance, err := a.ethereum.GetBalance(ctx, account.address, nil, headNumber)
+	if err != nil {
+		return false, err
+	}
+
+	nonce, err := a.ethereum.GetNonce(ctx, account.address)
+	if err != nil {
+		return false, err
+	}
+
+	account.balance = balance
+	account.nonce = nonce
+
+	return account.token != nil || balance.Sign() > 0 || nonce > 0, nil
+}
+
+// scanHistory collects deposits to the accounts and transfers from them in the blocks up to the head.
+func (a *Application) scanHistory(
+	ctx context.Context,
+	accounts []*recoveredAccount,
+	fromBlock uint64,
+	headNumber uint64,
+) error {
+	if len(accounts) == 0 {
+		return nil
+	}
+
+	byAddress := make(map[geth.Address]*recoveredAccount, len(accounts))
+	transfersByBlock := make(map[uint64][]infrastructure.TokenTransfer)
+	senders := false
+
+	for _, account := range accounts {
+		byAddress[account.address] = account
+		senders = senders || account.nonce > 0
+
+		for _, transfer := range account.tokenTransfers {
+			transfersByBlock[transfer.BlockNumber] = append(transfersByBlock[transfer.BlockNumber], transfer)
+		}
+	}
+
+	for number := fromBlock; number <= headNumber; number++ {
+		if (number-fromBlock)%RecoveryProgressInterval == 0 {
+			log.Printf("scanning block %d of %d\n", number, headNumber)
+		}
+
+		var block *types.Block
+
+		err := retry(ctx, func() error {
+			var err error
+
+			block, err = a.ethereum.GetBlock(ctx, new(big.Int).SetUint64(number))
+
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get block %d: %w", number, err)
+		}
+
+		err = retry(ctx, func() error {
+			return a.scanBlock(ctx, block, byAddress, transfersByBlock[number], senders)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan block %d: %w", number, err)
+		}
+	}
+
+	return nil
+}
+
+// scanBlock records deposits and transfers of the accounts included in the block.
+// Every call collects the block from scratch, so it can be retried.
+func (a *Application) scanBlock(
+	ctx context.Context,
+	block *types.Block,
+	accounts map[geth.Address]*recoveredAccount,
+	tokenTransfers []infrastructure.TokenTransfer,
+	senders bool,
+) error {
+	var (
+		payments  = make(map[*recoveredAccount][]*domain.Payment)
+		transfers = make(map[*recoveredAccount][]*domain.Transfer)
+	)
+
+	for _, tx := range block.Transactions() {
+		if tx.To() != nil {
+			if account, ok := accounts[*tx.To()]; ok && account.token == nil {
+				payment, err := a.recoverPayment(
+					ctx, block, tx, domain.PaymentKindTransaction, 0, nil, tx.Value(),
+				)
+				if err != nil {
+					return err
+				}
+
+				if payment != nil {
+					payments[account] = append(payments[account], payment)
+				}
+			}
+		}
+
+		if !senders {
+			continue
+		}
+
+		sender, err := a.ethereum.GetSender(tx)
+		if err != nil {
+			return err
+		}
+
+		// Transfers are sent only from ether invoices.
+		if account, ok := accounts[sender]; ok && account.token == nil {
+			transfer, err := a.recoverTransfer(ctx, block, tx)
+			if err != nil {
+				return err
+			}
+
+			transfers[account] = append(transfers[account], transfer)
+		}
+	}
+
+	for _, transfer := range tokenTransfers {
+		account, ok := accounts[transfer.To]
+		if !ok || account.token == nil || *account.token != transfer.Token {
+			continue
+		}
+
+		tx := block.Transaction(transfer.TxHash)
+		if tx == nil {
+			return fmt.Errorf("transaction %s not found in block %s", transfer.TxHash, block.Hash())
+		}
+
+		from := transfer.From
+
+		payment, err := a.recoverPayment(
+			ctx, block, tx, domain.PaymentKindTokenTransfer, transfer.LogIndex, &from, transfer.Value,
+		)
+		if err != nil {
+			return err
+		}
+
+		if payment != nil {
+			payments[account] = append(payments[account], payment)
+		}
+	}
+
+	if a.traceInternalCalls {
+		internalTransfers, err := a.ethereum.GetInternalTransfers(ctx, block)
+		if err != nil {
+			return err
+		}
+
+		for _, transfer := range internalTransfers {
+			account, ok := accounts[transfer.To]
+			if !ok || account.token != nil {
+				continue
+			}
+
+			tx := block.Transaction(transfer.TxHash)
+			if tx == nil {
+				return fmt.Errorf("transaction %s not found in block %s", transfer.TxHash, block.Hash())
+			}
+
+			from := transfer.From
+
+			payment, err := a.recoverPayment(
+				ctx, block, tx, domain.PaymentKindInternalCall, transfer.Index, &from, transfer.Value,
+			)
+			if err != nil {
+				return err
+			}
+
+			if payment != nil {
+				payments[account] = append(payments[account], payment)
+			}
+		}
+	}
+
+	for account, recovered := range payments {
+		account.payments = append(account.payments, recovered...)
+	}
+
+	for account, recovered := range transfers {
+		account.transfers = append(account.transfers, recovered...)
+	}
+
+	return nil
+}
+
+// recoverPayment builds the payment made by the transaction or returns nil if the transaction failed.
+// The sender of the transaction is used if from is nil.
+// Payments by internal calls are never verified, because the block header commits to no trace data.
+func (a *Application) recoverPayment(
+	ctx context.Context,
+	block *types.Block,
+	tx *types.Transaction,
+	kind domain.PaymentKind,
+	index uint64,
+	from *geth.Address,
+	value *big.Int,
+) (*domain.Payment, error) {
+	receipt, verified, err := a.ethereum.GetVerifiedReceipt(ctx, block, tx.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("cannot get receipt of transaction %s: %w", tx.Hash(), err)
+	}
+
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return nil, nil
+	}
+
+	if from == nil {
+		sender, err := a.ethereum.GetSender(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		from = &sender
+	}
+
+	return domain.NewDetectedPayment(
+		tx.Hash(),
+		kind,
+		index,
+		block.NumberU64(),
+		block.Hash(),
+		*from,
+		value,
+		time.Unix(int64(block.Time()), 0).UTC(),
+		receipt.GasUsed,
+		effectiveGasPrice(tx, receipt, block.BaseFee()),
+		verified && kind != domain.PaymentKindInternalCall,
+	), nil
+}
+
+// recoverTransfer builds the transfer sent by the transaction from an invoice address.
+// Transfers to the treasury are sweeps, the rest are refunds.
+func (a *Application) recoverTransfer(
+	ctx context.Context,
+	block *types.Block,
+	tx *types.Transaction,
+) (*domain.Transfer, error) {
+	receipt, _, err := a.ethereum.GetVerifiedReceipt(ctx, block, tx.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("cannot get receipt of transaction %s: %w", tx.Hash(), err)
+	}
+
+	var to geth.Address
+	if tx.To() != nil {
+		to = *tx.To()
+	}
+
+	kind := domain.TransferKindRefund
+	if a.treasury != nil && to == *a.treasury {
+		kind = domain.TransferKindSweep
+	}
+
+	status := domain.TransferStatusConfirmed
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		status = domain.TransferStatusFailed
+	}
+
+	return domain.NewTransfer(
+		kind,
+		tx.Hash(),
+		to,
+		tx.Value(),
+		tx.Nonce(),
+		new(big.Int).Mul(tx.GasFeeCap(), new(big.Int).SetUint64(tx.Gas())),
+		time.Unix(int64(block.Time()), 0).UTC(),
+		status,
+		block.NumberU64(),
+		receipt.GasUsed,
+		effectiveGasPrice(tx, receipt, block.BaseFee()),
+	), nil
+}
+
+// saveRecovered saves the invoice rebuilt from the account
+// unless the repository already has an invoice with its id.
+// The part of the balance at the head block which is not explained by the recovered payments and transfers
+// is recorded as an opening balance at the opening block, the last one before the scanned blocks.
+// The recovered invoice is priced at its payments less the refunds, so it is settled.
+// If the balance is less than the recovered one, the history of the invoice can't be rebuilt,
+// so it is not saved and reported as unexplained.
+func (a *Application) saveRecovered(
+	ctx context.Context,
+	account *recoveredAccount,
+	opening *types.Block,
+	head *types.Block,
+	report *RecoveryReport,
+) error {
+	_, err := a.repository.GetByID(ctx, account.id)
+	if err == nil {
+		report.Skipped = append(report.Skipped, account.id)
+
+		return nil
+	}
+	if !common.IsFlaggedError(err, common.FlagNotFound) {
+		return fmt.Errorf("cannot get invoice: %w", err)
+	}
+
+	var token *domain.Token
+	balance := account.balance
+
+	if account.token != nil {
+		token, err = a.ethereum.GetToken(ctx, *account.token)
+		if err != nil {
+			return fmt.Errorf("failed to get token: %w", err)
+		}
+
+		balance, err = a.ethereum.GetBalance(ctx, account.address, token, head.NumberU64())
+		if err != nil {
+			return fmt.Errorf("failed to get token balance: %w", err)
+		}
+	}
+
+	invoice := domain.NewInvoice(
+		account.id,
+		big.NewInt(0),
+		big.NewInt(0),
+		&account.address,
+		token,
+		nil,
+		domain.InvoiceStatusPending,
+		big.NewInt(0),
+		a.requiredConfirmations,
+		time.Unix(int64(head.Time()), 0).UTC(),
+		nil,
+		account.payments,
+		account.transfers,
+	)
+
+	unexplained := new(big.Int).Sub(balance, invoice.ExpectedBalance())
+	if unexplained.Sign() < 0 {
+		log.Printf(
+			"balance %s of invoice %d at %s is less than %s expected from the scanned blocks, it must be recovered manually\n",
+			balance, account.id, account.address, invoice.ExpectedBalance(),
+		)
+
+		report.Unexplained = append(report.Unexplained, account.id)
+
+		return nil
+	}
+
+	if unexplained.Sign() > 0 {
+		log.Printf(
+			"balance %s of invoice %d is not explained by the scanned blocks, it is recorded as the opening balance at block %d\n",
+			unexplained, account.id, opening.NumberU64(),
+		)
+
+		account.payments = append(account.payments, domain.NewDetectedPayment(
+			geth.Hash{},
+			domain.PaymentKindOpeningBalance,
+			0,
+			opening.NumberU64(),
+			opening.Hash(),
+			geth.Address{},
+			unexplained,
+			time.Unix(int64(opening.Time()), 0).UTC(),
+			0,
+			big.NewInt(0),
+			false,
+		))
+	}
+
+	price := new(big.Int).Neg(invoice.Refunded())
+	createdAt := time.Unix(int64(head.Time()), 0).UTC()
+
+	for _, payment := range account.payments {
+		price.Add(price, payment.Value())
+
+		if payment.Timestamp().Before(createdAt) {
+			createdAt = payment.Timestamp()
+		}
+	}
+
+	invoice = domain.NewInvoice(
+		account.id,
+		price,
+		big.NewInt(0),
+		&account.address,
+		token,
+		nil,
+		domain.InvoiceStatusPending,
+		big.NewInt(0),
+		a.requiredConfirmations,
+		createdAt,
+		nil,
+		nil,
+		account.transfers,
+	)
+
+	for _, payment := range account.payments {
+		invoice.Detect(payment)
+	}
+	invoice.UpdateConfirmations(head.NumberU64())
+
+	if err := a.repository.Save(ctx, invoice); err != nil {
+		return fmt.Errorf("cannot save invoice: %w", err)
+	}
+
+	log.Printf(
+		"recovered invoice %d at %s with %d payments and %d transfers\n",
+		invoice.ID(), account.address, len(account.payments), len(account.transfers),
+	)
+
+	report.Recovered = append(report.Recovered, account.id)
+	report.Payments += len(account.payments)
+	report.Transfers += len(account.transfers)
+
+	return nil
+}
+
+// reserveIDs advances the id sequence past the recovered invoices,
+// so new invoices do not reuse their addresses.
+func (a *Application) reserveIDs(ctx context.Context, lastID domain.ID) error {
+	for {
+		id, err := a.repository.GetID(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get invoice id: %w", err)
+		}
+
+		if id >= lastID {
+			return nil
+		}
+	}
+}
+
+// recoverCheckpoint makes the service continue from the head block if the checkpoint is lost as well,
+// so blocks mined after the recovery are handled as usual.
+func (a *Application) recoverCheckpoint(ctx context.Context, head *types.Block) error {
+	_, err := a.repository.GetCheckpoint(ctx)
+	if err == nil {
+		return nil
+	}
+	if !common.IsFlaggedError(err, common.FlagNotFound) {
+		return fmt.Errorf("failed to get checkpoint: %w", err)
+	}
+
+	checkpoint := infrastructure.Checkpoint{
+		Number:    head.NumberU64(),
+		Hash:      head.Hash(),
+		Ancestors: nil,
+	}
+	if err := a.repository.SaveCheckpoint(ctx, checkpoint); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+package application_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/application"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestApplication_Recover(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	node := newFakeNode(t)
+
+	endpoints, err := infrastructure.DialEndpoints(ctx, []string{node.URL}, time.Minute, time.Second)
+	require.NoError(t, err)
+
+	wallet, err := infrastructure.NewHDWallet(testMnemonic)
+	require.NoError(t, err)
+
+	payerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	payer := crypto.PubkeyToAddress(payerKey.PublicKey)
+	treasury := geth.HexToAddress("0x5f4eC3Df9cbd43714FE2740f5E3616155c5b8419")
+	contract := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	signer := types.LatestSignerForChainID(big.NewInt(1337))
+
+	addresses := make(map[domain.ID]geth.Address)
+	for id := domain.ID(1); id <= 8; id++ {
+		addresses[id] = invoiceAddress(t, wallet, id)
+		node.balances.Store(addresses[id], big.NewInt(0))
+	}
+
+	// sign signs a transaction of the payer or, if id is set, of the invoice address.
+	sign := func(id domain.ID, nonce uint64, to geth.Address, value int64) *types.Transaction {
+		tx := types.NewTx(&types.DynamicFeeTx{
+			ChainID:   big.NewInt(1337),
+			Nonce:     nonce,
+			GasTipCap: big.NewInt(1),
+			GasFeeCap: big.NewInt(2),
+			Gas:       infrastructure.TransferGasLimit,
+			To:        &to,
+			Value:     big.NewInt(value),
+		})
+
+		if id == 0 {
+			tx, err = types.SignTx(tx, signer, payerKey)
+		} else {
+			tx, err = wallet.SignInvoiceTransaction(ctx, id, tx, signer)
+		}
+		require.NoError(t, err)
+
+		return tx
+	}
+
+	receipt := func(cumulativeGasUsed uint64, logs ...*types.Log) *types.Receipt {
+		return &types.Receipt{
+			Status:            types.ReceiptStatusSuccessful,
+			CumulativeGasUsed: cumulativeGasUsed,
+			Logs:              logs,
+		}
+	}
+
+	// Invoice 1 is paid in ether and swept, invoice 2 is paid in tokens
+	// and invoice 3 is paid by a contract and partially refunded.
+	deposit := sign(0, 0, addresses[1], 1_000_000)
+	tokenDeposit := sign(0, 1, fakeToken, 0)
+	internalDeposit := sign(0, 2, contract, 2_000_000)
+
+	node.mine(
+		[]*types.Transaction{deposit, tokenDeposit, internalDeposit},
+		[]*types.Receipt{
+			receipt(21_000),
+			receipt(42_000, &types.Log{
+				Address: fakeToken,
+				Topics: []geth.Hash{
+					infrastructure.TransferEventTopic,
+					geth.BytesToHash(payer.Bytes()),
+					geth.BytesToHash(addresses[2].Bytes()),
+				},
+				Data:   geth.LeftPadBytes(big.NewInt(500).Bytes(), 32),
+				TxHash: tokenDeposit.Hash(),
+			}),
+			receipt(63_000),
+		},
+		fakeTrace{TxHash: deposit.Hash(), Result: fakeCall{Type: "CALL"}},
+		fakeTrace{TxHash: tokenDeposit.Hash(), Result: fakeCall{Type: "CALL"}},
+		fakeTrace{TxHash: internalDeposit.Hash(), Result: fakeCall{
+			Type:  "CALL",
+			From:  payer,
+			To:    contract,
+			Value: (*hexutil.Big)(big.NewInt(2_000_000)),
+			Calls: []fakeCall{{
+				Type:  "CALL",
+				From:  contract,
+				To:    addresses[3],
+				Value: (*hexutil.Big)(big.NewInt(2_000_000)),
+			}},
+		}},
+	)
+
+	sweep := sign(1, 0, treasury, 900_000)
+	refund := sign(3, 0, payer, 1_000_000)
+	head := node.mine([]*types.Transaction{sweep, refund}, []*types.Receipt{receipt(21_000), receipt(42_000)})
+
+	// Transfers pay 2 wei per gas: the base fee and the tip.
+	node.balances.Store(addresses[1], big.NewInt(1_000_000-900_000-42_000))
+	node.nonces.Store(addresses[1], uint64(1))
+	node.tokenBalances.Store(addresses[2], big.NewInt(500))
+	// The balance of invoice 3 has 300 wei which were deposited before the scanned blocks.
+	node.balances.Store(addresses[3], big.NewInt(2_000_000-1_000_000-42_000+300))
+	node.nonces.Store(addresses[3], uint64(1))
+	// Invoice 6 is behind the gap of invoices 4 and 5, which crosses the batches of two addresses.
+	node.balances.Store(addresses[6], big.NewInt(1))
+
+	repository := infrastructure.NewRepository()
+	ethereum := infrastructure.NewEthereum(endpoints, nil, wallet, nil, time.Second)
+	sut := application.NewApplication(ethereum, repository, 1, domain.Tolerance{}, 0, &treasury, nil, true)
+
+	report, err := sut.Recover(ctx, 2, 1)
+	require.NoError(t, err)
+	assert.Equal(t, head.NumberU64(), report.HeadNumber)
+	assert.Equal(t, uint64(5), report.Checked)
+	assert.Equal(t, []domain.ID{1, 2, 3}, report.Recovered)
+	assert.Empty(t, report.Skipped)
+	assert.Empty(t, report.Unexplained)
+	assert.Equal(t, 4, report.Payments)
+	assert.Equal(t, 2, report.Transfers)
+
+	swept, err := repository.GetByID(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, domain.InvoiceStatusPaid, swept.Status())
+	assert.Equal(t, big.NewInt(1_000_000), swept.Price())
+	require.Len(t, swept.Payments(), 1)
+	assert.Equal(t, domain.PaymentKindTransaction, swept.Payments()[0].Kind())
+	assert.Equal(t, payer, swept.Payments()[0].Sender())
+	assert.True(t, swept.Payments()[0].IsVerified())
+	require.Len(t, swept.Transfers(), 1)
+	assert.Equal(t, domain.TransferKindSweep, swept.Transfers()[0].Kind())
+	assert.Equal(t, sweep.Hash(), swept.Transfers()[0].TxHash())
+
+	paidInTokens, err := repository.GetByID(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, domain.InvoiceStatusPaid, paidInTokens.Status())
+	require.NotNil(t, paidInTokens.Token())
+	assert.Equal(t, fakeToken, paidInTokens.Token().Address())
+	require.Len(t, paidInTokens.Payments(), 1)
+	assert.Equal(t, domain.PaymentKindTokenTransfer, paidInTokens.Payments()[0].Kind())
+	assert.Equal(t, big.NewInt(500), paidInTokens.Payments()[0].Value())
+
+	refunded, err := repository.GetByID(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, domain.InvoiceStatusPaid, refunded.Status())
+	assert.Equal(t, big.NewInt(1_000_300), refunded.Price())
+	require.Len(t, refunded.Payments(), 2)
+	assert.Equal(t, domain.PaymentKindInternalCall, refunded.Payments()[0].Kind())
+	assert.Equal(t, contract, refunded.Payments()[0].Sender())
+	assert.False(t, refunded.Payments()[0].IsVerified())
+	assert.Equal(t, domain.PaymentKindOpeningBalance, refunded.Payments()[1].Kind())
+	assert.Equal(t, big.NewInt(300), refunded.Payments()[1].Value())
+	assert.Equal(t, uint64(0), refunded.Payments()[1].BlockNumber())
+	require.Len(t, refunded.Transfers(), 1)
+	assert.Equal(t, domain.TransferKindRefund, refunded.Transfers()[0].Kind())
+	assert.Equal(t, big.NewInt(958_300), refunded.ExpectedBalance())
+
+	// The sender of the opening balance is unknown, so the payer is unknown too.
+	_, ok := refunded.Payer()
+	assert.False(t, ok)
+
+	// New invoices get addresses after the recovered ones.
+	id, err := repository.GetID(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, domain.ID(4), id)
+
+	checkpoint, err := repository.GetCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, head.Hash(), checkpoint.Hash)
+
+	// The repeated recovery leaves the recovered invoices untouched.
+	report, err = sut.Recover(ctx, 2, 1)
+	require.NoError(t, err)
+	assert.Empty(t, report.Recovered)
+	assert.Equal(t, []domain.ID{1, 2, 3}, report.Skipped)
+	assert.Zero(t, report.Payments)
+
+	refunded, err = repository.GetByID(ctx, 3)
+	require.NoError(t, err)
+	assert.Len(t, refunded.Payments(), 2)
+	assert.Len(t, refunded.Transfers(), 1)
+}
+
+func TestApplication_RecoverUnexplainedBalance(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	node := newFakeNode(t)
+
+	endpoints, err := infrastructure.DialEndpoints(ctx, []string{node.URL}, time.Minute, time.Second)
+	require.NoError(t, err)
+
+	wallet, err := infrastructure.NewHDWallet(testMnemonic)
+	require.NoError(t, err)
+
+	payerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	for id := domain.ID(1); id <= 2; id++ {
+		node.balances.Store(invoiceAddress(t, wallet, id), big.NewInt(0))
+	}
+
+	address := invoiceAddress(t, wallet, 1)
+	deposit, err := types.SignNewTx(payerKey, types.LatestSignerForChainID(big.NewInt(1337)), &types.LegacyTx{
+		Nonce:    0,
+		GasPrice: big.NewInt(1),
+		Gas:      infrastructure.TransferGasLimit,
+		To:       &address,
+		Value:    big.NewInt(1_000),
+	})
+	require.NoError(t, err)
+
+	node.mine([]*types.Transaction{deposit}, []*types.Receipt{{
+		Status:            types.ReceiptStatusSuccessful,
+		CumulativeGasUsed: 21_000,
+	}})
+
+	// The deposit was spent by a transaction which is not found, so its history can't be rebuilt.
+	node.nonces.Store(address, uint64(1))
+
+	repository := infrastructure.NewRepository()
+	ethereum := infrastructure.NewEthereum(endpoints, nil, wallet, nil, time.Second)
+	sut := application.NewApplication(ethereum, repository, 1, domain.Tolerance{}, 0, nil, nil, false)
+
+	report, err := sut.Recover(ctx, 1, 1)
+	require.NoError(t, err)
+	assert.Empty(t, report.Recovered)
+	assert.Equal(t, []domain.ID{1}, report.Unexplained)
+
+	_, err = repository.GetByID(ctx, 1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,372 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+// SweepInvoice transfers funds from the invoice address to the treasury address.
+func (a *Application) SweepInvoice(ctx context.Context, id domain.ID) (*domain.Transfer, error) {
+	return a.sweep(ctx, id)
+}
+
+// RunSweeper periodically sweeps paid invoices which have not been swept yet.
+func (a *Application) RunSweeper(ctx context.Context, interval time.Duration) common.ErrorGroupGoroutine {
+	return func() error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		log.Println("start sweeping paid invoices")
+		for {
+			select {
+			case <-ctx.Done():
+				log.Println("sweeping paid invoices stopped")
+
+				return nil
+			case <-ticker.C:
+			}
+
+			if err := a.sweepPaid(ctx); err != nil {
+				log.Printf("failed to sweep paid invoices: %s\n", err)
+			}
+		}
+	}
+}
+
+func (a *Application) sweepPaid(ctx context.Context) error {
+	invoices, err := a.repository.GetUnswept(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get unswept invoices: %w", err)
+	}
+
+	for _, invoice := range invoices {
+		if _, err := a.sweep(ctx, invoice.ID()); err != nil {
+			log.Printf("failed to sweep invoice %d: %s\n", invoice.ID(), err)
+		}
+	}
+
+	return nil
+}
+
+func (a *Application) sweep(ctx context.Context, id domain.ID) (*domain.Transfer, error) {
+	if a.treasury == nil {
+		return nil, common.FlagError(fmt.Errorf("treasury address is not configured"), common.FlagConflict)
+	}
+
+	treasury := func(*domain.Invoice) (geth.Address, error) {
+		return *a.treasury, nil
+	}
+
+	return a.transfer(ctx, id, domain.TransferKindSweep, treasury, nil, true)
+}
+
+// RefundInvoice sends the amount from the invoice address back to the destination.
+// If the destination is nil, the refund is sent to the payer of the invoice.
+// If subtractFee is set, the network fee is paid from the amount,
+// otherwise it is paid from the rest of the funds on the invoice address.
+func (a *Application) RefundInvoice(
+	ctx context.Context,
+	id domain.ID,
+	amount domain.WEI,
+	destination *geth.Address,
+	subtractFee bool,
+) (*domain.Transfer, error) {
+	// The refundable amount is checked while the invoice is locked, so concurrent refunds can't exceed it.
+	to := func(invoice *domain.Invoice) (geth.Address, error) {
+		return refundDestination(invoice, amount, destination)
+	}
+
+	return a.transfer(ctx, id, domain.TransferKindRefund, to, amount, subtractFee)
+}
+
+// refundDestination checks that the amount can be refunded from the invoice
+// and returns the destination, which defaults to the payer.
+func refundDestination(invoice *domain.Invoice, amount domain.WEI, destination *geth.Address) (geth.Address, error) {
+	if amount.Cmp(invoice.Refundable()) > 0 {
+		return geth.Address{}, common.FlagError(
+			fmt.Errorf("invoice %d: %w %s", invoice.ID(), domain.ErrRefundExceedsBalance, invoice.Refundable()),
+			common.FlagConflict,
+		)
+	}
+
+	if destination != nil {
+		return *destination, nil
+	}
+
+	payer, ok := invoice.Payer()
+	if !ok {
+		return geth.Address{}, common.FlagError(
+			fmt.Errorf("invoice %d has no single payer, the destination must be set", invoice.ID()),
+			common.FlagConflict,
+		)
+	}
+
+	return payer, nil
+}
+
+// transfer signs a transfer from the invoice address to the destination returned by to,
+// records it on the invoice and sends it.
+// If amount is nil, the whole balance except fees is transferred.
+// The transfer is reserved while the invoice is locked, so concurrent transfers of one invoice
+// never pass the pending transfer check together and never sign transactions with the same nonce.
+// Signing may wait for an operator approval on a remote signer, so the invoice is not locked meanwhile.
+// The signed transfer is recorded only if the invoice has not changed since the reservation,
+// otherwise the signed transaction is dropped without being sent.
+func (a *Application) transfer(
+	ctx context.Context,
+	id domain.ID,
+	kind domain.TransferKind,
+	to func(invoice *domain.Invoice) (geth.Address, error),
+	amount domain.WEI,
+	subtractFee bool,
+) (*domain.Transfer, error) {
+	var destination geth.Address
+
+	reserved, _, err := a.updateInvoice(ctx, id, func(invoice *domain.Invoice) (bool, error) {
+		if err := checkTransferable(invoice); err != nil {
+			return false, err
+		}
+
+		var err error
+
+		destination, err = to(invoice)
+		if err != nil {
+			return false, err
+		}
+
+		return false, a.reserveTransfer(id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer a.releaseTransfer(id)
+
+	tx, err := a.ethereum.SignTransfer(ctx, id, destination, amount, subtractFee)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transfer: %w", err)
+	}
+
+	var transfer *domain.Transfer
+
+	_, _, err = a.updateInvoice(ctx, id, func(invoice *domain.Invoice) (bool, error) {
+		if invoice.Version() != reserved.Version() {
+			return false, common.FlagError(
+				fmt.Errorf("invoice %d has changed while the transfer was signed", id),
+				common.FlagConflict,
+			)
+		}
+
+		transfer, err = recordTransfer(invoice, kind, tx)
+
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.sendTransfer(ctx, id, transfer, tx)
+}
+
+// reserveTransfer marks the invoice as having a transfer being signed.
+// It must be called while the invoice is locked, after the invoice is checked to be transferable.
+func (a *Application) reserveTransfer(id domain.ID) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.signing[id]; ok {
+		return common.FlagError(fmt.Errorf("invoice %d: %w", id, domain.ErrPendingTransfer), common.FlagConflict)
+	}
+
+	a.signing[id] = struct{}{}
+
+	return nil
+}
+
+func (a *Application) releaseTransfer(id domain.ID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.signing, id)
+}
+
+// checkTransferable checks that a new transfer can be sent from the invoice address.
+func checkTransferable(invoice *domain.Invoice) error {
+	if invoice.Token() != nil {
+		return common.FlagError(
+			fmt.Errorf("invoice %d is paid in tokens, token transfers are not supported", invoice.ID()),
+			common.FlagConflict,
+		)
+	}
+
+	if invoice.PendingTransfer() != nil {
+		return common.FlagError(
+			fmt.Errorf("invoice %d: %w", invoice.ID(), domain.ErrPendingTransfer),
+			common.FlagConflict,
+		)
+	}
+
+	return nil
+}
+
+// recordTransfer records the signed transfer on the invoice as pending.
+func recordTransfer(invoice *domain.Invoice, kind domain.TransferKind, tx *types.Transaction) (*domain.Transfer, error) {
+	transfer := domain.NewPendingTransfer(
+		kind,
+		tx.Hash(),
+		*tx.To(),
+		tx.Value(),
+		tx.Nonce(),
+		new(big.Int).Mul(tx.GasFeeCap(), new(big.Int).SetUint64(tx.Gas())),
+		time.Now().UTC(),
+	)
+
+	if err := invoice.AddTransfer(transfer); err != nil {
+		return nil, common.FlagError(fmt.Errorf("invoice %d: %w", invoice.ID(), err), common.FlagConflict)
+	}
+
+	return transfer, nil
+}
+
+// sendTransfer sends the transfer which has already been recorded on the invoice,
+// so it is tracked even if sending is interrupted.
+// The transfer fails only if the node rejects it. After other errors the transaction
+// may still be included, so the transfer is left pending until it is settled by its receipt or nonce,
+// otherwise a failed transfer could be sent again and transfer the funds twice.
+func (a *Application) sendTransfer(
+	ctx context.Context,
+	id domain.ID,
+	transfer *domain.Transfer,
+	tx *types.Transaction,
+) (*domain.Transfer, error) {
+	sendErr := a.ethereum.SendTransaction(ctx, tx)
+	if sendErr != nil && !errors.Is(sendErr, infrastructure.ErrTransactionRejected) {
+		return nil, fmt.Errorf("%s %s of invoice %d is left pending: %w", transfer.Kind(), tx.Hash(), id, sendErr)
+	}
+
+	if sendErr != nil {
+		_, _, err := a.updateInvoice(ctx, id, func(invoice *domain.Invoice) (bool, error) {
+			pending := invoice.PendingTransfer()
+			if pending == nil || pending.TxHash() != tx.Hash() {
+				return false, nil
+			}
+
+			invoice.FailTransfer(pending, 0, 0, new(big.Int))
+
+			return true, nil
+		})
+		if err != nil {
+			return nil, errors.Join(sendErr, err)
+		}
+
+		return nil, sendErr
+	}
+
+	log.Printf("%s %s of invoice %d sent to %s\n", transfer.Kind(), tx.Hash(), id, transfer.To())
+
+	return transfer, nil
+}
+
+// updateTransfers completes pending transfers which got enough confirmations relative to the head block.
+// A transfer which nonce has been used by another transaction will never be included, so it fails.
+func (a *Application) updateTransfers(ctx context.Context, headNumber uint64) error {
+	invoices, err := a.repository.GetWithPendingTransfers(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get invoices with pending transfers: %w", err)
+	}
+
+	for _, pending := range invoices {
+		var transfer *domain.Transfer
+
+		invoice, changed, err := a.updateInvoice(ctx, pending.ID(), func(invoice *domain.Invoice) (bool, error) {
+			transfer = invoice.PendingTransfer()
+			if transfer == nil {
+				return false, nil
+			}
+
+			changed, err := a.updateTransfer(ctx, invoice, transfer, headNumber)
+			if err != nil {
+				return false, fmt.Errorf("cannot update transfer %s: %w", transfer.TxHash(), err)
+			}
+
+			return changed, nil
+		})
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+
+		eventType := EventTransferConfirmed
+		if !transfer.IsConfirmed() {
+			eventType = EventTransferFailed
+		}
+
+		a.publish(ctx, Event{
+			Type:      eventType,
+			InvoiceID: invoice.ID(),
+			Status:    invoice.Status(),
+			TxHash:    transfer.TxHash(),
+			Value:     transfer.Value(),
+			CreatedAt: time.Now(),
+		})
+	}
+
+	return nil
+}
+
+func (a *Application) updateTransfer(
+	ctx context.Context,
+	invoice *domain.Invoice,
+	transfer *domain.Transfer,
+	headNumber uint64,
+) (bool, error) {
+	receipt, err := a.ethereum.GetReceipt(ctx, transfer.TxHash())
+	if common.IsFlaggedError(err, common.FlagNotFound) {
+		nonce, err := a.ethereum.GetNonce(ctx, *invoice.Address())
+		if err != nil {
+			return false, err
+		}
+
+		if nonce <= transfer.Nonce() {
+			return false, nil
+		}
+
+		invoice.FailTransfer(transfer, 0, 0, new(big.Int))
+
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	blockNumber := receipt.BlockNumber.Uint64()
+	if headNumber < blockNumber || headNumber-blockNumber+1 < a.requiredConfirmations {
+		return false, nil
+	}
+
+	// Nodes return no effective gas price only for transactions from before EIP-1559.
+	gasPrice := receipt.EffectiveGasPrice
+	if gasPrice == nil {
+		gasPrice = new(big.Int)
+	}
+
+	if receipt.Status == types.ReceiptStatusSuccessful {
+		transfer.Confirm(blockNumber, receipt.GasUsed, gasPrice)
+	} else {
+		invoice.FailTransfer(transfer, blockNumber, receipt.GasUsed, gasPrice)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,271 @@
+package application
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+const (
+	WebhookPollInterval   = time.Second
+	WebhookInitialBackoff = 5 * time.Second
+	WebhookMaxBackoff     = time.Hour
+	WebhookMaxAttempts    = 10
+
+	// WebhookScheduleRetryInterval is the delay between attempts to save deliveries of an event.
+	WebhookScheduleRetryInterval = time.Second
+
+	eventIDLength = 16
+)
+
+type WebhookRepository interface {
+	SaveWebhookDelivery(ctx context.Context, delivery *infrastructure.WebhookDelivery) error
+	GetDueWebhookDeliveries(ctx context.Context, now time.Time) ([]*infrastructure.WebhookDelivery, error)
+	SaveWebhookAttempt(ctx context.Context, attempt infrastructure.WebhookAttempt) error
+}
+
+// Webhooks delivers events to the configured endpoints.
+// Deliveries are stored before they are sent, so they survive restarts,
+// and failed ones are retried with exponential backoff. Every attempt is recorded.
+// An event may be delivered more than once,
+// so receivers should deduplicate events by the infrastructure.WebhookEventIDHeader.
+type Webhooks struct {
+	client     *infrastructure.WebhookClient
+	repository WebhookRepository
+	urls       []string
+
+	wakeUp chan struct{}
+}
+
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Type      EventType   `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      webhookData `json:"data"`
+}
+
+type webhookData struct {
+	InvoiceID domain.ID            `json:"invoice_id"`
+	Status    domain.InvoiceStatus `json:"status"`
+	TxHash    *domain.Hash         `json:"tx_hash,omitempty"`
+	Value     domain.WEI           `json:"value,omitempty"`
+}
+
+func NewWebhooks(
+	client *infrastructure.WebhookClient,
+	repository WebhookRepository,
+	urls []string,
+) *Webhooks {
+	return &Webhooks{
+		client:     client,
+		repository: repository,
+		urls:       urls,
+		wakeUp:     make(chan struct{}, 1),
+	}
+}
+
+// Handle is an EventHandler which schedules delivery of the event to every endpoint.
+// Events are published after the invoice is saved, so saving the deliveries is retried
+// until it succeeds or the context is done instead of losing the event.
+// The publisher is blocked meanwhile.
+func (w *Webhooks) Handle(ctx context.Context, event Event) {
+	deliveries, err := w.newDeliveries(event)
+	if err != nil {
+		log.Printf("failed to schedule webhooks for event %s: %s\n", event.Type, err)
+
+		return
+	}
+
+	for {
+		err := w.schedule(ctx, deliveries)
+		if err == nil {
+			break
+		}
+
+		log.Printf(
+			"failed to schedule webhooks for event %s of invoice %d, retrying: %s\n",
+			event.Type, event.InvoiceID, err,
+		)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("webhooks for event %s of invoice %d are not scheduled\n", event.Type, event.InvoiceID)
+
+			return
+		case <-time.After(WebhookScheduleRetryInterval):
+		}
+	}
+
+	select {
+	case w.wakeUp <- struct{}{}:
+	default:
+	}
+}
+
+// schedule saves the deliveries which have not been saved yet.
+func (w *Webhooks) schedule(ctx context.Context, deliveries []*infrastructure.WebhookDelivery) error {
+	for _, delivery := range deliveries {
+		if delivery.ID != 0 {
+			continue
+		}
+
+		if err := w.repository.SaveWebhookDelivery(ctx, delivery); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newDeliveries returns deliveries of the event to every endpoint.
+func (w *Webhooks) newDeliveries(event Event) ([]*infrastructure.WebhookDelivery, error) {
+	id, err := newEventID()
+	if err != nil {
+		return nil, err
+	}
+
+	data := webhookData{
+		InvoiceID: event.InvoiceID,
+		Status:    event.Status,
+		Value:     event.Value,
+	}
+	if event.TxHash != (domain.Hash{}) {
+		data.TxHash = &event.TxHash
+	}
+
+	payload, err := json.Marshal(webhookPayload{
+		ID:        id,
+		Type:      event.Type,
+		CreatedAt: event.CreatedAt.UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	now := time.Now()
+	deliveries := make([]*infrastructure.WebhookDelivery, 0, len(w.urls))
+
+	for _, url := range w.urls {
+		deliveries = append(deliveries, &infrastructure.WebhookDelivery{
+			EventID:       id,
+			EventType:     string(event.Type),
+			URL:           url,
+			Payload:       payload,
+			Status:        infrastructure.WebhookDeliveryStatusPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		})
+	}
+
+	return deliveries, nil
+}
+
+// RunDispatcher sends due webhook deliveries until the context is done.
+func (w *Webhooks) RunDispatcher(ctx context.Context) common.ErrorGroupGoroutine {
+	return func() error {
+		ticker := time.NewTicker(WebhookPollInterval)
+		defer ticker.Stop()
+
+		log.Println("start delivering webhooks")
+		for {
+			if err := w.deliverDue(ctx); err != nil {
+				log.Printf("failed to deliver webhooks: %s\n", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				log.Println("delivering webhooks stopped")
+
+				return nil
+			case <-ticker.C:
+			case <-w.wakeUp:
+			}
+		}
+	}
+}
+
+func (w *Webhooks) deliverDue(ctx context.Context) error {
+	deliveries, err := w.repository.GetDueWebhookDeliveries(ctx, time.Now())
+	if err != nil {
+		return fmt.Errorf("cannot get due webhook deliveries: %w", err)
+	}
+
+	for _, delivery := range deliveries {
+		if err := w.deliver(ctx, delivery); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Webhooks) deliver(ctx context.Context, delivery *infrastructure.WebhookDelivery) error {
+	statusCode, sendErr := w.client.Send(ctx, delivery.URL, delivery.EventID, delivery.Payload)
+	if ctx.Err() != nil {
+		// The attempt was interrupted by the shutdown, it is not counted.
+		return nil
+	}
+
+	now := time.Now()
+	delivery.Attempts++
+
+	attempt := infrastructure.WebhookAttempt{
+		DeliveryID: delivery.ID,
+		Attempt:    delivery.Attempts,
+		StatusCode: statusCode,
+		CreatedAt:  now,
+	}
+
+	switch {
+	case sendErr == nil:
+		delivery.Status = infrastructure.WebhookDeliveryStatusDelivered
+	case delivery.Attempts >= WebhookMaxAttempts:
+		attempt.Error = sendErr.Error()
+		delivery.Status = infrastructure.WebhookDeliveryStatusFailed
+
+		log.Printf("giving up delivering event %s to %s: %s\n", delivery.EventID, delivery.URL, sendErr)
+	default:
+		attempt.Error = sendErr.Error()
+		delivery.NextAttemptAt = now.Add(webhookBackoff(delivery.Attempts))
+
+		log.Printf(
+			"failed to deliver event %s to %s, retrying at %s: %s\n",
+			delivery.EventID, delivery.URL, delivery.NextAttemptAt.Format(time.RFC3339), sendErr,
+		)
+	}
+
+	if err := w.repository.SaveWebhookAttempt(ctx, attempt); err != nil {
+		return err
+	}
+
+	return w.repository.SaveWebhookDelivery(ctx, delivery)
+}
+
+// webhookBackoff returns the delay before the next attempt,
+// which doubles after every failed attempt.
+func webhookBackoff(attempts uint64) time.Duration {
+	backoff := WebhookInitialBackoff
+	for i := uint64(1); i < attempts && backoff < WebhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, WebhookMaxBackoff)
+}
+
+func newEventID() (string, error) {
+	id := make([]byte, eventIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate event id: %w", err)
+	}
+
+	return hex.EncodeToString(id), nil
+}
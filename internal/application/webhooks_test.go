@@ -0,0 +1,151 @@
+package application_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/application"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+// webhookRepository records saved deliveries and attempts.
+// Saving a new delivery to the failingURL fails once.
+type webhookRepository struct {
+	mu         sync.Mutex
+	failingURL string
+	deliveries []infrastructure.WebhookDelivery
+	attempts   []infrastructure.WebhookAttempt
+}
+
+func (r *webhookRepository) SaveWebhookDelivery(_ context.Context, delivery *infrastructure.WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if delivery.ID == 0 && delivery.URL == r.failingURL {
+		r.failingURL = ""
+
+		return errors.New("database is unavailable")
+	}
+
+	if delivery.ID == 0 {
+		delivery.ID = uint64(len(r.deliveries) + 1)
+	}
+	r.deliveries = append(r.deliveries, *delivery)
+
+	return nil
+}
+
+func (r *webhookRepository) GetDueWebhookDeliveries(context.Context, time.Time) ([]*infrastructure.WebhookDelivery, error) {
+	return nil, nil
+}
+
+func (r *webhookRepository) SaveWebhookAttempt(_ context.Context, attempt infrastructure.WebhookAttempt) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.attempts = append(r.attempts, attempt)
+
+	return nil
+}
+
+func TestWebhooks_HandleRetriesScheduling(t *testing.T) {
+	t.Parallel()
+
+	repository := &webhookRepository{failingURL: "http://localhost/second"}
+	sut := application.NewWebhooks(
+		infrastructure.NewWebhookClient("secret"),
+		repository,
+		[]string{"http://localhost/first", "http://localhost/second"},
+	)
+
+	// The saved delivery to the first endpoint is not saved again when the scheduling is retried.
+	sut.Handle(context.Background(), application.Event{
+		Type:      application.EventInvoicePaid,
+		InvoiceID: 1,
+		Status:    domain.InvoiceStatusPaid,
+		CreatedAt: time.Now(),
+	})
+
+	require.Len(t, repository.deliveries, 2)
+	assert.Equal(t, "http://localhost/first", repository.deliveries[0].URL)
+	assert.Equal(t, "http://localhost/second", repository.deliveries[1].URL)
+	assert.Equal(t, repository.deliveries[0].EventID, repository.deliveries[1].EventID)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	t.Parallel()
+
+	expected := []time.Duration{
+		5 * time.Second,
+		10 * time.Second,
+		20 * time.Second,
+		40 * time.Second,
+		80 * time.Second,
+		160 * time.Second,
+		320 * time.Second,
+		640 * time.Second,
+		1280 * time.Second,
+		2560 * time.Second,
+		time.Hour,
+		time.Hour,
+	}
+
+	for i, backoff := range expected {
+		assert.Equal(t, backoff, application.WebhookBackoff(uint64(i+1)), "attempt %d", i+1)
+	}
+	assert.Equal(t, application.WebhookMaxBackoff, application.WebhookBackoff(100))
+}
+
+func TestWebhooks_DeliverGivesUpAfterMaxAttempts(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+
+	ctx := context.Background()
+	repository := &webhookRepository{}
+	sut := application.NewWebhooks(infrastructure.NewWebhookClient("secret"), repository, []string{server.URL})
+
+	delivery := &infrastructure.WebhookDelivery{
+		ID:            1,
+		EventID:       "event",
+		EventType:     string(application.EventInvoicePaid),
+		URL:           server.URL,
+		Payload:       []byte(`{}`),
+		Status:        infrastructure.WebhookDeliveryStatusPending,
+		Attempts:      application.WebhookMaxAttempts - 2,
+		NextAttemptAt: time.Now(),
+		CreatedAt:     time.Now(),
+	}
+
+	require.NoError(t, application.DeliverWebhook(sut, ctx, delivery))
+	assert.Equal(t, infrastructure.WebhookDeliveryStatusPending, delivery.Status)
+	assert.WithinDuration(
+		t, time.Now().Add(application.WebhookBackoff(application.WebhookMaxAttempts-1)), delivery.NextAttemptAt, time.Second,
+	)
+
+	require.NoError(t, application.DeliverWebhook(sut, ctx, delivery))
+	assert.Equal(t, infrastructure.WebhookDeliveryStatusFailed, delivery.Status)
+	assert.Equal(t, uint64(application.WebhookMaxAttempts), delivery.Attempts)
+
+	require.Len(t, repository.attempts, 2)
+	for i, attempt := range repository.attempts {
+		assert.Equal(t, uint64(application.WebhookMaxAttempts-1+i), attempt.Attempt)
+		assert.Equal(t, http.StatusInternalServerError, attempt.StatusCode)
+		assert.NotEmpty(t, attempt.Error)
+	}
+
+	require.Len(t, repository.deliveries, 2)
+	assert.Equal(t, infrastructure.WebhookDeliveryStatusFailed, repository.deliveries[1].Status)
+}
@@ -2,40 +2,535 @@ package common
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
 )
 
 type Config struct {
-	Mnemonic      string
-	EthereumRPC   string
+	// Only one of Mnemonic, MnemonicFile and XPub is set.
+	// MnemonicFile is the mnemonic encrypted with a passphrase,
+	// which is read from PassphraseFile or prompted for if it is empty.
+	// XPub is the account-level extended public key used in watch-only mode.
+	Mnemonic       string
+	MnemonicFile   string
+	PassphraseFile string
+	XPub           string
+	// SignerURL is the endpoint of the remote signer holding the keys in watch-only mode.
+	// Transfers are signed in memory with the mnemonic if it is empty.
+	SignerURL      string
+	SignerProtocol string
+	// EthereumRPCs are endpoints of the same chain in the order of preference.
+	EthereumRPCs []string
+	// PollInterval is used only for HTTP endpoints, which do not support subscriptions.
+	PollInterval        time.Duration
+	HealthCheckInterval time.Duration
+	RPCMaxHeadAge       time.Duration
+	RPCMaxLatency       time.Duration
+	// QuorumRPCs are independent providers verifying every block, verification is disabled if it is empty.
+	// QuorumSize is the number of them which must agree.
+	QuorumRPCs    []string
+	QuorumSize    int
 	ServerAddress string
+	StorageDriver string
+	StorageDSN    string
+
+	// AdminServerAddress serves the endpoints moving funds and the operator tools.
+	// AdminToken is the bearer token required by them, it may be empty only for a loopback address.
+	AdminServerAddress string
+	AdminToken         string
+
+	RequiredConfirmations uint64
+	Tolerance             domain.Tolerance
+	InvoiceTTL            time.Duration
+	// TraceInternalCalls requires the debug namespace on all endpoints.
+	TraceInternalCalls bool
+
+	WebhookURLs   []string
+	WebhookSecret string
+
+	TreasuryAddress *geth.Address
+	SweepInterval   time.Duration
+
+	// ReconcileInterval is zero if reconciliation of invoice balances is disabled.
+	ReconcileInterval        time.Duration
+	ReconcileOpenDiscrepancy bool
+
+	// RateProvider is empty if fiat invoices are disabled.
+	// Only the settings of the chosen provider are set.
+	RateProvider      string
+	ExchangeRates     map[string]string
+	ExchangeRatesFile string
+	ChainlinkFeeds    map[string]geth.Address
+	RateMaxAge        time.Duration
 }
 
 const (
-	MnemonicKey      = "MNEMONIC"
-	EthereumRPCKey   = "ETHEREUM_RPC"
-	ServerAddressKey = "SERVER_ADDRESS"
+	MnemonicKey       = "MNEMONIC"
+	MnemonicFileKey   = "MNEMONIC_FILE"
+	PassphraseFileKey = "PASSPHRASE_FILE"
+	XPubKey           = "XPUB"
+	SignerURLKey      = "SIGNER_URL"
+	SignerProtocolKey = "SIGNER_PROTOCOL"
+	EthereumRPCKey    = "ETHEREUM_RPC"
+	PollIntervalKey   = "POLL_INTERVAL"
+	ServerAddressKey  = "SERVER_ADDRESS"
+	StorageDriverKey  = "STORAGE_DRIVER"
+	StorageDSNKey     = "STORAGE_DSN"
+
+	AdminServerAddressKey = "ADMIN_SERVER_ADDRESS"
+	AdminTokenKey         = "ADMIN_TOKEN"
+
+	HealthCheckIntervalKey = "HEALTH_CHECK_INTERVAL"
+	RPCMaxHeadAgeKey       = "RPC_MAX_HEAD_AGE"
+	RPCMaxLatencyKey       = "RPC_MAX_LATENCY"
+	QuorumRPCsKey          = "QUORUM_RPCS"
+	QuorumSizeKey          = "QUORUM_SIZE"
+
+	RequiredConfirmationsKey = "CONFIRMATIONS"
+	ToleranceKey             = "UNDERPAYMENT_TOLERANCE"
+	InvoiceTTLKey            = "INVOICE_TTL"
+	TraceInternalCallsKey    = "TRACE_INTERNAL_CALLS"
+
+	WebhookURLsKey   = "WEBHOOK_URLS"
+	WebhookSecretKey = "WEBHOOK_SECRET"
+
+	TreasuryAddressKey = "TREASURY_ADDRESS"
+	SweepIntervalKey   = "SWEEP_INTERVAL"
+
+	ReconcileIntervalKey        = "RECONCILE_INTERVAL"
+	ReconcileOpenDiscrepancyKey = "RECONCILE_OPEN_DISCREPANCIES"
+
+	RateProviderKey      = "RATE_PROVIDER"
+	ExchangeRatesKey     = "EXCHANGE_RATES"
+	ExchangeRatesFileKey = "EXCHANGE_RATES_FILE"
+	ChainlinkFeedsKey    = "CHAINLINK_FEEDS"
+	RateMaxAgeKey        = "RATE_MAX_AGE"
+)
+
+const DefaultSweepInterval = 10 * time.Minute
+
+// DefaultAdminServerAddress is reachable only from the host.
+const DefaultAdminServerAddress = "localhost:8081"
+
+// DefaultPollInterval is a third of the Ethereum block time.
+const DefaultPollInterval = 4 * time.Second
+
+const (
+	DefaultHealthCheckInterval = 15 * time.Second
+	// DefaultRPCMaxHeadAge is five Ethereum block times.
+	DefaultRPCMaxHeadAge = time.Minute
+	DefaultRPCMaxLatency = 2 * time.Second
+)
+
+// DefaultRateMaxAge allows a missed update of Chainlink ETH feeds, which are updated at least hourly.
+const DefaultRateMaxAge = 2 * time.Hour
+
+const (
+	RateProviderStatic    = "static"
+	RateProviderFile      = "file"
+	RateProviderChainlink = "chainlink"
+)
+
+const DefaultRequiredConfirmations = 1
+
+const (
+	SignerProtocolWeb3Signer = "web3signer"
+	SignerProtocolClef       = "clef"
+)
+
+const (
+	StorageDriverMemory   = "memory"
+	StorageDriverSQLite   = "sqlite"
+	StorageDriverPostgres = "postgres"
 )
 
 func ConfigFromEnv() (*Config, error) {
-	mnemonic, ok := os.LookupEnv(MnemonicKey)
-	if !ok {
-		return nil, fmt.Errorf("environment variable %s not set", MnemonicKey)
+	mnemonic := os.Getenv(MnemonicKey)
+	mnemonicFile := os.Getenv(MnemonicFileKey)
+	xpub := os.Getenv(XPubKey)
+
+	keys := 0
+	for _, value := range []string{mnemonic, mnemonicFile, xpub} {
+		if value != "" {
+			keys++
+		}
 	}
 
-	ethereumRPC, ok := os.LookupEnv(EthereumRPCKey)
-	if !ok {
+	switch {
+	case keys == 0:
+		return nil, fmt.Errorf(
+			"one of environment variables %s, %s and %s must be set", MnemonicKey, MnemonicFileKey, XPubKey,
+		)
+	case keys > 1:
+		return nil, fmt.Errorf(
+			"only one of environment variables %s, %s and %s can be set", MnemonicKey, MnemonicFileKey, XPubKey,
+		)
+	}
+
+	passphraseFile := os.Getenv(PassphraseFileKey)
+	if passphraseFile != "" && mnemonicFile == "" {
+		return nil, fmt.Errorf("environment variable %s must be set with %s", MnemonicFileKey, PassphraseFileKey)
+	}
+
+	// Keys are held by the remote signer, so only the extended public key may be given with it.
+	signerURL := os.Getenv(SignerURLKey)
+	if signerURL != "" && xpub == "" {
+		return nil, fmt.Errorf("environment variable %s must be set with %s", XPubKey, SignerURLKey)
+	}
+
+	signerProtocol := lookupEnvDefault(SignerProtocolKey, SignerProtocolWeb3Signer)
+	switch signerProtocol {
+	case SignerProtocolWeb3Signer, SignerProtocolClef:
+	default:
+		return nil, fmt.Errorf("unknown signer protocol %q in %s", signerProtocol, SignerProtocolKey)
+	}
+
+	// Comma separated list of endpoints, the first healthy one is used.
+	ethereumRPCs := lookupList(EthereumRPCKey)
+	if len(ethereumRPCs) == 0 {
 		return nil, fmt.Errorf("environment variable %s not set", EthereumRPCKey)
 	}
 
+	pollInterval, err := lookupDurationDefault(PollIntervalKey, DefaultPollInterval)
+	if err != nil {
+		return nil, err
+	}
+	if pollInterval <= 0 {
+		return nil, fmt.Errorf("environment variable %s must be positive", PollIntervalKey)
+	}
+
+	healthCheckInterval, err := lookupDurationDefault(HealthCheckIntervalKey, DefaultHealthCheckInterval)
+	if err != nil {
+		return nil, err
+	}
+	if healthCheckInterval <= 0 {
+		return nil, fmt.Errorf("environment variable %s must be positive", HealthCheckIntervalKey)
+	}
+
+	rpcMaxHeadAge, err := lookupDurationDefault(RPCMaxHeadAgeKey, DefaultRPCMaxHeadAge)
+	if err != nil {
+		return nil, err
+	}
+	if rpcMaxHeadAge <= 0 {
+		return nil, fmt.Errorf("environment variable %s must be positive", RPCMaxHeadAgeKey)
+	}
+
+	rpcMaxLatency, err := lookupDurationDefault(RPCMaxLatencyKey, DefaultRPCMaxLatency)
+	if err != nil {
+		return nil, err
+	}
+	if rpcMaxLatency <= 0 {
+		return nil, fmt.Errorf("environment variable %s must be positive", RPCMaxLatencyKey)
+	}
+
+	quorumRPCs := lookupList(QuorumRPCsKey)
+
+	// A majority of the providers by default.
+	quorumSize, err := lookupUintDefault(QuorumSizeKey, uint64(len(quorumRPCs)/2+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(quorumRPCs) > 0 && (quorumSize == 0 || quorumSize > uint64(len(quorumRPCs))) {
+		return nil, fmt.Errorf("environment variable %s must be between 1 and the number of %s", QuorumSizeKey, QuorumRPCsKey)
+	}
+
 	serverAddress, ok := os.LookupEnv(ServerAddressKey)
 	if !ok {
 		return nil, fmt.Errorf("environment variable %s not set", ServerAddressKey)
 	}
 
-	return &Config{
-		Mnemonic:      mnemonic,
-		EthereumRPC:   ethereumRPC,
-		ServerAddress: serverAddress,
-	}, nil
+	adminServerAddress := lookupEnvDefault(AdminServerAddressKey, DefaultAdminServerAddress)
+	adminToken := os.Getenv(AdminTokenKey)
+	if adminToken == "" && !isLoopbackAddress(adminServerAddress) {
+		return nil, fmt.Errorf(
+			"environment variable %s must be set unless %s is a loopback address", AdminTokenKey, AdminServerAddressKey,
+		)
+	}
+
+	storageDriver := lookupEnvDefault(StorageDriverKey, StorageDriverMemory)
+	storageDSN := os.Getenv(StorageDSNKey)
+
+	switch storageDriver {
+	case StorageDriverMemory:
+	case StorageDriverSQLite, StorageDriverPostgres:
+		if storageDSN == "" {
+			return nil, fmt.Errorf("environment variable %s must be set for %s storage", StorageDSNKey, storageDriver)
+		}
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q in %s", storageDriver, StorageDriverKey)
+	}
+
+	requiredConfirmations, err := lookupUintDefault(RequiredConfirmationsKey, DefaultRequiredConfirmations)
+	if err != nil {
+		return nil, err
+	}
+	if requiredConfirmations == 0 {
+		return nil, fmt.Errorf("environment variable %s must be positive", RequiredConfirmationsKey)
+	}
+
+	// Absolute amount of wei, e.g. 1000, or a percentage of the price, e.g. 0.5%.
+	tolerance, err := domain.ParseTolerance(lookupEnvDefault(ToleranceKey, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid environment variable %s: %w", ToleranceKey, err)
+	}
+
+	// Invoices never expire by default.
+	invoiceTTL, err := lookupDurationDefault(InvoiceTTLKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	if invoiceTTL < 0 {
+		return nil, fmt.Errorf("environment variable %s must not be negative", InvoiceTTLKey)
+	}
+
+	// Payments made by contracts are detected only by tracing blocks, which is expensive.
+	traceInternalCalls, err := lookupBoolDefault(TraceInternalCallsKey, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Comma separated list of endpoints, webhooks are disabled if it is empty.
+	webhookURLs := lookupList(WebhookURLsKey)
+
+	webhookSecret := os.Getenv(WebhookSecretKey)
+	if len(webhookURLs) > 0 && webhookSecret == "" {
+		return nil, fmt.Errorf("environment variable %s must be set to sign webhooks", WebhookSecretKey)
+	}
+
+	// Sweeping is disabled if the treasury address is not set.
+	var treasuryAddress *geth.Address
+	if rawTreasury := os.Getenv(TreasuryAddressKey); rawTreasury != "" {
+		if !geth.IsHexAddress(rawTreasury) {
+			return nil, fmt.Errorf("environment variable %s must be an address", TreasuryAddressKey)
+		}
+
+		address := geth.HexToAddress(rawTreasury)
+		treasuryAddress = &address
+	}
+
+	// Zero disables automatic sweeping, invoices can still be swept manually.
+	sweepInterval, err := lookupDurationDefault(SweepIntervalKey, DefaultSweepInterval)
+	if err != nil {
+		return nil, err
+	}
+	if sweepInterval < 0 {
+		return nil, fmt.Errorf("environment variable %s must not be negative", SweepIntervalKey)
+	}
+
+	// Reconciliation requests a balance of every open invoice, so it is disabled by default.
+	reconcileInterval, err := lookupDurationDefault(ReconcileIntervalKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	if reconcileInterval < 0 {
+		return nil, fmt.Errorf("environment variable %s must not be negative", ReconcileIntervalKey)
+	}
+
+	reconcileOpenDiscrepancy, err := lookupBoolDefault(ReconcileOpenDiscrepancyKey, false)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{
+		Mnemonic:            mnemonic,
+		MnemonicFile:        mnemonicFile,
+		PassphraseFile:      passphraseFile,
+		XPub:                xpub,
+		SignerURL:           signerURL,
+		SignerProtocol:      signerProtocol,
+		EthereumRPCs:        ethereumRPCs,
+		PollInterval:        pollInterval,
+		HealthCheckInterval: healthCheckInterval,
+		RPCMaxHeadAge:       rpcMaxHeadAge,
+		RPCMaxLatency:       rpcMaxLatency,
+		QuorumRPCs:          quorumRPCs,
+		QuorumSize:          int(quorumSize),
+		ServerAddress:       serverAddress,
+		StorageDriver:       storageDriver,
+		StorageDSN:          storageDSN,
+
+		AdminServerAddress: adminServerAddress,
+		AdminToken:         adminToken,
+
+		RequiredConfirmations: requiredConfirmations,
+		Tolerance:             tolerance,
+		InvoiceTTL:            invoiceTTL,
+		TraceInternalCalls:    traceInternalCalls,
+
+		WebhookURLs:   webhookURLs,
+		WebhookSecret: webhookSecret,
+
+		TreasuryAddress: treasuryAddress,
+		SweepInterval:   sweepInterval,
+
+		ReconcileInterval:        reconcileInterval,
+		ReconcileOpenDiscrepancy: reconcileOpenDiscrepancy,
+	}
+
+	if err := rateProviderFromEnv(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func rateProviderFromEnv(config *Config) error {
+	config.RateProvider = os.Getenv(RateProviderKey)
+
+	switch config.RateProvider {
+	case "":
+		return nil
+	case RateProviderStatic:
+		// Prices of one ether by currency codes, e.g. USD=3012.45,EUR=2790.10.
+		rates, err := lookupPairs(ExchangeRatesKey)
+		if err != nil {
+			return err
+		}
+
+		config.ExchangeRates = rates
+	case RateProviderFile:
+		config.ExchangeRatesFile = os.Getenv(ExchangeRatesFileKey)
+		if config.ExchangeRatesFile == "" {
+			return fmt.Errorf("environment variable %s must be set for %s rate provider", ExchangeRatesFileKey, RateProviderFile)
+		}
+	case RateProviderChainlink:
+		// Addresses of ETH price feeds by currency codes, e.g. USD=0x5f4eC3Df9cbd43714FE2740f5E3616155c5b8419.
+		rawFeeds, err := lookupPairs(ChainlinkFeedsKey)
+		if err != nil {
+			return err
+		}
+
+		config.ChainlinkFeeds = make(map[string]geth.Address, len(rawFeeds))
+		for currency, rawFeed := range rawFeeds {
+			if !geth.IsHexAddress(rawFeed) {
+				return fmt.Errorf("price feed of %s in %s must be an address", currency, ChainlinkFeedsKey)
+			}
+
+			config.ChainlinkFeeds[currency] = geth.HexToAddress(rawFeed)
+		}
+
+		config.RateMaxAge, err = lookupDurationDefault(RateMaxAgeKey, DefaultRateMaxAge)
+		if err != nil {
+			return err
+		}
+		if config.RateMaxAge <= 0 {
+			return fmt.Errorf("environment variable %s must be positive", RateMaxAgeKey)
+		}
+	default:
+		return fmt.Errorf("unknown rate provider %q in %s", config.RateProvider, RateProviderKey)
+	}
+
+	return nil
+}
+
+// isLoopbackAddress reports whether the listen address accepts connections only from the host.
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// lookupList parses an optional comma separated list.
+func lookupList(key string) []string {
+	var list []string
+
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// lookupPairs parses a required comma separated list of KEY=value pairs.
+// Keys are converted to upper case.
+func lookupPairs(key string) (map[string]string, error) {
+	pairs := make(map[string]string)
+
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s must be a list of KEY=value pairs", key)
+		}
+
+		pairs[strings.ToUpper(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("environment variable %s must not be empty", key)
+	}
+
+	return pairs, nil
+}
+
+func lookupEnvDefault(key, defaultValue string) string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return defaultValue
+	}
+
+	return value
+}
+
+func lookupUintDefault(key string, defaultValue uint64) (uint64, error) {
+	raw, ok := os.LookupEnv(key)
+	if !ok || raw == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("environment variable %s must be an unsigned integer: %w", key, err)
+	}
+
+	return value, nil
+}
+
+func lookupBoolDefault(key string, defaultValue bool) (bool, error) {
+	raw, ok := os.LookupEnv(key)
+	if !ok || raw == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("environment variable %s must be a boolean: %w", key, err)
+	}
+
+	return value, nil
+}
+
+func lookupDurationDefault(key string, defaultValue time.Duration) (time.Duration, error) {
+	raw, ok := os.LookupEnv(key)
+	if !ok || raw == "" {
+		return defaultValue, nil
+	}
+
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("environment variable %s must be a duration: %w", key, err)
+	}
+
+	return value, nil
 }
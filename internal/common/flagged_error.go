@@ -6,6 +6,8 @@ type Flag string
 
 const (
 	FlagNotFound Flag = "not exists"
+	// FlagConflict marks operations which are not possible in the current state.
+	FlagConflict Flag = "conflict"
 )
 
 type Flagged interface {
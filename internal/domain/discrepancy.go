@@ -0,0 +1,143 @@
+package domain
+
+import (
+	"errors"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+)
+
+// Discrepancy is a mismatch between the on-chain balance of an invoice address
+// and the balance expected from the recorded payments and transfers.
+// It stays open until an operator resolves it.
+type Discrepancy struct {
+	id        uint64
+	invoiceID ID
+	address   geth.Address
+	expected  WEI
+	actual    WEI
+	// blockNumber is the block at which the balance was checked.
+	blockNumber uint64
+	status      DiscrepancyStatus
+	// resolution is the note left by the operator who resolved the discrepancy.
+	resolution string
+	createdAt  time.Time
+	// resolvedAt is nil while the discrepancy is open.
+	resolvedAt *time.Time
+}
+
+var ErrDiscrepancyResolved = errors.New("discrepancy is already resolved")
+
+type DiscrepancyStatus string
+
+const (
+	DiscrepancyStatusOpen     DiscrepancyStatus = "open"
+	DiscrepancyStatusResolved DiscrepancyStatus = "resolved"
+)
+
+func NewDiscrepancy(
+	id uint64,
+	invoiceID ID,
+	address geth.Address,
+	expected WEI,
+	actual WEI,
+	blockNumber uint64,
+	status DiscrepancyStatus,
+	resolution string,
+	createdAt time.Time,
+	resolvedAt *time.Time,
+) *Discrepancy {
+	return &Discrepancy{
+		id:          id,
+		invoiceID:   invoiceID,
+		address:     address,
+		expected:    expected,
+		actual:      actual,
+		blockNumber: blockNumber,
+		status:      status,
+		resolution:  resolution,
+		createdAt:   createdAt,
+		resolvedAt:  resolvedAt,
+	}
+}
+
+// NewOpenDiscrepancy creates a discrepancy which has just been found, it gets its ID when it is saved.
+func NewOpenDiscrepancy(
+	invoiceID ID,
+	address geth.Address,
+	expected WEI,
+	actual WEI,
+	blockNumber uint64,
+	createdAt time.Time,
+) *Discrepancy {
+	return NewDiscrepancy(0, invoiceID, address, expected, actual, blockNumber, DiscrepancyStatusOpen, "", createdAt, nil)
+}
+
+func (d *Discrepancy) ID() uint64 {
+	return d.id
+}
+
+// SetID is called by repositories when a new discrepancy is saved.
+func (d *Discrepancy) SetID(id uint64) {
+	d.id = id
+}
+
+func (d *Discrepancy) InvoiceID() ID {
+	return d.invoiceID
+}
+
+func (d *Discrepancy) Address() geth.Address {
+	return d.address
+}
+
+func (d *Discrepancy) Expected() WEI {
+	return d.expected
+}
+
+func (d *Discrepancy) Actual() WEI {
+	return d.actual
+}
+
+func (d *Discrepancy) BlockNumber() uint64 {
+	return d.blockNumber
+}
+
+func (d *Discrepancy) Status() DiscrepancyStatus {
+	return d.status
+}
+
+func (d *Discrepancy) IsOpen() bool {
+	return d.status == DiscrepancyStatusOpen
+}
+
+func (d *Discrepancy) Resolution() string {
+	return d.resolution
+}
+
+func (d *Discrepancy) CreatedAt() time.Time {
+	return d.createdAt
+}
+
+func (d *Discrepancy) ResolvedAt() *time.Time {
+	return d.resolvedAt
+}
+
+// Recheck records the balances found at the block by a later reconciliation of the open discrepancy.
+func (d *Discrepancy) Recheck(expected, actual WEI, blockNumber uint64) {
+	d.expected = expected
+	d.actual = actual
+	d.blockNumber = blockNumber
+}
+
+// Resolve closes the open discrepancy with the note of the operator.
+func (d *Discrepancy) Resolve(resolution string, at time.Time) error {
+	if !d.IsOpen() {
+		return ErrDiscrepancyResolved
+	}
+
+	d.status = DiscrepancyStatusResolved
+	d.resolution = resolution
+	d.resolvedAt = &at
+
+	return nil
+}
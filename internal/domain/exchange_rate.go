@@ -0,0 +1,130 @@
+package domain
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// decimalPrecision is the number of fraction digits kept when a decimal is formatted.
+const decimalPrecision = 18
+
+var (
+	weiPerEther     = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+	decimalPattern  = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// ExchangeRate is the price of one ether in a fiat currency at the given time.
+type ExchangeRate struct {
+	currency  string
+	rate      *big.Rat
+	timestamp time.Time
+	// source tells where the rate was taken from, e.g. the address of a price feed.
+	source string
+}
+
+func NewExchangeRate(currency string, rate *big.Rat, timestamp time.Time, source string) ExchangeRate {
+	return ExchangeRate{
+		currency:  currency,
+		rate:      rate,
+		timestamp: timestamp,
+		source:    source,
+	}
+}
+
+func (r ExchangeRate) Currency() string {
+	return r.currency
+}
+
+func (r ExchangeRate) Rate() *big.Rat {
+	return r.rate
+}
+
+func (r ExchangeRate) Timestamp() time.Time {
+	return r.timestamp
+}
+
+func (r ExchangeRate) Source() string {
+	return r.source
+}
+
+// ToWEI converts the amount of the currency to wei.
+// The result is rounded up, so the invoice is never priced below the amount.
+func (r ExchangeRate) ToWEI(amount *big.Rat) WEI {
+	wei := new(big.Rat).Quo(amount, r.rate)
+	wei.Mul(wei, new(big.Rat).SetInt(weiPerEther))
+
+	quotient, remainder := new(big.Int).QuoRem(wei.Num(), wei.Denom(), new(big.Int))
+	if remainder.Sign() > 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+
+	return quotient
+}
+
+// FiatPrice is the price of an invoice set in a fiat currency.
+// The price in wei is calculated once with the locked exchange rate.
+type FiatPrice struct {
+	amount *big.Rat
+	rate   ExchangeRate
+}
+
+func NewFiatPrice(amount *big.Rat, rate ExchangeRate) *FiatPrice {
+	return &FiatPrice{
+		amount: amount,
+		rate:   rate,
+	}
+}
+
+func (p *FiatPrice) Amount() *big.Rat {
+	return p.amount
+}
+
+func (p *FiatPrice) Currency() string {
+	return p.rate.currency
+}
+
+func (p *FiatPrice) Rate() ExchangeRate {
+	return p.rate
+}
+
+// ParseCurrency parses a three-letter ISO 4217 currency code, e.g. "USD".
+func ParseCurrency(raw string) (string, error) {
+	currency := strings.ToUpper(strings.TrimSpace(raw))
+	if !currencyPattern.MatchString(currency) {
+		return "", fmt.Errorf("%q is not a currency code", raw)
+	}
+
+	return currency, nil
+}
+
+// ParseDecimal parses a non-negative decimal number, e.g. "19.99".
+// Unlike big.Rat.SetString, fractions and exponents are not accepted.
+func ParseDecimal(raw string) (*big.Rat, error) {
+	if !decimalPattern.MatchString(raw) {
+		return nil, fmt.Errorf("%q is not a decimal number", raw)
+	}
+
+	value, ok := new(big.Rat).SetString(raw)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a decimal number", raw)
+	}
+
+	return value, nil
+}
+
+// FormatDecimal formats the number without trailing zeros.
+// Numbers with more fraction digits than decimalPrecision are rounded.
+func FormatDecimal(value *big.Rat) string {
+	if value.IsInt() {
+		return value.Num().String()
+	}
+
+	formatted := value.FloatString(decimalPrecision)
+	formatted = strings.TrimRight(formatted, "0")
+
+	return strings.TrimSuffix(formatted, ".")
+}
@@ -0,0 +1,61 @@
+package domain_test
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+func TestExchangeRate_ToWEI(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		amount string
+		rate   string
+		wei    string
+	}{
+		{name: "exact", amount: "3000", rate: "2000", wei: "1500000000000000000"},
+		{name: "fraction", amount: "19.99", rate: "1999", wei: "10000000000000000"},
+		{name: "rounded up", amount: "1", rate: "3", wei: "333333333333333334"},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			amount, err := domain.ParseDecimal(tc.amount)
+			require.NoError(t, err)
+			rate, err := domain.ParseDecimal(tc.rate)
+			require.NoError(t, err)
+
+			sut := domain.NewExchangeRate("USD", rate, time.Time{}, "static")
+
+			assert.Equal(t, tc.wei, sut.ToWEI(amount).String())
+		})
+	}
+}
+
+func TestParseDecimal(t *testing.T) {
+	t.Parallel()
+
+	for _, raw := range []string{"0", "19.99", "3012.45678901"} {
+		value, err := domain.ParseDecimal(raw)
+		require.NoError(t, err)
+		assert.Equal(t, raw, domain.FormatDecimal(value))
+	}
+
+	for _, raw := range []string{"", "-1", "1/3", "1e5", "1.", ".5"} {
+		_, err := domain.ParseDecimal(raw)
+		assert.Error(t, err, raw)
+	}
+
+	assert.Equal(t, "1.5", domain.FormatDecimal(big.NewRat(3, 2)))
+}
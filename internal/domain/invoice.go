@@ -1,7 +1,9 @@
 package domain
 
 import (
+	"errors"
 	"math/big"
+	"time"
 
 	geth "github.com/ethereum/go-ethereum/common"
 )
@@ -11,7 +13,25 @@ type Invoice struct {
 	price   WEI
 	balance WEI
 	address Address
-	status  InvoiceStatus
+	// token is nil for invoices paid in ether.
+	token *Token
+	// fiat is nil for invoices priced in wei.
+	fiat   *FiatPrice
+	status InvoiceStatus
+
+	// tolerance is the underpayment which still settles the invoice.
+	tolerance WEI
+
+	requiredConfirmations uint64
+	payments              []*Payment
+	transfers             []*Transfer
+
+	createdAt time.Time
+	// expiresAt is nil for invoices that never expire.
+	expiresAt *time.Time
+
+	// version is the number of times the invoice has been saved, zero for a new invoice.
+	version uint64
 }
 
 type (
@@ -20,11 +40,20 @@ type (
 	Address = *geth.Address
 )
 
+// ErrConcurrentUpdate is returned by repositories when the invoice has been saved
+// by someone else since it was loaded.
+var ErrConcurrentUpdate = errors.New("invoice has been updated concurrently")
+
 type InvoiceStatus string
 
 const (
-	InvoiceStatusPending InvoiceStatus = "pending"
-	InvoiceStatusPaid    InvoiceStatus = "paid"
+	InvoiceStatusPending       InvoiceStatus = "pending"
+	InvoiceStatusDetected      InvoiceStatus = "detected"
+	InvoiceStatusConfirming    InvoiceStatus = "confirming"
+	InvoiceStatusPartiallyPaid InvoiceStatus = "partially_paid"
+	InvoiceStatusPaid          InvoiceStatus = "paid"
+	InvoiceStatusOverpaid      InvoiceStatus = "overpaid"
+	InvoiceStatusExpired       InvoiceStatus = "expired"
 )
 
 func NewInvoice(
@@ -32,17 +61,65 @@ func NewInvoice(
 	price WEI,
 	balance WEI,
 	address *geth.Address,
+	token *Token,
+	fiat *FiatPrice,
 	status InvoiceStatus,
+	tolerance WEI,
+	requiredConfirmations uint64,
+	createdAt time.Time,
+	expiresAt *time.Time,
+	payments []*Payment,
+	transfers []*Transfer,
 ) *Invoice {
 	return &Invoice{
-		id:      id,
-		price:   price,
-		balance: balance,
-		address: address,
-		status:  status,
+		id:                    id,
+		price:                 price,
+		balance:               balance,
+		address:               address,
+		token:                 token,
+		fiat:                  fiat,
+		status:                status,
+		tolerance:             tolerance,
+		requiredConfirmations: requiredConfirmations,
+		payments:              payments,
+		transfers:             transfers,
+		createdAt:             createdAt,
+		expiresAt:             expiresAt,
 	}
 }
 
+// Version returns the number of times the invoice has been saved.
+// Repositories reject saving an invoice which has been saved by someone else since it was loaded.
+func (i *Invoice) Version() uint64 {
+	return i.version
+}
+
+// SetVersion is called by repositories when the invoice is loaded or saved.
+func (i *Invoice) SetVersion(version uint64) {
+	i.version = version
+}
+
+// Clone returns a copy of the invoice which can be changed without affecting the original,
+// e.g. by a repository that keeps invoices in memory.
+func (i *Invoice) Clone() *Invoice {
+	clone := *i
+	clone.balance = new(big.Int).Set(i.balance)
+
+	clone.payments = make([]*Payment, len(i.payments))
+	for n, payment := range i.payments {
+		payment := *payment
+		clone.payments[n] = &payment
+	}
+
+	clone.transfers = make([]*Transfer, len(i.transfers))
+	for n, transfer := range i.transfers {
+		transfer := *transfer
+		clone.transfers[n] = &transfer
+	}
+
+	return &clone
+}
+
 func (i *Invoice) ID() ID {
 	return i.id
 }
@@ -59,14 +136,435 @@ func (i *Invoice) Address() Address {
 	return i.address
 }
 
+// Token returns the token of the invoice or nil if the invoice is paid in ether.
+func (i *Invoice) Token() *Token {
+	return i.token
+}
+
+// Fiat returns the price in a fiat currency the invoice was created with, if any.
+func (i *Invoice) Fiat() *FiatPrice {
+	return i.fiat
+}
+
+// Accepts reports whether the payment is made in the currency of the invoice.
+func (i *Invoice) Accepts(kind PaymentKind, contract *geth.Address) bool {
+	if i.token == nil {
+		return kind == PaymentKindTransaction || kind == PaymentKindInternalCall
+	}
+
+	return kind == PaymentKindTokenTransfer && contract != nil && *contract == i.token.address
+}
+
 func (i *Invoice) Status() InvoiceStatus {
 	return i.status
 }
 
+func (i *Invoice) Tolerance() WEI {
+	return i.tolerance
+}
+
+// IsSettled reports whether the balance covers the price within the tolerance.
+func (i *Invoice) IsSettled() bool {
+	settled := new(big.Int).Add(i.netBalance(), i.tolerance)
+
+	return settled.Cmp(i.price) >= 0
+}
+
+// AmountDue returns the amount left to pay. It is zero for settled invoices.
+func (i *Invoice) AmountDue() WEI {
+	if i.IsSettled() {
+		return new(big.Int)
+	}
+
+	return new(big.Int).Sub(i.price, i.netBalance())
+}
+
+// Excess returns the amount paid over the price.
+func (i *Invoice) Excess() WEI {
+	balance := i.netBalance()
+	if balance.Cmp(i.price) <= 0 {
+		return new(big.Int)
+	}
+
+	return new(big.Int).Sub(balance, i.price)
+}
+
+// Refunded returns the total value of refunds which have not failed.
+func (i *Invoice) Refunded() WEI {
+	refunded := new(big.Int)
+
+	for _, transfer := range i.transfers {
+		if transfer.kind == TransferKindRefund && !transfer.IsFailed() {
+			refunded.Add(refunded, transfer.value)
+		}
+	}
+
+	return refunded
+}
+
+// Refundable returns the amount which can still be refunded,
+// which includes late payments.
+func (i *Invoice) Refundable() WEI {
+	refundable := new(big.Int).Add(i.balance, i.LateAmount())
+
+	return refundable.Sub(refundable, i.Refunded())
+}
+
+// netBalance returns the balance without refunds.
+// Refunds are taken from late payments first, since those are not credited to the balance.
+func (i *Invoice) netBalance() WEI {
+	fromBalance := new(big.Int).Sub(i.Refunded(), i.LateAmount())
+	if fromBalance.Sign() <= 0 {
+		return i.balance
+	}
+
+	return fromBalance.Sub(i.balance, fromBalance)
+}
+
+// ExpectedBalance returns the amount which must be held by the invoice address
+// in the currency of the invoice: all payments which are not reverted, including late ones,
+// minus confirmed transfers and, for ether invoices, the fees of transfers included in blocks.
+// It is only accurate if the invoice has no pending transfer.
+func (i *Invoice) ExpectedBalance() WEI {
+	expected := new(big.Int)
+
+	for _, payment := range i.payments {
+		if !payment.IsReverted() {
+			expected.Add(expected, payment.value)
+		}
+	}
+
+	for _, transfer := range i.transfers {
+		if transfer.IsConfirmed() {
+			expected.Sub(expected, transfer.value)
+		}
+
+		if i.token == nil && transfer.blockNumber > 0 {
+			fee := new(big.Int).SetUint64(transfer.gasUsed)
+			expected.Sub(expected, fee.Mul(fee, transfer.effectiveGasPrice))
+		}
+	}
+
+	return expected
+}
+
+// ChangedAfter reports whether the invoice has payments or transfers included in blocks after the given one.
+func (i *Invoice) ChangedAfter(blockNumber uint64) bool {
+	for _, payment := range i.payments {
+		if payment.blockNumber > blockNumber {
+			return true
+		}
+	}
+
+	for _, transfer := range i.transfers {
+		if transfer.blockNumber > blockNumber {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsOpen reports whether the invoice address may still hold funds:
+// the invoice is not swept and did not expire without payments.
+func (i *Invoice) IsOpen() bool {
+	if sweep := i.Sweep(); sweep != nil && sweep.IsConfirmed() {
+		return false
+	}
+
+	return i.status != InvoiceStatusExpired || len(i.payments) > 0
+}
+
+// Payer returns the sender of the payments if all of them were sent from the same address.
+// The payer is unknown if the invoice has an opening balance.
+func (i *Invoice) Payer() (geth.Address, bool) {
+	var (
+		payer geth.Address
+		found bool
+	)
+
+	for _, payment := range i.payments {
+		if payment.IsReverted() {
+			continue
+		}
+
+		if payment.kind == PaymentKindOpeningBalance {
+			return geth.Address{}, false
+		}
+
+		if found && payment.sender != payer {
+			return geth.Address{}, false
+		}
+
+		payer = payment.sender
+		found = true
+	}
+
+	return payer, found
+}
+
+func (i *Invoice) RequiredConfirmations() uint64 {
+	return i.requiredConfirmations
+}
+
+func (i *Invoice) Payments() []*Payment {
+	return i.payments
+}
+
+func (i *Invoice) Transfers() []*Transfer {
+	return i.transfers
+}
+
+// PendingTransfer returns the transfer which is not confirmed or failed yet, if any.
+func (i *Invoice) PendingTransfer() *Transfer {
+	for _, transfer := range i.transfers {
+		if transfer.IsPending() {
+			return transfer
+		}
+	}
+
+	return nil
+}
+
+// Sweep returns the latest sweep of the invoice which has not failed, if any.
+func (i *Invoice) Sweep() *Transfer {
+	for n := len(i.transfers) - 1; n >= 0; n-- {
+		transfer := i.transfers[n]
+		if transfer.kind == TransferKindSweep && transfer.status != TransferStatusFailed {
+			return transfer
+		}
+	}
+
+	return nil
+}
+
+// AddTransfer records a transfer from the invoice address.
+// Refunds are debited from the balance at once and credited back if they fail.
+func (i *Invoice) AddTransfer(transfer *Transfer) error {
+	if i.PendingTransfer() != nil {
+		return ErrPendingTransfer
+	}
+
+	if transfer.kind == TransferKindRefund && transfer.value.Cmp(i.Refundable()) > 0 {
+		return ErrRefundExceedsBalance
+	}
+
+	i.transfers = append(i.transfers, transfer)
+	i.refreshStatus()
+
+	return nil
+}
+
+// FailTransfer marks the transfer as failed. Gas used is zero if the transaction was never included in a block.
+func (i *Invoice) FailTransfer(transfer *Transfer, blockNumber, gasUsed uint64, effectiveGasPrice WEI) {
+	transfer.Fail(blockNumber, gasUsed, effectiveGasPrice)
+
+	i.refreshStatus()
+}
+
+func (i *Invoice) CreatedAt() time.Time {
+	return i.createdAt
+}
+
+func (i *Invoice) ExpiresAt() *time.Time {
+	return i.expiresAt
+}
+
+// LateAmount returns the total value of confirmed late payments,
+// which are not credited to the balance.
+func (i *Invoice) LateAmount() WEI {
+	amount := new(big.Int)
+
+	for _, payment := range i.payments {
+		if payment.late && payment.IsConfirmed() {
+			amount.Add(amount, payment.value)
+		}
+	}
+
+	return amount
+}
+
+// Confirmations returns the number of confirmations of the least confirmed payment.
+// Reverted and late payments are not taken into account.
+func (i *Invoice) Confirmations() uint64 {
+	var (
+		confirmations uint64
+		found         bool
+	)
+
+	for _, payment := range i.payments {
+		if payment.IsReverted() || payment.late {
+			continue
+		}
+
+		if !found || payment.confirmations < confirmations {
+			confirmations = payment.confirmations
+			found = true
+		}
+	}
+
+	return confirmations
+}
+
+// HasUnconfirmedPayments reports whether the invoice is waiting for confirmations.
+func (i *Invoice) HasUnconfirmedPayments() bool {
+	for _, payment := range i.payments {
+		if payment.IsConfirming() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// awaitsDeposit reports whether any payment made before expiration is waiting for confirmations.
+func (i *Invoice) awaitsDeposit() bool {
+	for _, payment := range i.payments {
+		if payment.IsConfirming() && !payment.late {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsOverdue reports whether the invoice has expired by the given time.
+func (i *Invoice) IsOverdue(at time.Time) bool {
+	return i.expiresAt != nil && at.After(*i.expiresAt)
+}
+
+// CanExpire reports whether the invoice is unpaid and overdue.
+// Invoices with payments waiting for confirmations cannot expire,
+// because these payments were made in time.
+func (i *Invoice) CanExpire(now time.Time) bool {
+	switch i.status {
+	case InvoiceStatusPending, InvoiceStatusPartiallyPaid:
+		return i.IsOverdue(now)
+	default:
+		return false
+	}
+}
+
+// Expire marks the invoice as expired if it can expire.
+// It reports whether the invoice has changed.
+func (i *Invoice) Expire(now time.Time) bool {
+	if !i.CanExpire(now) {
+		return false
+	}
+
+	i.status = InvoiceStatusExpired
+
+	return true
+}
+
+// Detect records a payment which has just been included in a block.
+// The value is not credited until the payment gets enough confirmations.
+// A payment included in a block after the invoice expired is marked as late.
+// A payment that has already been detected is ignored,
+// unless it was reverted and now is included in another block.
+// It reports whether the payment has been recorded.
+func (i *Invoice) Detect(detected *Payment) bool {
+	detected.late = i.IsOverdue(detected.timestamp)
+
+	for n, payment := range i.payments {
+		if !payment.isSame(detected) {
+			continue
+		}
+
+		if !payment.IsReverted() {
+			return false
+		}
+
+		i.payments[n] = detected
+		i.UpdateConfirmations(detected.blockNumber)
+
+		return true
+	}
+
+	i.payments = append(i.payments, detected)
+	i.UpdateConfirmations(detected.blockNumber)
+
+	return true
+}
+
+// UpdateConfirmations recalculates confirmations of unconfirmed payments
+// relative to the head block and credits the ones that got enough of them.
+// It reports whether the invoice has changed.
+func (i *Invoice) UpdateConfirmations(headNumber uint64) bool {
+	changed := false
+
+	for _, payment := range i.payments {
+		if !payment.IsConfirming() || headNumber < payment.blockNumber {
+			continue
+		}
+
+		confirmations := headNumber - payment.blockNumber + 1
+		if confirmations == payment.confirmations {
+			continue
+		}
+
+		payment.confirmations = confirmations
+		changed = true
+
+		if confirmations >= i.requiredConfirmations {
+			payment.status = PaymentStatusConfirmed
+
+			if !payment.late {
+				i.Deposit(payment.value)
+			}
+		}
+	}
+
+	i.refreshStatus()
+
+	return changed
+}
+
+// Revert reverts payments included in the orphaned block
+// and returns them. Credited payments are debited from the balance.
+func (i *Invoice) Revert(blockHash Hash) []*Payment {
+	var reverted []*Payment
+
+	for _, payment := range i.payments {
+		if payment.blockHash != blockHash || payment.IsReverted() {
+			continue
+		}
+
+		if payment.IsConfirmed() && !payment.late {
+			i.balance.Sub(i.balance, payment.value)
+		}
+
+		payment.status = PaymentStatusReverted
+		payment.confirmations = 0
+		reverted = append(reverted, payment)
+	}
+
+	i.refreshStatus()
+
+	return reverted
+}
+
 func (i *Invoice) Deposit(amount WEI) {
 	i.balance.Add(i.balance, amount)
 
-	if i.balance.Cmp(i.price) >= 0 {
+	i.refreshStatus()
+}
+
+func (i *Invoice) refreshStatus() {
+	switch {
+	case i.netBalance().Cmp(i.price) > 0:
+		i.status = InvoiceStatusOverpaid
+	case i.IsSettled():
 		i.status = InvoiceStatusPaid
+	case !i.awaitsDeposit() && i.status == InvoiceStatusExpired:
+		return
+	case !i.awaitsDeposit() && i.netBalance().Sign() > 0:
+		i.status = InvoiceStatusPartiallyPaid
+	case !i.awaitsDeposit():
+		i.status = InvoiceStatusPending
+	case i.Confirmations() <= 1:
+		i.status = InvoiceStatusDetected
+	default:
+		i.status = InvoiceStatusConfirming
 	}
 }
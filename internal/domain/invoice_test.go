@@ -0,0 +1,133 @@
+package domain_test
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+const transferGas = 21_000
+
+func TestInvoice_Confirmations(t *testing.T) {
+	t.Parallel()
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	sut := domain.NewInvoice(1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 3, time.Time{}, nil, nil, nil)
+
+	sut.Detect(newPayment(1, 10, 2))
+	assert.Equal(t, domain.InvoiceStatusDetected, sut.Status())
+	assert.Equal(t, uint64(1), sut.Confirmations())
+	assert.Equal(t, big.NewInt(0), sut.Balance())
+
+	sut.Detect(newPayment(1, 10, 2))
+	assert.Len(t, sut.Payments(), 1, "the same transaction must be detected once")
+
+	assert.True(t, sut.UpdateConfirmations(11))
+	assert.Equal(t, domain.InvoiceStatusConfirming, sut.Status())
+	assert.Equal(t, uint64(2), sut.Confirmations())
+
+	assert.False(t, sut.UpdateConfirmations(11))
+
+	assert.True(t, sut.UpdateConfirmations(12))
+	assert.Equal(t, domain.InvoiceStatusPaid, sut.Status())
+	assert.Equal(t, big.NewInt(2), sut.Balance())
+	assert.False(t, sut.HasUnconfirmedPayments())
+}
+
+func TestInvoice_Revert(t *testing.T) {
+	t.Parallel()
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	sut := domain.NewInvoice(1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 1, time.Time{}, nil, nil, nil)
+
+	sut.Detect(newPayment(1, 10, 2))
+	assert.Equal(t, domain.InvoiceStatusPaid, sut.Status())
+
+	reverted := sut.Revert(geth.BigToHash(big.NewInt(10)))
+	assert.Len(t, reverted, 1)
+	assert.Equal(t, domain.InvoiceStatusPending, sut.Status())
+	assert.Zero(t, sut.Balance().Sign())
+
+	assert.Empty(t, sut.Revert(geth.BigToHash(big.NewInt(10))), "payments must be reverted once")
+
+	sut.Detect(newPayment(1, 11, 2))
+	assert.Equal(t, domain.InvoiceStatusPaid, sut.Status())
+	assert.Equal(t, big.NewInt(2), sut.Balance())
+}
+
+func TestInvoice_PartialPayments(t *testing.T) {
+	t.Parallel()
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	sut := domain.NewInvoice(
+		1, big.NewInt(10), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(1), 1, time.Time{}, nil, nil, nil,
+	)
+	assert.Equal(t, big.NewInt(10), sut.AmountDue())
+
+	sut.Detect(newPayment(1, 10, 8))
+	assert.Equal(t, domain.InvoiceStatusPartiallyPaid, sut.Status())
+	assert.Equal(t, big.NewInt(2), sut.AmountDue())
+
+	sut.Detect(newPayment(2, 11, 1))
+	assert.Equal(t, domain.InvoiceStatusPaid, sut.Status(), "the underpayment is within the tolerance")
+	assert.Zero(t, sut.AmountDue().Sign())
+	assert.Zero(t, sut.Excess().Sign())
+
+	sut.Detect(newPayment(3, 12, 3))
+	assert.Equal(t, domain.InvoiceStatusOverpaid, sut.Status())
+	assert.Equal(t, big.NewInt(2), sut.Excess())
+}
+
+func TestInvoice_Expire(t *testing.T) {
+	t.Parallel()
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	// Blocks up to 10 are mined in time.
+	expiresAt := time.Unix(10*12, 0).UTC()
+	sut := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 2, time.Time{}, &expiresAt, nil, nil,
+	)
+
+	sut.Detect(newPayment(1, 10, 1))
+	assert.False(t, sut.Expire(expiresAt.Add(time.Second)), "payments made in time must be awaited")
+
+	sut.UpdateConfirmations(11)
+	assert.Equal(t, domain.InvoiceStatusPartiallyPaid, sut.Status())
+	assert.False(t, sut.Expire(expiresAt), "the invoice must not expire before its expiration time")
+	assert.True(t, sut.Expire(expiresAt.Add(time.Second)))
+	assert.Equal(t, domain.InvoiceStatusExpired, sut.Status())
+
+	assert.True(t, sut.Detect(newPayment(2, 11, 1)))
+	assert.True(t, sut.Payments()[1].IsLate())
+	assert.Equal(t, domain.InvoiceStatusExpired, sut.Status())
+
+	sut.UpdateConfirmations(12)
+	assert.True(t, sut.Payments()[1].IsConfirmed())
+	assert.Equal(t, domain.InvoiceStatusExpired, sut.Status(), "late payments must not pay the invoice")
+	assert.Equal(t, big.NewInt(1), sut.Balance())
+	assert.Equal(t, big.NewInt(1), sut.LateAmount())
+}
+
+var sender = geth.HexToAddress("0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf")
+
+// newPayment creates a payment made by the transaction with the given number in the block.
+func newPayment(tx byte, blockNumber uint64, value int64) *domain.Payment {
+	return domain.NewDetectedPayment(
+		geth.Hash{tx},
+		domain.PaymentKindTransaction,
+		0,
+		blockNumber,
+		geth.BigToHash(new(big.Int).SetUint64(blockNumber)),
+		sender,
+		big.NewInt(value),
+		time.Unix(int64(blockNumber)*12, 0).UTC(),
+		transferGas,
+		big.NewInt(1),
+		true,
+	)
+}
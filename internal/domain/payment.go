@@ -0,0 +1,202 @@
+package domain
+
+import (
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+)
+
+type Hash = geth.Hash
+
+// Payment is a transfer of funds to an invoice address.
+// A single transaction may make several payments,
+// so payments are unique by transaction hash, kind and index.
+type Payment struct {
+	txHash Hash
+	kind   PaymentKind
+	// index is the position of the payment in the transaction:
+	// the log index for token transfers, the position of the call in the trace for internal calls
+	// and zero for transaction value.
+	index       uint64
+	blockNumber uint64
+	blockHash   Hash
+	sender      geth.Address
+	value       WEI
+	timestamp   time.Time
+
+	confirmations uint64
+	status        PaymentStatus
+
+	gasUsed           uint64
+	effectiveGasPrice WEI
+
+	// late is set for payments included in a block after the invoice expired.
+	// Late payments are confirmed as usual, but never credited to the balance.
+	late bool
+	// verified is set if the transaction and its receipt were checked
+	// against the transaction and receipt roots of the block header.
+	verified bool
+}
+
+type PaymentKind string
+
+const (
+	// PaymentKindTransaction is the native value of a transaction sent to the invoice address.
+	PaymentKindTransaction PaymentKind = "transaction"
+	// PaymentKindTokenTransfer is an ERC-20 Transfer event with the invoice address as the recipient.
+	PaymentKindTokenTransfer PaymentKind = "token_transfer"
+	// PaymentKindInternalCall is ether sent to the invoice address by a contract,
+	// e.g. a smart-contract wallet, while executing a transaction.
+	PaymentKindInternalCall PaymentKind = "internal_call"
+	// PaymentKindOpeningBalance is the part of the balance of a recovered invoice
+	// which is not explained by the scanned blocks, e.g. deposits made before them.
+	// It has no transaction and its sender is unknown.
+	PaymentKindOpeningBalance PaymentKind = "opening_balance"
+)
+
+type PaymentStatus string
+
+const (
+	PaymentStatusConfirming PaymentStatus = "confirming"
+	PaymentStatusConfirmed  PaymentStatus = "confirmed"
+	PaymentStatusReverted   PaymentStatus = "reverted"
+)
+
+func NewPayment(
+	txHash Hash,
+	kind PaymentKind,
+	index uint64,
+	blockNumber uint64,
+	blockHash Hash,
+	sender geth.Address,
+	value WEI,
+	timestamp time.Time,
+	confirmations uint64,
+	status PaymentStatus,
+	gasUsed uint64,
+	effectiveGasPrice WEI,
+	late bool,
+	verified bool,
+) *Payment {
+	return &Payment{
+		txHash:            txHash,
+		kind:              kind,
+		index:             index,
+		blockNumber:       blockNumber,
+		blockHash:         blockHash,
+		sender:            sender,
+		value:             value,
+		timestamp:         timestamp,
+		confirmations:     confirmations,
+		status:            status,
+		gasUsed:           gasUsed,
+		effectiveGasPrice: effectiveGasPrice,
+		late:              late,
+		verified:          verified,
+	}
+}
+
+// NewDetectedPayment creates a payment made by a successful transaction
+// which has just been included in a block.
+func NewDetectedPayment(
+	txHash Hash,
+	kind PaymentKind,
+	index uint64,
+	blockNumber uint64,
+	blockHash Hash,
+	sender geth.Address,
+	value WEI,
+	timestamp time.Time,
+	gasUsed uint64,
+	effectiveGasPrice WEI,
+	verified bool,
+) *Payment {
+	return NewPayment(
+		txHash,
+		kind,
+		index,
+		blockNumber,
+		blockHash,
+		sender,
+		value,
+		timestamp,
+		0,
+		PaymentStatusConfirming,
+		gasUsed,
+		effectiveGasPrice,
+		false,
+		verified,
+	)
+}
+
+func (p *Payment) TxHash() Hash {
+	return p.txHash
+}
+
+func (p *Payment) Kind() PaymentKind {
+	return p.kind
+}
+
+func (p *Payment) Index() uint64 {
+	return p.index
+}
+
+func (p *Payment) BlockNumber() uint64 {
+	return p.blockNumber
+}
+
+func (p *Payment) BlockHash() Hash {
+	return p.blockHash
+}
+
+func (p *Payment) Sender() geth.Address {
+	return p.sender
+}
+
+func (p *Payment) Value() WEI {
+	return p.value
+}
+
+func (p *Payment) Timestamp() time.Time {
+	return p.timestamp
+}
+
+func (p *Payment) Confirmations() uint64 {
+	return p.confirmations
+}
+
+func (p *Payment) Status() PaymentStatus {
+	return p.status
+}
+
+func (p *Payment) GasUsed() uint64 {
+	return p.gasUsed
+}
+
+func (p *Payment) EffectiveGasPrice() WEI {
+	return p.effectiveGasPrice
+}
+
+func (p *Payment) IsLate() bool {
+	return p.late
+}
+
+func (p *Payment) IsVerified() bool {
+	return p.verified
+}
+
+func (p *Payment) IsConfirmed() bool {
+	return p.status == PaymentStatusConfirmed
+}
+
+func (p *Payment) IsConfirming() bool {
+	return p.status == PaymentStatusConfirming
+}
+
+func (p *Payment) IsReverted() bool {
+	return p.status == PaymentStatusReverted
+}
+
+func (p *Payment) isSame(other *Payment) bool {
+	return p.txHash == other.txHash && p.kind == other.kind && p.index == other.index
+}
@@ -0,0 +1,34 @@
+package domain
+
+import (
+	geth "github.com/ethereum/go-ethereum/common"
+)
+
+// Token is an ERC-20 token in which an invoice is priced and paid.
+// Amounts of token invoices are in the smallest unit of the token,
+// decimals tell how to display them.
+type Token struct {
+	address  geth.Address
+	symbol   string
+	decimals uint8
+}
+
+func NewToken(address geth.Address, symbol string, decimals uint8) *Token {
+	return &Token{
+		address:  address,
+		symbol:   symbol,
+		decimals: decimals,
+	}
+}
+
+func (t *Token) Address() geth.Address {
+	return t.address
+}
+
+func (t *Token) Symbol() string {
+	return t.symbol
+}
+
+func (t *Token) Decimals() uint8 {
+	return t.decimals
+}
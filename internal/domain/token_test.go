@@ -0,0 +1,54 @@
+package domain_test
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+var tokenAddress = geth.HexToAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48")
+
+func TestInvoice_TokenPayments(t *testing.T) {
+	t.Parallel()
+
+	address := geth.HexToAddress("0x0")
+	token := domain.NewToken(tokenAddress, "USDC", 6)
+	sut := domain.NewInvoice(
+		1, big.NewInt(3_000_000), big.NewInt(0), &address, token, nil, domain.InvoiceStatusPending, big.NewInt(0), 1, time.Time{}, nil, nil, nil,
+	)
+
+	otherToken := geth.HexToAddress("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.True(t, sut.Accepts(domain.PaymentKindTokenTransfer, &tokenAddress))
+	assert.False(t, sut.Accepts(domain.PaymentKindTokenTransfer, &otherToken))
+	assert.False(t, sut.Accepts(domain.PaymentKindTransaction, nil), "ether must not pay token invoices")
+	assert.False(t, sut.Accepts(domain.PaymentKindInternalCall, nil), "ether must not pay token invoices")
+
+	assert.True(t, sut.Detect(newTokenPayment(1, 0, 10, 1_000_000)))
+	assert.True(t, sut.Detect(newTokenPayment(1, 1, 10, 2_000_000)), "a transaction may make several transfers")
+	assert.False(t, sut.Detect(newTokenPayment(1, 1, 10, 2_000_000)), "the same transfer must be detected once")
+	assert.Len(t, sut.Payments(), 2)
+	assert.Equal(t, domain.InvoiceStatusPaid, sut.Status())
+	assert.Equal(t, big.NewInt(3_000_000), sut.Balance())
+}
+
+// newTokenPayment creates a payment made by the transfer event with the given log index.
+func newTokenPayment(tx byte, logIndex, blockNumber uint64, value int64) *domain.Payment {
+	return domain.NewDetectedPayment(
+		geth.Hash{tx},
+		domain.PaymentKindTokenTransfer,
+		logIndex,
+		blockNumber,
+		geth.BigToHash(new(big.Int).SetUint64(blockNumber)),
+		sender,
+		big.NewInt(value),
+		time.Unix(int64(blockNumber)*12, 0).UTC(),
+		transferGas,
+		big.NewInt(1),
+		true,
+	)
+}
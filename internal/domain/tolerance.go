@@ -0,0 +1,66 @@
+package domain
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const maxTolerancePercent = 100
+
+// Tolerance is the amount by which an invoice may be underpaid and still be settled.
+// It is either an absolute amount of wei or a percentage of the invoice price.
+// The zero value allows no underpayment.
+type Tolerance struct {
+	absolute WEI
+	percent  *big.Rat
+}
+
+func NewAbsoluteTolerance(amount WEI) Tolerance {
+	return Tolerance{absolute: amount}
+}
+
+func NewPercentTolerance(percent *big.Rat) Tolerance {
+	return Tolerance{percent: percent}
+}
+
+// ParseTolerance parses an absolute amount of wei, e.g. "1000",
+// or a percentage of the invoice price, e.g. "0.5%".
+func ParseTolerance(raw string) (Tolerance, error) {
+	if rawPercent, ok := strings.CutSuffix(raw, "%"); ok {
+		percent, ok := new(big.Rat).SetString(rawPercent)
+		if !ok || percent.Sign() < 0 || percent.Cmp(big.NewRat(maxTolerancePercent, 1)) > 0 {
+			return Tolerance{}, fmt.Errorf("tolerance %q must be a percentage between 0%% and 100%%", raw)
+		}
+
+		return NewPercentTolerance(percent), nil
+	}
+
+	amount, ok := new(big.Int).SetString(raw, 10)
+	if !ok || amount.Sign() < 0 {
+		return Tolerance{}, fmt.Errorf("tolerance %q must be a non-negative amount of wei or a percentage", raw)
+	}
+
+	return NewAbsoluteTolerance(amount), nil
+}
+
+// For returns the tolerated underpayment for the price. Fractions of wei are rounded down.
+func (t Tolerance) For(price WEI) WEI {
+	switch {
+	case t.absolute != nil:
+		return new(big.Int).Set(t.absolute)
+	case t.percent != nil:
+		amount := new(big.Int).Mul(price, t.percent.Num())
+		denominator := new(big.Int).Mul(t.percent.Denom(), big.NewInt(maxTolerancePercent))
+
+		return amount.Quo(amount, denominator)
+	default:
+		return new(big.Int)
+	}
+}
+
+// IsRelative reports whether the tolerance is a percentage of the price.
+// Absolute tolerance is an amount of wei, so it does not apply to token prices.
+func (t Tolerance) IsRelative() bool {
+	return t.percent != nil
+}
@@ -0,0 +1,46 @@
+package domain_test
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+func TestParseTolerance(t *testing.T) {
+	t.Parallel()
+
+	price := big.NewInt(1_000)
+
+	testCases := []struct {
+		raw      string
+		expected *big.Int
+	}{
+		{raw: "0", expected: big.NewInt(0)},
+		{raw: "15", expected: big.NewInt(15)},
+		{raw: "1%", expected: big.NewInt(10)},
+		{raw: "0.25%", expected: big.NewInt(2)},
+		{raw: "100%", expected: big.NewInt(1_000)},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.raw, func(t *testing.T) {
+			t.Parallel()
+
+			tolerance, err := domain.ParseTolerance(tc.raw)
+			require.NoError(t, err)
+
+			assert.Zero(t, tc.expected.Cmp(tolerance.For(price)))
+		})
+	}
+
+	for _, raw := range []string{"", "-1", "abc", "101%", "-1%"} {
+		_, err := domain.ParseTolerance(raw)
+		assert.Error(t, err, raw)
+	}
+}
@@ -0,0 +1,163 @@
+package domain
+
+import (
+	"errors"
+	"math/big"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+)
+
+// Transfer is a transaction sent from an invoice address.
+// Only one transfer of an invoice can be pending at a time,
+// because transfers from the same address must have sequential nonces.
+type Transfer struct {
+	kind   TransferKind
+	txHash Hash
+	to     geth.Address
+	value  WEI
+	nonce  uint64
+	// maxFee is the largest fee the transaction may cost.
+	maxFee    WEI
+	createdAt time.Time
+
+	status            TransferStatus
+	blockNumber       uint64
+	gasUsed           uint64
+	effectiveGasPrice WEI
+}
+
+var (
+	ErrPendingTransfer      = errors.New("invoice already has a pending transfer")
+	ErrRefundExceedsBalance = errors.New("refund exceeds the refundable amount")
+)
+
+type TransferKind string
+
+const (
+	TransferKindSweep  TransferKind = "sweep"
+	TransferKindRefund TransferKind = "refund"
+)
+
+type TransferStatus string
+
+const (
+	TransferStatusPending   TransferStatus = "pending"
+	TransferStatusConfirmed TransferStatus = "confirmed"
+	// TransferStatusFailed is set for reverted transactions
+	// and for transactions that were never included in a block.
+	TransferStatusFailed TransferStatus = "failed"
+)
+
+func NewTransfer(
+	kind TransferKind,
+	txHash Hash,
+	to geth.Address,
+	value WEI,
+	nonce uint64,
+	maxFee WEI,
+	createdAt time.Time,
+	status TransferStatus,
+	blockNumber uint64,
+	gasUsed uint64,
+	effectiveGasPrice WEI,
+) *Transfer {
+	return &Transfer{
+		kind:              kind,
+		txHash:            txHash,
+		to:                to,
+		value:             value,
+		nonce:             nonce,
+		maxFee:            maxFee,
+		createdAt:         createdAt,
+		status:            status,
+		blockNumber:       blockNumber,
+		gasUsed:           gasUsed,
+		effectiveGasPrice: effectiveGasPrice,
+	}
+}
+
+// NewPendingTransfer creates a transfer which has just been signed.
+func NewPendingTransfer(
+	kind TransferKind,
+	txHash Hash,
+	to geth.Address,
+	value WEI,
+	nonce uint64,
+	maxFee WEI,
+	createdAt time.Time,
+) *Transfer {
+	return NewTransfer(kind, txHash, to, value, nonce, maxFee, createdAt, TransferStatusPending, 0, 0, new(big.Int))
+}
+
+func (t *Transfer) Kind() TransferKind {
+	return t.kind
+}
+
+func (t *Transfer) TxHash() Hash {
+	return t.txHash
+}
+
+func (t *Transfer) To() geth.Address {
+	return t.to
+}
+
+func (t *Transfer) Value() WEI {
+	return t.value
+}
+
+func (t *Transfer) Nonce() uint64 {
+	return t.nonce
+}
+
+func (t *Transfer) MaxFee() WEI {
+	return t.maxFee
+}
+
+func (t *Transfer) CreatedAt() time.Time {
+	return t.createdAt
+}
+
+func (t *Transfer) Status() TransferStatus {
+	return t.status
+}
+
+func (t *Transfer) BlockNumber() uint64 {
+	return t.blockNumber
+}
+
+func (t *Transfer) GasUsed() uint64 {
+	return t.gasUsed
+}
+
+func (t *Transfer) EffectiveGasPrice() WEI {
+	return t.effectiveGasPrice
+}
+
+func (t *Transfer) IsPending() bool {
+	return t.status == TransferStatusPending
+}
+
+func (t *Transfer) IsFailed() bool {
+	return t.status == TransferStatusFailed
+}
+
+func (t *Transfer) IsConfirmed() bool {
+	return t.status == TransferStatusConfirmed
+}
+
+// Confirm records the block in which a successful transfer got enough confirmations.
+func (t *Transfer) Confirm(blockNumber, gasUsed uint64, effectiveGasPrice WEI) {
+	t.status = TransferStatusConfirmed
+	t.blockNumber = blockNumber
+	t.gasUsed = gasUsed
+	t.effectiveGasPrice = effectiveGasPrice
+}
+
+// Fail marks the transfer as failed. Use Invoice.FailTransfer to update the invoice as well.
+func (t *Transfer) Fail(blockNumber, gasUsed uint64, effectiveGasPrice WEI) {
+	t.status = TransferStatusFailed
+	t.blockNumber = blockNumber
+	t.gasUsed = gasUsed
+	t.effectiveGasPrice = effectiveGasPrice
+}
@@ -0,0 +1,137 @@
+package domain_test
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+var treasury = geth.HexToAddress("0x2B5AD5c4795c026514f8317c7a215E218DcCD6cF")
+
+func TestInvoice_AddTransfer(t *testing.T) {
+	t.Parallel()
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	sut := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 1, time.Time{}, nil, nil, nil,
+	)
+	assert.Nil(t, sut.Sweep())
+
+	first := newSweep(0)
+	require.NoError(t, sut.AddTransfer(first))
+	assert.ErrorIs(t, sut.AddTransfer(newSweep(1)), domain.ErrPendingTransfer)
+	assert.Equal(t, first, sut.PendingTransfer())
+
+	first.Fail(0, 0, big.NewInt(0))
+	assert.Nil(t, sut.PendingTransfer())
+	assert.Nil(t, sut.Sweep(), "failed sweeps must be ignored")
+
+	second := newSweep(0)
+	require.NoError(t, sut.AddTransfer(second))
+	second.Confirm(10, transferGas, big.NewInt(1))
+	assert.Equal(t, second, sut.Sweep())
+	assert.Nil(t, sut.PendingTransfer())
+}
+
+func TestInvoice_Refund(t *testing.T) {
+	t.Parallel()
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	sut := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 1, time.Time{}, nil, nil, nil,
+	)
+
+	sut.Detect(newPayment(1, 10, 3))
+	assert.Equal(t, domain.InvoiceStatusOverpaid, sut.Status())
+
+	payer, ok := sut.Payer()
+	assert.True(t, ok)
+	assert.Equal(t, sender, payer)
+
+	assert.ErrorIs(t, sut.AddTransfer(newRefund(4)), domain.ErrRefundExceedsBalance)
+
+	refund := newRefund(1)
+	require.NoError(t, sut.AddTransfer(refund))
+	assert.Equal(t, domain.InvoiceStatusPaid, sut.Status())
+	assert.Equal(t, big.NewInt(1), sut.Refunded())
+	assert.Equal(t, big.NewInt(2), sut.Refundable())
+	assert.Zero(t, sut.Excess().Sign())
+
+	sut.FailTransfer(refund, 0, 0, big.NewInt(0))
+	assert.Equal(t, domain.InvoiceStatusOverpaid, sut.Status(), "failed refunds must be credited back")
+	assert.Zero(t, sut.Refunded().Sign())
+}
+
+func TestInvoice_ExpectedBalance(t *testing.T) {
+	t.Parallel()
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	sut := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 1, time.Time{}, nil, nil, nil,
+	)
+
+	sut.Detect(newPayment(1, 10, 100_000))
+	sut.Detect(newPayment(2, 11, 5))
+	sut.Revert(geth.BigToHash(big.NewInt(11)))
+	assert.Equal(t, big.NewInt(100_000), sut.ExpectedBalance(), "reverted payments must not be expected")
+
+	refund := newRefund(1)
+	require.NoError(t, sut.AddTransfer(refund))
+	refund.Confirm(12, transferGas, big.NewInt(1))
+
+	failed := newRefund(2)
+	require.NoError(t, sut.AddTransfer(failed))
+	sut.FailTransfer(failed, 13, transferGas, big.NewInt(1))
+
+	assert.Equal(t, big.NewInt(100_000-1-2*transferGas), sut.ExpectedBalance(), "fees of failed transfers are paid too")
+}
+
+func TestInvoice_ChangedAfter(t *testing.T) {
+	t.Parallel()
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	sut := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 1, time.Time{}, nil, nil, nil,
+	)
+
+	sut.Detect(newPayment(1, 10, 2))
+	assert.False(t, sut.ChangedAfter(10))
+	assert.True(t, sut.ChangedAfter(9))
+
+	refund := newRefund(1)
+	require.NoError(t, sut.AddTransfer(refund))
+	assert.False(t, sut.ChangedAfter(10), "pending transfers are not included in blocks")
+
+	refund.Confirm(12, transferGas, big.NewInt(1))
+	assert.True(t, sut.ChangedAfter(11))
+}
+
+func newRefund(value int64) *domain.Transfer {
+	return domain.NewPendingTransfer(
+		domain.TransferKindRefund,
+		geth.BigToHash(big.NewInt(value)),
+		sender,
+		big.NewInt(value),
+		0,
+		big.NewInt(transferGas),
+		time.Unix(1, 0).UTC(),
+	)
+}
+
+func newSweep(nonce uint64) *domain.Transfer {
+	return domain.NewPendingTransfer(
+		domain.TransferKindSweep,
+		geth.BigToHash(new(big.Int).SetUint64(nonce)),
+		treasury,
+		big.NewInt(2),
+		nonce,
+		big.NewInt(transferGas),
+		time.Unix(1, 0).UTC(),
+	)
+}
@@ -0,0 +1,184 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+// BundleVersion is the version of the format of offline signing bundles.
+const BundleVersion = 1
+
+// UnsignedBundle holds transfers from invoice addresses exported to be signed offline.
+type UnsignedBundle struct {
+	Version      int                   `json:"version"`
+	ChainID      *big.Int              `json:"chain_id"`
+	CreatedAt    time.Time             `json:"created_at"`
+	Transactions []UnsignedTransaction `json:"transactions"`
+}
+
+// UnsignedTransaction is an EIP-1559 transfer from the invoice address with all parameters fixed,
+// so the signer does not need access to the chain.
+type UnsignedTransaction struct {
+	InvoiceID domain.ID           `json:"invoice_id"`
+	Kind      domain.TransferKind `json:"kind"`
+	// DerivationPath is the path of the invoice key, the signer checks it against the invoice id.
+	DerivationPath string       `json:"derivation_path"`
+	From           geth.Address `json:"from"`
+	To             geth.Address `json:"to"`
+	Value          *big.Int     `json:"value"`
+	Nonce          uint64       `json:"nonce"`
+	Gas            uint64       `json:"gas"`
+	GasTipCap      *big.Int     `json:"max_priority_fee_per_gas"`
+	GasFeeCap      *big.Int     `json:"max_fee_per_gas"`
+}
+
+// SignedBundle holds transfers signed offline, ready to be imported and broadcast by the service.
+type SignedBundle struct {
+	Version      int                 `json:"version"`
+	ChainID      *big.Int            `json:"chain_id"`
+	Transactions []SignedTransaction `json:"transactions"`
+}
+
+type SignedTransaction struct {
+	InvoiceID domain.ID           `json:"invoice_id"`
+	Kind      domain.TransferKind `json:"kind"`
+	// Raw is the signed transaction encoded as for eth_sendRawTransaction.
+	Raw hexutil.Bytes `json:"raw"`
+}
+
+// NewUnsignedBundle creates an empty bundle for the chain.
+func NewUnsignedBundle(chainID *big.Int, createdAt time.Time) *UnsignedBundle {
+	return &UnsignedBundle{
+		Version:      BundleVersion,
+		ChainID:      chainID,
+		CreatedAt:    createdAt,
+		Transactions: make([]UnsignedTransaction, 0),
+	}
+}
+
+// Add adds the unsigned transfer built by BuildTransfer from the invoice address.
+func (b *UnsignedBundle) Add(id domain.ID, kind domain.TransferKind, from geth.Address, tx *types.Transaction) {
+	b.Transactions = append(b.Transactions, UnsignedTransaction{
+		InvoiceID:      id,
+		Kind:           kind,
+		DerivationPath: InvoiceDerivationPath(id).String(),
+		From:           from,
+		To:             *tx.To(),
+		Value:          tx.Value(),
+		Nonce:          tx.Nonce(),
+		Gas:            tx.Gas(),
+		GasTipCap:      tx.GasTipCap(),
+		GasFeeCap:      tx.GasFeeCap(),
+	})
+}
+
+// SignBundle signs every transfer of the bundle with the key of its invoice.
+// The derivation path and the sender of every transfer are checked against the invoice id,
+// so a tampered bundle can't make the wallet sign from another address.
+func SignBundle(ctx context.Context, wallet *HDWallet, bundle *UnsignedBundle) (*SignedBundle, error) {
+	if bundle.Version != BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", bundle.Version)
+	}
+	if bundle.ChainID == nil || bundle.ChainID.Sign() <= 0 {
+		return nil, fmt.Errorf("bundle has no chain id")
+	}
+
+	signer := types.LatestSignerForChainID(bundle.ChainID)
+
+	signed := &SignedBundle{
+		Version:      BundleVersion,
+		ChainID:      bundle.ChainID,
+		Transactions: make([]SignedTransaction, 0, len(bundle.Transactions)),
+	}
+
+	for _, unsigned := range bundle.Transactions {
+		if path := InvoiceDerivationPath(unsigned.InvoiceID).String(); unsigned.DerivationPath != path {
+			return nil, fmt.Errorf(
+				"derivation path %s of invoice %d must be %s", unsigned.DerivationPath, unsigned.InvoiceID, path,
+			)
+		}
+
+		from, err := wallet.GetInvoiceAccount(unsigned.InvoiceID)
+		if err != nil {
+			return nil, err
+		}
+		if *from != unsigned.From {
+			return nil, fmt.Errorf("address of invoice %d is %s instead of %s", unsigned.InvoiceID, from, unsigned.From)
+		}
+
+		if unsigned.Value == nil || unsigned.GasTipCap == nil || unsigned.GasFeeCap == nil {
+			return nil, fmt.Errorf("transfer of invoice %d has no value or fees", unsigned.InvoiceID)
+		}
+
+		to := unsigned.To
+		tx := types.NewTx(&types.DynamicFeeTx{
+			ChainID:   bundle.ChainID,
+			Nonce:     unsigned.Nonce,
+			GasTipCap: unsigned.GasTipCap,
+			GasFeeCap: unsigned.GasFeeCap,
+			Gas:       unsigned.Gas,
+			To:        &to,
+			Value:     unsigned.Value,
+		})
+
+		tx, err = wallet.SignInvoiceTransaction(ctx, unsigned.InvoiceID, tx, signer)
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err := tx.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode transaction of invoice %d: %w", unsigned.InvoiceID, err)
+		}
+
+		signed.Transactions = append(signed.Transactions, SignedTransaction{
+			InvoiceID: unsigned.InvoiceID,
+			Kind:      unsigned.Kind,
+			Raw:       raw,
+		})
+	}
+
+	return signed, nil
+}
+
+// DecodeSignedTransaction decodes the transaction signed offline and recovers its sender.
+// The transaction must be signed for the chain of the service.
+func (e *Ethereum) DecodeSignedTransaction(signed SignedTransaction) (*types.Transaction, geth.Address, error) {
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(signed.Raw); err != nil {
+		return nil, geth.Address{}, common.FlagError(
+			fmt.Errorf("failed to decode transaction of invoice %d: %w", signed.InvoiceID, err),
+			common.FlagConflict,
+		)
+	}
+
+	if tx.ChainId().Cmp(e.chainID) != 0 {
+		return nil, geth.Address{}, common.FlagError(
+			fmt.Errorf("transaction %s is signed for chain %s instead of %s", tx.Hash(), tx.ChainId(), e.chainID),
+			common.FlagConflict,
+		)
+	}
+
+	if tx.To() == nil {
+		return nil, geth.Address{}, common.FlagError(
+			fmt.Errorf("transaction %s has no recipient", tx.Hash()),
+			common.FlagConflict,
+		)
+	}
+
+	sender, err := e.GetSender(tx)
+	if err != nil {
+		return nil, geth.Address{}, common.FlagError(err, common.FlagConflict)
+	}
+
+	return tx, sender, nil
+}
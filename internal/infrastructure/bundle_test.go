@@ -0,0 +1,62 @@
+package infrastructure_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestSignBundle(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	wallet, err := infrastructure.NewHDWallet(testMnemonic)
+	require.NoError(t, err)
+
+	from, err := wallet.GetInvoiceAccount(7)
+	require.NoError(t, err)
+
+	treasury := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	unsigned := infrastructure.NewUnsignedBundle(big.NewInt(fakeChainID), time.Now())
+	unsigned.Add(7, domain.TransferKindSweep, *from, types.NewTx(&types.DynamicFeeTx{
+		ChainID:   big.NewInt(fakeChainID),
+		Nonce:     3,
+		GasTipCap: big.NewInt(1),
+		GasFeeCap: big.NewInt(3),
+		Gas:       infrastructure.TransferGasLimit,
+		To:        &treasury,
+		Value:     big.NewInt(1_000),
+	}))
+	assert.Equal(t, "m/44'/60'/0'/0/7", unsigned.Transactions[0].DerivationPath)
+
+	signed, err := infrastructure.SignBundle(ctx, wallet, unsigned)
+	require.NoError(t, err)
+	require.Len(t, signed.Transactions, 1)
+
+	sut := newTestEthereum(ctx, t, newFakeNode(t))
+
+	tx, sender, err := sut.DecodeSignedTransaction(signed.Transactions[0])
+	require.NoError(t, err)
+	assert.Equal(t, *from, sender)
+	assert.Equal(t, treasury, *tx.To())
+	assert.Equal(t, big.NewInt(1_000), tx.Value())
+	assert.Equal(t, uint64(3), tx.Nonce())
+
+	unsigned.Transactions[0].InvoiceID = 8
+	_, err = infrastructure.SignBundle(ctx, wallet, unsigned)
+	assert.ErrorContains(t, err, "derivation path")
+
+	unsigned.Transactions[0].DerivationPath = "m/44'/60'/0'/0/8"
+	_, err = infrastructure.SignBundle(ctx, wallet, unsigned)
+	assert.ErrorContains(t, err, "address of invoice 8")
+}
@@ -0,0 +1,248 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+)
+
+// endpoint is an RPC endpoint of the pool.
+// The client is nil until the endpoint is dialed successfully.
+// Its fields are written only by health checks and only while the mutex of the pool is held,
+// so health checks can read them without it.
+type endpoint struct {
+	url     string
+	client  *ethclient.Client
+	healthy bool
+	// chainChecked is set once the chain id of the endpoint is known to match the pool.
+	chainChecked bool
+}
+
+// EndpointPool holds several RPC endpoints of the same chain and chooses the active one.
+// Endpoints are checked periodically, the first healthy endpoint in the configured order is active,
+// so the service switches to a backup endpoint when the primary one fails and back when it recovers.
+// An endpoint is healthy if it responds within maxLatency with a head not older than maxHeadAge.
+type EndpointPool struct {
+	endpoints  []*endpoint
+	maxHeadAge time.Duration
+	maxLatency time.Duration
+
+	mu      sync.RWMutex
+	chainID *big.Int
+	active  *endpoint
+	// switched is closed when another endpoint becomes active.
+	switched chan struct{}
+}
+
+// DialEndpoints dials the endpoints in order. At least one of them must be reachable,
+// the others are dialed again by health checks.
+func DialEndpoints(ctx context.Context, urls []string, maxHeadAge, maxLatency time.Duration) (*EndpointPool, error) {
+	p := &EndpointPool{
+		endpoints:  make([]*endpoint, 0, len(urls)),
+		maxHeadAge: maxHeadAge,
+		maxLatency: maxLatency,
+		switched:   make(chan struct{}),
+	}
+
+	var errs []error
+
+	for _, url := range urls {
+		e := &endpoint{url: url}
+		p.endpoints = append(p.endpoints, e)
+
+		if err := p.dial(ctx, e); err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		e.healthy = true
+		if p.active == nil {
+			p.active = e
+		}
+	}
+
+	if p.active == nil {
+		return nil, fmt.Errorf("no endpoint is reachable: %w", errors.Join(errs...))
+	}
+
+	for _, err := range errs {
+		log.Printf("endpoint is not reachable: %s\n", err)
+	}
+
+	return p, nil
+}
+
+// Client returns the client of the active endpoint.
+func (p *EndpointPool) Client() *ethclient.Client {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.active.client
+}
+
+func (p *EndpointPool) ActiveURL() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.active.url
+}
+
+// Switched returns a channel which is closed when another endpoint becomes active.
+func (p *EndpointPool) Switched() <-chan struct{} {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.switched
+}
+
+// RunHealthChecks checks the endpoints with the interval until the context is done.
+func (p *EndpointPool) RunHealthChecks(ctx context.Context, interval time.Duration) common.ErrorGroupGoroutine {
+	return func() error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		log.Println("start checking endpoints")
+		for {
+			p.checkEndpoints(ctx)
+
+			select {
+			case <-ctx.Done():
+				log.Println("checking endpoints stopped")
+
+				return nil
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+func (p *EndpointPool) checkEndpoints(ctx context.Context) {
+	for _, e := range p.endpoints {
+		err := p.check(ctx, e)
+		healthy := err == nil
+
+		if healthy != e.healthy {
+			if healthy {
+				log.Printf("endpoint %s is healthy again\n", e.url)
+			} else {
+				log.Printf("endpoint %s is unhealthy: %s\n", e.url, err)
+			}
+		}
+
+		p.mu.Lock()
+		e.healthy = healthy
+		p.mu.Unlock()
+	}
+
+	p.chooseActive()
+}
+
+func (p *EndpointPool) check(ctx context.Context, e *endpoint) error {
+	ctx, cancel := context.WithTimeout(ctx, p.maxLatency)
+	defer cancel()
+
+	if e.client == nil {
+		if err := p.dial(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	if !e.chainChecked {
+		if err := p.checkChain(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+
+	head, err := e.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get head: %w", err)
+	}
+
+	if latency := time.Since(start); latency > p.maxLatency {
+		return fmt.Errorf("latency %s is too high", latency)
+	}
+
+	if age := time.Since(time.Unix(int64(head.Time), 0)); age > p.maxHeadAge {
+		return fmt.Errorf("head %d is %s old", head.Number, age.Round(time.Second))
+	}
+
+	return nil
+}
+
+func (p *EndpointPool) dial(ctx context.Context, e *endpoint) error {
+	client, err := ethclient.DialContext(ctx, e.url)
+	if err != nil {
+		return fmt.Errorf("failed to dial to %s: %w", e.url, err)
+	}
+
+	p.mu.Lock()
+	e.client = client
+	p.mu.Unlock()
+
+	return p.checkChain(ctx, e)
+}
+
+// checkChain makes sure that all endpoints serve the same chain.
+func (p *EndpointPool) checkChain(ctx context.Context, e *endpoint) error {
+	chainID, err := e.client.ChainID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get chain id of %s: %w", e.url, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.chainID == nil {
+		p.chainID = chainID
+	}
+
+	if p.chainID.Cmp(chainID) != 0 {
+		return fmt.Errorf("endpoint %s serves chain %s instead of %s", e.url, chainID, p.chainID)
+	}
+
+	e.chainChecked = true
+
+	return nil
+}
+
+// chooseActive activates the first healthy endpoint.
+// The active endpoint is kept if none of them is healthy.
+func (p *EndpointPool) chooseActive() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, e := range p.endpoints {
+		if !e.healthy {
+			continue
+		}
+
+		if e != p.active {
+			log.Printf("switching endpoint from %s to %s\n", p.active.url, e.url)
+
+			p.active = e
+			close(p.switched)
+			p.switched = make(chan struct{})
+		}
+
+		return
+	}
+}
+
+// ChainID returns the id of the chain served by the endpoints.
+func (p *EndpointPool) ChainID() *big.Int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.chainID
+}
@@ -2,113 +2,295 @@ package infrastructure
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum"
-	"github.com/ethereum/go-ethereum/accounts"
 	geth "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
-	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
+	"github.com/ethereum/go-ethereum/rpc"
 
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
 	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
 )
 
+const (
+	TransferGasLimit = 21_000
+	// BaseFeeMultiplier keeps a transaction includable while the base fee grows for a few blocks.
+	BaseFeeMultiplier = 2
+)
+
+// ErrTransactionRejected is returned when the node rejects a transaction, so it will never be included.
+var ErrTransactionRejected = errors.New("transaction rejected")
+
+// rejections are the errors of the geth transaction pool, after which the transaction is never included.
+// Other errors, like timeouts, dropped connections or "already known",
+// don't tell whether the transaction has reached the pool.
+var rejections = []string{
+	"nonce too low",
+	"insufficient funds",
+	"intrinsic gas too low",
+	"exceeds block gas limit",
+	"max fee per gas less than block base fee",
+	"max priority fee per gas higher than max fee per gas",
+	"invalid sender",
+	"invalid transaction v, r, s values",
+	"transaction type not supported",
+	"oversized data",
+	"negative value",
+}
+
 type Ethereum struct {
-	client *ethclient.Client
-	wallet accounts.Wallet
+	endpoints *EndpointPool
+	// quorum is nil if blocks are not verified against other providers.
+	quorum *Quorum
+	wallet Wallet
+	// signer is nil in watch-only mode.
+	signer      Signer
+	chainID     *big.Int
+	chainSigner types.Signer
+
+	// pollInterval is the interval of polling new blocks from HTTP endpoints.
+	pollInterval time.Duration
+
+	mu           sync.Mutex
+	lastReceipts blockReceipts
 }
 
-func NewEthereum(ctx context.Context, rpcURL string, walletMnemonic string) (*Ethereum, error) {
-	client, err := ethclient.DialContext(ctx, rpcURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to dial to %s: %w", rpcURL, err)
+// NewEthereum uses the active endpoint of the pool for every call.
+// Plain HTTP endpoints do not support subscriptions,
+// so new blocks are polled from them with the given interval.
+// If the quorum is set, every streamed block is verified by it first.
+// Transfers are signed by the signer, they can't be sent if it is nil.
+func NewEthereum(
+	endpoints *EndpointPool,
+	quorum *Quorum,
+	wallet Wallet,
+	signer Signer,
+	pollInterval time.Duration,
+) *Ethereum {
+	chainID := endpoints.ChainID()
+
+	return &Ethereum{
+		endpoints:    endpoints,
+		quorum:       quorum,
+		wallet:       wallet,
+		signer:       signer,
+		chainID:      chainID,
+		chainSigner:  types.LatestSignerForChainID(chainID),
+		pollInterval: pollInterval,
 	}
+}
 
-	wallet, err := hdwallet.NewFromMnemonic(walletMnemonic)
+func (e *Ethereum) client() *ethclient.Client {
+	return e.endpoints.Client()
+}
+
+// IsHTTPEndpoint reports whether the RPC endpoint is reached over plain HTTP,
+// as opposed to websocket and IPC endpoints.
+func IsHTTPEndpoint(rpcURL string) bool {
+	endpoint, err := url.Parse(rpcURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create wallet: %w", err)
+		return false
 	}
 
-	return &Ethereum{
-		client: client,
-		wallet: wallet,
-	}, nil
+	return endpoint.Scheme == "http" || endpoint.Scheme == "https"
+}
+
+func (e *Ethereum) ChainID() *big.Int {
+	return new(big.Int).Set(e.chainID)
 }
 
 func (e *Ethereum) GetInvoiceAccount(id domain.ID) (*geth.Address, error) {
-	path := e.generateDerivativePath(id)
-	if path.String() == accounts.DefaultRootDerivationPath.String() {
-		return nil, fmt.Errorf("you can't use default root derivation path")
+	return e.wallet.GetInvoiceAccount(id)
+}
+
+func (e *Ethereum) GetReceipt(ctx context.Context, txHash geth.Hash) (*types.Receipt, error) {
+	receipt, err := e.client().TransactionReceipt(ctx, txHash)
+	if errors.Is(err, ethereum.NotFound) {
+		return nil, common.FlagError(fmt.Errorf("receipt of transaction %s not found", txHash), common.FlagNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get receipt of transaction %s: %w", txHash, err)
 	}
 
-	account, err := e.wallet.Derive(path, false)
+	return receipt, nil
+}
+
+func (e *Ethereum) GetSender(tx *types.Transaction) (geth.Address, error) {
+	sender, err := types.Sender(e.chainSigner, tx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to derive account with path %s: %w", path, err)
+		return geth.Address{}, fmt.Errorf("failed to recover sender of transaction %s: %w", tx.Hash(), err)
 	}
 
-	return &account.Address, nil
+	return sender, nil
 }
 
-func (e *Ethereum) generateDerivativePath(id domain.ID) accounts.DerivationPath {
-	path := accounts.DefaultRootDerivationPath
+// SignTransfer builds and signs an EIP-1559 transfer from the invoice address.
+// See BuildTransfer for the meaning of the arguments.
+func (e *Ethereum) SignTransfer(
+	ctx context.Context,
+	id domain.ID,
+	to geth.Address,
+	amount *big.Int,
+	subtractFee bool,
+) (*types.Transaction, error) {
+	if e.signer == nil {
+		return nil, common.FlagError(
+			fmt.Errorf("transactions can't be signed in watch-only mode"),
+			common.FlagConflict,
+		)
+	}
+
+	tx, err := e.BuildTransfer(ctx, id, to, amount, subtractFee)
+	if err != nil {
+		return nil, err
+	}
 
-	path = append(path, id)
+	signed, err := e.signer.SignInvoiceTransaction(ctx, id, tx, e.chainSigner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transfer of invoice %d: %w", id, err)
+	}
 
-	return path
+	return signed, nil
 }
 
-type TransactionHandler func(*types.Transaction) error
+// BuildTransfer builds an unsigned EIP-1559 transfer from the invoice address.
+// If subtractFee is set, the largest possible fee is subtracted from the amount,
+// otherwise it is paid in addition to the amount.
+// If amount is nil, the whole balance is transferred and the fee is subtracted from it.
+func (e *Ethereum) BuildTransfer(
+	ctx context.Context,
+	id domain.ID,
+	to geth.Address,
+	amount *big.Int,
+	subtractFee bool,
+) (*types.Transaction, error) {
+	from, err := e.wallet.GetInvoiceAccount(id)
+	if err != nil {
+		return nil, err
+	}
 
-func (e *Ethereum) SubscribeConfirmedTransactions(ctx context.Context) (<-chan *types.Transaction, error) {
-	headers := make(chan *types.Header)
+	balance, err := e.client().BalanceAt(ctx, *from, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance of %s: %w", from, err)
+	}
 
-	sub, err := e.client.SubscribeNewHead(ctx, headers)
+	nonce, err := e.client().PendingNonceAt(ctx, *from)
 	if err != nil {
-		return nil, fmt.Errorf("failed to subscribe to headers: %w", err)
+		return nil, fmt.Errorf("failed to get nonce of %s: %w", from, err)
 	}
 
-	transactions := make(chan *types.Transaction)
+	head, err := e.client().HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get head block: %w", err)
+	}
+	if head.BaseFee == nil {
+		return nil, fmt.Errorf("chain does not support EIP-1559 transactions")
+	}
+
+	tip, err := e.client().SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to suggest gas tip: %w", err)
+	}
+
+	feeCap := new(big.Int).Mul(head.BaseFee, big.NewInt(BaseFeeMultiplier))
+	feeCap.Add(feeCap, tip)
+
+	maxFee := new(big.Int).Mul(feeCap, big.NewInt(TransferGasLimit))
+
+	if amount == nil {
+		amount = balance
+		subtractFee = true
+	}
+
+	value := amount
+	if subtractFee {
+		value = new(big.Int).Sub(amount, maxFee)
+	}
 
-	go e.listenHeaders(ctx, headers, sub, transactions)
+	if value.Sign() <= 0 || new(big.Int).Add(value, maxFee).Cmp(balance) > 0 {
+		return nil, common.FlagError(
+			fmt.Errorf("balance %s of %s is not enough to transfer %s with fee up to %s", balance, from, value, maxFee),
+			common.FlagConflict,
+		)
+	}
 
-	return transactions, nil
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:   e.chainID,
+		Nonce:     nonce,
+		GasTipCap: tip,
+		GasFeeCap: feeCap,
+		Gas:       TransferGasLimit,
+		To:        &to,
+		Value:     value,
+	}), nil
 }
 
-func (e *Ethereum) listenHeaders(
-	ctx context.Context,
-	headers <-chan *types.Header,
-	headersSubscription ethereum.Subscription,
-	transactions chan<- *types.Transaction,
-) {
-	defer close(transactions)
-
-	for {
-		select {
-		case <-ctx.Done():
-			headersSubscription.Unsubscribe()
-			log.Println("unsubscribed from headers")
-
-			return
-		case err := <-headersSubscription.Err():
-			log.Printf("subscription error: %s\n", err)
-
-			return
-		case header := <-headers:
-			block, err := e.client.BlockByHash(ctx, header.Hash())
-			if err != nil {
-				log.Printf("failed to get block by hash %s: %s\n", header.Hash(), err)
-
-				continue
-			}
-
-			blockTransactions := block.Transactions()
-
-			log.Printf("new block received with %d transactions\n", len(blockTransactions))
-			for _, tx := range blockTransactions {
-				transactions <- tx
-			}
+// SendTransaction sends the signed transaction to the node.
+// ErrTransactionRejected is returned only if the node has definitely rejected it.
+func (e *Ethereum) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if err := e.client().SendTransaction(ctx, tx); err != nil {
+		if isRejection(err) {
+			return fmt.Errorf("failed to send transaction %s: %w: %w", tx.Hash(), ErrTransactionRejected, err)
 		}
+
+		return fmt.Errorf("failed to send transaction %s: %w", tx.Hash(), err)
 	}
+
+	return nil
+}
+
+// isRejection reports whether the error is a response of the node rejecting the transaction.
+func isRejection(err error) bool {
+	var rpcErr rpc.Error
+	if !errors.As(err, &rpcErr) {
+		return false
+	}
+
+	message := strings.ToLower(rpcErr.Error())
+	for _, rejection := range rejections {
+		if strings.Contains(message, rejection) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetNonce returns the number of transactions sent from the address which are included in the head block.
+func (e *Ethereum) GetNonce(ctx context.Context, address geth.Address) (uint64, error) {
+	nonce, err := e.client().NonceAt(ctx, address, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get nonce of %s: %w", address, err)
+	}
+
+	return nonce, nil
+}
+
+// GetBalance returns the balance of the address at the block in ether or in the token if it is set.
+func (e *Ethereum) GetBalance(
+	ctx context.Context,
+	address geth.Address,
+	token *domain.Token,
+	blockNumber uint64,
+) (*big.Int, error) {
+	number := new(big.Int).SetUint64(blockNumber)
+
+	if token != nil {
+		return e.getTokenBalance(ctx, token.Address(), address, number)
+	}
+
+	balance, err := e.client().BalanceAt(ctx, address, number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance of %s at block %d: %w", address, blockNumber, err)
+	}
+
+	return balance, nil
 }
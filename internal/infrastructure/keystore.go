@@ -0,0 +1,110 @@
+package infrastructure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	geth "github.com/ethereum/go-ethereum/common"
+)
+
+// MnemonicFileVersion is the version of the format of encrypted mnemonic files.
+const MnemonicFileVersion = 1
+
+// ErrWrongPassphrase is returned when the mnemonic file can't be decrypted with the passphrase.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// mnemonicFile holds the mnemonic encrypted the same way as private keys in geth keystore v3 files:
+// the key is derived from the passphrase with scrypt and the mnemonic is encrypted with AES-128-CTR.
+type mnemonicFile struct {
+	Version int `json:"version"`
+	// Address is the address of the first invoice, so the wallet can be identified without the passphrase.
+	Address geth.Address        `json:"address"`
+	Crypto  keystore.CryptoJSON `json:"crypto"`
+}
+
+// WriteMnemonicFile encrypts the mnemonic with the passphrase and writes it to the file readable only by the owner.
+// The file is replaced atomically, so an interrupted rotation does not lose the mnemonic.
+func WriteMnemonicFile(path string, mnemonic string, passphrase string) error {
+	if passphrase == "" {
+		return fmt.Errorf("passphrase must not be empty")
+	}
+
+	wallet, err := NewHDWallet(mnemonic)
+	if err != nil {
+		return err
+	}
+
+	address, err := wallet.GetInvoiceAccount(1)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := keystore.EncryptDataV3(
+		[]byte(mnemonic), []byte(passphrase), keystore.StandardScryptN, keystore.StandardScryptP,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt mnemonic: %w", err)
+	}
+
+	data, err := json.MarshalIndent(mnemonicFile{
+		Version: MnemonicFileVersion,
+		Address: *address,
+		Crypto:  encrypted,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode mnemonic file: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create mnemonic file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+
+		return fmt.Errorf("failed to write mnemonic file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write mnemonic file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace mnemonic file: %w", err)
+	}
+
+	return nil
+}
+
+// ReadMnemonicFile decrypts the mnemonic from the file written by WriteMnemonicFile.
+func ReadMnemonicFile(path string, passphrase string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read mnemonic file: %w", err)
+	}
+
+	var file mnemonicFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return "", fmt.Errorf("failed to parse mnemonic file: %w", err)
+	}
+
+	if file.Version != MnemonicFileVersion {
+		return "", fmt.Errorf("unsupported mnemonic file version %d", file.Version)
+	}
+
+	mnemonic, err := keystore.DecryptDataV3(file.Crypto, passphrase)
+	if errors.Is(err, keystore.ErrDecrypt) {
+		return "", fmt.Errorf("failed to decrypt mnemonic file %s: %w", path, ErrWrongPassphrase)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt mnemonic file %s: %w", path, err)
+	}
+
+	return string(mnemonic), nil
+}
@@ -0,0 +1,49 @@
+package infrastructure_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestMnemonicFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "mnemonic.json")
+
+	err := infrastructure.WriteMnemonicFile(path, testMnemonic, "first")
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), testMnemonic)
+
+	mnemonic, err := infrastructure.ReadMnemonicFile(path, "first")
+	require.NoError(t, err)
+	assert.Equal(t, testMnemonic, mnemonic)
+
+	_, err = infrastructure.ReadMnemonicFile(path, "second")
+	assert.ErrorIs(t, err, infrastructure.ErrWrongPassphrase)
+
+	err = infrastructure.WriteMnemonicFile(path, testMnemonic, "second")
+	require.NoError(t, err)
+
+	mnemonic, err = infrastructure.ReadMnemonicFile(path, "second")
+	require.NoError(t, err)
+	assert.Equal(t, testMnemonic, mnemonic)
+
+	_, err = infrastructure.ReadMnemonicFile(path, "first")
+	assert.ErrorIs(t, err, infrastructure.ErrWrongPassphrase)
+
+	err = infrastructure.WriteMnemonicFile(path, "not a mnemonic", "third")
+	assert.Error(t, err)
+}
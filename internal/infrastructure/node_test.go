@@ -0,0 +1,368 @@
+package infrastructure_test
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	fakeChainID  = 1337
+	fakeGasLimit = 30_000_000
+)
+
+// fakeChain is a chain of blocks which can be extended and reorganized by tests.
+// Blocks are timestamped with the time they are added, so the head is always fresh.
+type fakeChain struct {
+	mu       sync.Mutex
+	blocks   []*types.Block
+	byHash   map[geth.Hash]*types.Block
+	receipts map[geth.Hash][]*types.Receipt
+	traces   map[geth.Hash][]fakeTrace
+}
+
+// fakeTrace is a transaction trace returned by the callTracer.
+type fakeTrace struct {
+	TxHash geth.Hash `json:"txHash"`
+	Result fakeCall  `json:"result"`
+}
+
+type fakeCall struct {
+	Type  string       `json:"type"`
+	From  geth.Address `json:"from"`
+	To    geth.Address `json:"to"`
+	Value *hexutil.Big `json:"value,omitempty"`
+	Error string       `json:"error,omitempty"`
+	Calls []fakeCall   `json:"calls,omitempty"`
+}
+
+// fakeNode is a stand-in for an Ethereum node serving JSON-RPC over HTTP.
+type fakeNode struct {
+	*fakeChain
+
+	URL  string
+	down atomic.Bool
+}
+
+func newFakeNode(t *testing.T) *fakeNode {
+	t.Helper()
+
+	chain := &fakeChain{
+		byHash:   make(map[geth.Hash]*types.Block),
+		receipts: make(map[geth.Hash][]*types.Receipt),
+		traces:   make(map[geth.Hash][]fakeTrace),
+	}
+	chain.extend(1, 0)
+
+	return serveFakeChain(t, chain)
+}
+
+// mirror starts another node serving the same chain.
+func (n *fakeNode) mirror(t *testing.T) *fakeNode {
+	t.Helper()
+
+	return serveFakeChain(t, n.fakeChain)
+}
+
+// setDown makes the node respond with 503 Service Unavailable to every request.
+func (n *fakeNode) setDown(down bool) {
+	n.down.Store(down)
+}
+
+func serveFakeChain(t *testing.T, chain *fakeChain) *fakeNode {
+	t.Helper()
+
+	node := &fakeNode{fakeChain: chain}
+
+	server := rpc.NewServer()
+	require.NoError(t, server.RegisterName("eth", &fakeEthAPI{chain: chain}))
+	require.NoError(t, server.RegisterName("debug", &fakeDebugAPI{chain: chain}))
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if node.down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		server.ServeHTTP(w, r)
+	}))
+	t.Cleanup(httpServer.Close)
+	t.Cleanup(server.Stop)
+
+	node.URL = httpServer.URL
+
+	return node
+}
+
+// extend appends empty blocks to the canonical chain.
+// Blocks with the same number on different forks have different hashes.
+func (c *fakeChain) extend(count int, fork byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		c.append(nil, nil, fork)
+	}
+}
+
+// mine appends a block with the transactions and their receipts to the canonical chain.
+func (c *fakeChain) mine(txs []*types.Transaction, receipts []*types.Receipt) *types.Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.append(txs, receipts, 0)
+}
+
+func (c *fakeChain) append(txs []*types.Transaction, receipts []*types.Receipt, fork byte) *types.Block {
+	number := uint64(len(c.blocks))
+	header := &types.Header{
+		Difficulty: new(big.Int),
+		Number:     new(big.Int).SetUint64(number),
+		GasLimit:   fakeGasLimit,
+		Time:       uint64(time.Now().Unix()),
+		Extra:      []byte{fork},
+		BaseFee:    big.NewInt(1),
+	}
+	if number > 0 {
+		header.ParentHash = c.blocks[number-1].Hash()
+	}
+
+	for _, receipt := range receipts {
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+	}
+
+	block := types.NewBlock(header, txs, nil, receipts, trie.NewStackTrie(nil))
+
+	for i, receipt := range receipts {
+		receipt.BlockHash = block.Hash()
+		receipt.BlockNumber = block.Number()
+		receipt.TransactionIndex = uint(i)
+	}
+
+	c.blocks = append(c.blocks, block)
+	c.byHash[block.Hash()] = block
+	c.receipts[block.Hash()] = append([]*types.Receipt{}, receipts...)
+
+	return block
+}
+
+// trace sets the traces of the block transactions returned by debug_traceBlockByHash.
+func (c *fakeChain) trace(number uint64, traces ...fakeTrace) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.traces[c.blocks[number].Hash()] = traces
+}
+
+// tamperReceipts changes the receipts of the block returned by the nodes.
+func (c *fakeChain) tamperReceipts(number uint64, tamper func(receipts []*types.Receipt)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tamper(c.receipts[c.blocks[number].Hash()])
+}
+
+// rewind drops the canonical blocks after the number, so the chain can be extended on another fork.
+func (c *fakeChain) rewind(number uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.blocks = c.blocks[:number+1]
+}
+
+func (c *fakeChain) block(number uint64) *types.Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.blocks[number]
+}
+
+// fakeEthAPI implements the eth namespace of the fakeNode.
+type fakeEthAPI struct {
+	chain *fakeChain
+}
+
+func (api *fakeEthAPI) ChainId() *hexutil.Big { //nolint:revive,stylecheck // must match eth_chainId
+	return (*hexutil.Big)(big.NewInt(fakeChainID))
+}
+
+func (api *fakeEthAPI) BlockNumber() hexutil.Uint64 {
+	api.chain.mu.Lock()
+	defer api.chain.mu.Unlock()
+
+	return hexutil.Uint64(len(api.chain.blocks) - 1)
+}
+
+func (api *fakeEthAPI) GetBlockByNumber(number rpc.BlockNumber, fullTx bool) (map[string]any, error) {
+	api.chain.mu.Lock()
+	defer api.chain.mu.Unlock()
+
+	if number < 0 {
+		number = rpc.BlockNumber(len(api.chain.blocks) - 1)
+	}
+	if int(number) >= len(api.chain.blocks) {
+		return nil, nil
+	}
+
+	return marshalBlock(api.chain.blocks[number], fullTx)
+}
+
+func (api *fakeEthAPI) GetBlockByHash(hash geth.Hash, fullTx bool) (map[string]any, error) {
+	api.chain.mu.Lock()
+	defer api.chain.mu.Unlock()
+
+	block, ok := api.chain.byHash[hash]
+	if !ok {
+		return nil, nil
+	}
+
+	return marshalBlock(block, fullTx)
+}
+
+func (api *fakeEthAPI) GetBlockReceipts(blockNrOrHash rpc.BlockNumberOrHash) ([]*types.Receipt, error) {
+	api.chain.mu.Lock()
+	defer api.chain.mu.Unlock()
+
+	hash, ok := blockNrOrHash.Hash()
+	if !ok {
+		return nil, errors.New("only block hashes are supported")
+	}
+
+	return api.chain.receipts[hash], nil
+}
+
+// fakeFilter is the filter of eth_getLogs, only block ranges are supported.
+type fakeFilter struct {
+	FromBlock hexutil.Uint64 `json:"fromBlock"`
+	ToBlock   hexutil.Uint64 `json:"toBlock"`
+	Topics    [][]geth.Hash  `json:"topics"`
+}
+
+func (api *fakeEthAPI) GetLogs(filter fakeFilter) ([]*types.Log, error) {
+	api.chain.mu.Lock()
+	defer api.chain.mu.Unlock()
+
+	logs := make([]*types.Log, 0)
+
+	for number := uint64(filter.FromBlock); number <= uint64(filter.ToBlock) && number < uint64(len(api.chain.blocks)); number++ {
+		for _, receipt := range api.chain.receipts[api.chain.blocks[number].Hash()] {
+			for _, log := range receipt.Logs {
+				if !matchTopics(log.Topics, filter.Topics) {
+					continue
+				}
+
+				matched := *log
+				matched.BlockNumber = number
+				matched.BlockHash = receipt.BlockHash
+				logs = append(logs, &matched)
+			}
+		}
+	}
+
+	return logs, nil
+}
+
+func matchTopics(topics []geth.Hash, filter [][]geth.Hash) bool {
+	if len(filter) > len(topics) {
+		return false
+	}
+
+	for i, alternatives := range filter {
+		if len(alternatives) == 0 {
+			continue
+		}
+
+		matched := false
+		for _, topic := range alternatives {
+			matched = matched || topic == topics[i]
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fakeDebugAPI implements the debug namespace of the fakeNode.
+type fakeDebugAPI struct {
+	chain *fakeChain
+}
+
+func (api *fakeDebugAPI) TraceBlockByHash(hash geth.Hash, _ map[string]any) ([]fakeTrace, error) {
+	api.chain.mu.Lock()
+	defer api.chain.mu.Unlock()
+
+	if _, ok := api.chain.byHash[hash]; !ok {
+		return nil, fmt.Errorf("block %s not found", hash)
+	}
+
+	return api.chain.traces[hash], nil
+}
+
+func marshalBlock(block *types.Block, fullTx bool) (map[string]any, error) {
+	header, err := json.Marshal(block.Header())
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(header, &fields); err != nil {
+		return nil, err
+	}
+
+	transactions := make([]any, 0, len(block.Transactions()))
+	for _, tx := range block.Transactions() {
+		if fullTx {
+			transactions = append(transactions, tx)
+		} else {
+			transactions = append(transactions, tx.Hash())
+		}
+	}
+
+	fields["hash"] = block.Hash()
+	fields["transactions"] = transactions
+	fields["uncles"] = []any{}
+
+	return fields, nil
+}
+
+// signTransfers signs transactions sending one wei to the address with consecutive nonces.
+func signTransfers(t *testing.T, key *ecdsa.PrivateKey, to geth.Address, count int) []*types.Transaction {
+	t.Helper()
+
+	signer := types.LatestSignerForChainID(big.NewInt(fakeChainID))
+	txs := make([]*types.Transaction, count)
+
+	for nonce := range txs {
+		tx, err := types.SignNewTx(key, signer, &types.LegacyTx{
+			Nonce:    uint64(nonce),
+			GasPrice: big.NewInt(1),
+			Gas:      100_000,
+			To:       &to,
+			Value:    big.NewInt(1),
+		})
+		require.NoError(t, err)
+
+		txs[nonce] = tx
+	}
+
+	return txs
+}
@@ -0,0 +1,531 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/jackc/pgx/v5"
+	_ "github.com/jackc/pgx/v5/stdlib" // registers the "pgx" database/sql driver
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+const (
+	PostgresDriverName = "pgx"
+
+	// InvoicesChannel is the prefix of the notification channel, which is followed by the schema name.
+	InvoicesChannel           = "invoices"
+	ListenerReconnectInterval = 5 * time.Second
+
+	// LeaderLockKey is the key of the advisory lock held by the instance running the background jobs.
+	// It is arbitrary and only has to differ from other advisory locks taken in the database.
+	LeaderLockKey = 7_405_162
+	// LeaderCheckInterval is the interval of trying to take the leader lock
+	// and of checking that the connection holding it is alive.
+	LeaderCheckInterval = 5 * time.Second
+)
+
+var postgresDialect = sqlDialect{
+	numberedPlaceholders: true,
+	migrations: []string{
+		`CREATE SEQUENCE invoice_id_seq AS BIGINT MINVALUE 1 MAXVALUE 4294967295`,
+		`CREATE TABLE invoices (
+			id      BIGINT PRIMARY KEY,
+			price   TEXT   NOT NULL,
+			balance TEXT   NOT NULL,
+			address TEXT   NOT NULL UNIQUE,
+			status  TEXT   NOT NULL
+		)`,
+		`CREATE TABLE block_checkpoint (
+			id     INTEGER PRIMARY KEY CHECK (id = 1),
+			number BIGINT  NOT NULL,
+			hash   TEXT    NOT NULL
+		)`,
+		`ALTER TABLE invoices ADD COLUMN required_confirmations INTEGER NOT NULL DEFAULT 1`,
+		`CREATE TABLE deposits (
+			invoice_id    BIGINT  NOT NULL REFERENCES invoices (id),
+			tx_hash       TEXT    NOT NULL,
+			block_number  BIGINT  NOT NULL,
+			block_hash    TEXT    NOT NULL,
+			value         TEXT    NOT NULL,
+			confirmations BIGINT  NOT NULL,
+			status        TEXT    NOT NULL,
+			PRIMARY KEY (invoice_id, tx_hash)
+		)`,
+		`CREATE INDEX deposits_status_idx ON deposits (status)`,
+		`CREATE INDEX deposits_block_hash_idx ON deposits (block_hash)`,
+		`ALTER TABLE deposits ADD COLUMN gas_used BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE deposits ADD COLUMN effective_gas_price TEXT NOT NULL DEFAULT '0'`,
+		`ALTER TABLE deposits RENAME TO payments`,
+		`ALTER INDEX deposits_status_idx RENAME TO payments_status_idx`,
+		`ALTER INDEX deposits_block_hash_idx RENAME TO payments_block_hash_idx`,
+		`ALTER TABLE payments ADD COLUMN sender TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE payments ADD COLUMN block_time BIGINT NOT NULL DEFAULT 0`,
+		`CREATE UNIQUE INDEX payments_tx_hash_idx ON payments (tx_hash)`,
+		`ALTER TABLE invoices ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE invoices ADD COLUMN expires_at BIGINT`,
+		`CREATE INDEX invoices_expires_at_idx ON invoices (status, expires_at)`,
+		`ALTER TABLE payments ADD COLUMN late BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE invoices ADD COLUMN tolerance TEXT NOT NULL DEFAULT '0'`,
+		`CREATE TABLE webhook_deliveries (
+			id              BIGINT  GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			event_id        TEXT    NOT NULL,
+			event_type      TEXT    NOT NULL,
+			url             TEXT    NOT NULL,
+			payload         TEXT    NOT NULL,
+			status          TEXT    NOT NULL,
+			attempts        BIGINT  NOT NULL,
+			next_attempt_at BIGINT  NOT NULL,
+			created_at      BIGINT  NOT NULL
+		)`,
+		`CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (status, next_attempt_at)`,
+		`CREATE TABLE webhook_attempts (
+			delivery_id BIGINT  NOT NULL REFERENCES webhook_deliveries (id),
+			attempt     BIGINT  NOT NULL,
+			status_code BIGINT  NOT NULL,
+			error       TEXT    NOT NULL,
+			created_at  BIGINT  NOT NULL,
+			PRIMARY KEY (delivery_id, attempt)
+		)`,
+		`CREATE TABLE transfers (
+			invoice_id          BIGINT  NOT NULL REFERENCES invoices (id),
+			kind                TEXT    NOT NULL,
+			tx_hash             TEXT    NOT NULL UNIQUE,
+			to_address          TEXT    NOT NULL,
+			value               TEXT    NOT NULL,
+			nonce               BIGINT  NOT NULL,
+			max_fee             TEXT    NOT NULL,
+			created_at          BIGINT  NOT NULL,
+			status              TEXT    NOT NULL,
+			block_number        BIGINT  NOT NULL,
+			gas_used            BIGINT  NOT NULL,
+			effective_gas_price TEXT    NOT NULL
+		)`,
+		`CREATE INDEX transfers_invoice_id_idx ON transfers (invoice_id)`,
+		`CREATE INDEX transfers_status_idx ON transfers (status)`,
+		`ALTER TABLE invoices ADD COLUMN token_address TEXT`,
+		`ALTER TABLE invoices ADD COLUMN token_symbol TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE invoices ADD COLUMN token_decimals SMALLINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE payments ADD COLUMN kind TEXT NOT NULL DEFAULT 'transaction'`,
+		`ALTER TABLE payments ADD COLUMN payment_index BIGINT NOT NULL DEFAULT 0`,
+		// The primary key keeps the name of the table before it was renamed.
+		`ALTER TABLE payments DROP CONSTRAINT deposits_pkey`,
+		`ALTER TABLE payments ADD PRIMARY KEY (invoice_id, tx_hash, kind, payment_index)`,
+		`DROP INDEX payments_tx_hash_idx`,
+		`CREATE UNIQUE INDEX payments_source_idx ON payments (tx_hash, kind, payment_index)`,
+		`ALTER TABLE invoices ADD COLUMN fiat_currency TEXT`,
+		`ALTER TABLE invoices ADD COLUMN fiat_amount TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE invoices ADD COLUMN exchange_rate TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE invoices ADD COLUMN exchange_rate_at BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE invoices ADD COLUMN exchange_rate_source TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE payments ADD COLUMN verified BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE TABLE discrepancies (
+			id           BIGINT  GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			invoice_id   BIGINT  NOT NULL REFERENCES invoices (id),
+			address      TEXT    NOT NULL,
+			expected     TEXT    NOT NULL,
+			actual       TEXT    NOT NULL,
+			block_number BIGINT  NOT NULL,
+			status       TEXT    NOT NULL,
+			resolution   TEXT    NOT NULL,
+			created_at   BIGINT  NOT NULL,
+			resolved_at  BIGINT
+		)`,
+		`CREATE INDEX discrepancies_status_idx ON discrepancies (status)`,
+		`ALTER TABLE invoices ADD COLUMN version BIGINT NOT NULL DEFAULT 1`,
+		`CREATE TABLE recent_blocks (
+			number BIGINT PRIMARY KEY,
+			hash   TEXT   NOT NULL
+		)`,
+	},
+}
+
+// PostgresRepository is an invoice repository shared by several instances of the service.
+// Invoices are always read from the database, so a deposit recorded by one instance
+// is visible to the others immediately.
+// Every instance keeps an index of invoice addresses in memory,
+// so the transaction watcher does not query the database for each transaction.
+// The index is kept up to date with LISTEN/NOTIFY on a channel of the schema,
+// so deployments sharing a database in different schemas do not index each other's invoices.
+type PostgresRepository struct {
+	*sqlRepository
+
+	dsn     string
+	channel string
+
+	addresses *sync.Map
+	// indexReady is false while the listener is disconnected
+	// and the index may miss invoices created by other instances.
+	indexReady *atomic.Bool
+
+	stopListening context.CancelFunc
+	listenerDone  chan struct{}
+}
+
+type invoiceNotification struct {
+	ID      domain.ID `json:"id"`
+	Address string    `json:"address"`
+}
+
+func NewPostgresRepository(ctx context.Context, dsn string) (*PostgresRepository, error) {
+	db, err := sql.Open(PostgresDriverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres database: %w", err)
+	}
+
+	repository, err := newSQLRepository(ctx, db, postgresDialect)
+	if err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+
+	channel, err := invoicesChannel(ctx, db)
+	if err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+
+	r := &PostgresRepository{
+		sqlRepository: repository,
+		dsn:           dsn,
+		channel:       channel,
+		addresses:     new(sync.Map),
+		indexReady:    new(atomic.Bool),
+		listenerDone:  make(chan struct{}),
+	}
+
+	conn, err := r.listen(ctx)
+	if err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+
+	listenerCtx, stopListening := context.WithCancel(context.Background())
+	r.stopListening = stopListening
+
+	go r.handleNotifications(listenerCtx, conn)
+
+	return r, nil
+}
+
+func (r *PostgresRepository) Close() error {
+	r.stopListening()
+	<-r.listenerDone
+
+	return r.sqlRepository.Close()
+}
+
+func (r *PostgresRepository) GetID(ctx context.Context) (domain.ID, error) {
+	var id domain.ID
+
+	if err := r.db.QueryRowContext(ctx, `SELECT nextval('invoice_id_seq')`).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to allocate invoice id: %w", err)
+	}
+
+	return id, nil
+}
+
+func (r *PostgresRepository) Save(ctx context.Context, invoice *domain.Invoice) error {
+	payload, err := json.Marshal(invoiceNotification{
+		ID:      invoice.ID(),
+		Address: invoice.Address().Hex(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal invoice notification: %w", err)
+	}
+
+	var version uint64
+
+	err = r.inTx(ctx, func(tx *sql.Tx) error {
+		version, err = r.save(ctx, tx, invoice)
+		if err != nil {
+			return err
+		}
+
+		// Notifications are delivered only when the transaction commits.
+		if _, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, r.channel, string(payload)); err != nil {
+			return fmt.Errorf("failed to notify about invoice with id %d: %w", invoice.ID(), err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	invoice.SetVersion(version)
+	r.addresses.Store(invoice.Address().Hex(), invoice.ID())
+
+	return nil
+}
+
+func (r *PostgresRepository) GetByAddress(ctx context.Context, address *geth.Address) (*domain.Invoice, error) {
+	if !r.indexReady.Load() {
+		return r.sqlRepository.GetByAddress(ctx, address)
+	}
+
+	id, ok := r.addresses.Load(address.Hex())
+	if !ok {
+		return nil, common.FlagError(
+			fmt.Errorf("invoice with address %q not found", address.Hex()),
+			common.FlagNotFound,
+		)
+	}
+
+	typedID, ok := id.(domain.ID)
+	if !ok {
+		return nil, fmt.Errorf("invoice id for address %q has invalid type", address.Hex())
+	}
+
+	return r.GetByID(ctx, typedID)
+}
+
+// invoicesChannel returns the notification channel of the schema the tables are created in.
+func invoicesChannel(ctx context.Context, db *sql.DB) (string, error) {
+	var schema string
+
+	if err := db.QueryRowContext(ctx, `SELECT current_schema()`).Scan(&schema); err != nil {
+		return "", fmt.Errorf("failed to get current schema: %w", err)
+	}
+
+	return InvoicesChannel + "_" + schema, nil
+}
+
+// listen subscribes to the invoices channel and then loads the address index,
+// so no invoice created in between is missed.
+func (r *PostgresRepository) listen(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, r.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{r.channel}.Sanitize()); err != nil {
+		return nil, errors.Join(
+			fmt.Errorf("failed to listen to %s channel: %w", r.channel, err),
+			conn.Close(ctx),
+		)
+	}
+
+	if err := r.loadAddresses(ctx); err != nil {
+		return nil, errors.Join(err, conn.Close(ctx))
+	}
+
+	r.indexReady.Store(true)
+
+	return conn, nil
+}
+
+func (r *PostgresRepository) loadAddresses(ctx context.Context) error {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, address FROM invoices`)
+	if err != nil {
+		return fmt.Errorf("failed to load invoice addresses: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id      domain.ID
+			address string
+		)
+
+		if err := rows.Scan(&id, &address); err != nil {
+			return fmt.Errorf("failed to scan invoice address: %w", err)
+		}
+
+		r.addresses.Store(address, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load invoice addresses: %w", err)
+	}
+
+	return nil
+}
+
+func (r *PostgresRepository) handleNotifications(ctx context.Context, conn *pgx.Conn) {
+	defer close(r.listenerDone)
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err == nil {
+			r.handleNotification(notification.Payload)
+
+			continue
+		}
+
+		r.indexReady.Store(false)
+		closeErr := conn.Close(context.Background())
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("invoices listener error: %s\n", errors.Join(err, closeErr))
+
+		conn = r.reconnect(ctx)
+		if conn == nil {
+			return
+		}
+	}
+}
+
+func (r *PostgresRepository) handleNotification(payload string) {
+	var notification invoiceNotification
+
+	if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+		log.Printf("invalid invoice notification %q: %s\n", payload, err)
+
+		return
+	}
+
+	r.addresses.Store(notification.Address, notification.ID)
+}
+
+func (r *PostgresRepository) reconnect(ctx context.Context) *pgx.Conn {
+	ticker := time.NewTicker(ListenerReconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			conn, err := r.listen(ctx)
+			if err != nil {
+				log.Printf("failed to reconnect invoices listener: %s\n", err)
+
+				continue
+			}
+
+			log.Println("invoices listener reconnected")
+
+			return conn
+		}
+	}
+}
+
+// RunAsLeader runs the jobs while the instance holds the leader lock, a session-level advisory lock,
+// so the background jobs of instances sharing the database never run at the same time.
+// Other instances wait for the lock and take over when the leader stops or loses its connection.
+// The jobs must return when their context is done.
+func (r *PostgresRepository) RunAsLeader(
+	ctx context.Context,
+	jobs func(ctx context.Context) error,
+) common.ErrorGroupGoroutine {
+	return func() error {
+		for {
+			conn := r.acquireLeaderLock(ctx)
+			if conn == nil {
+				return nil
+			}
+
+			log.Println("leader lock acquired, starting background jobs")
+
+			err := r.lead(ctx, conn, jobs)
+
+			// The session is closed instead of being returned to the pool, which releases the lock.
+			discardConn(conn)
+
+			if err != nil || ctx.Err() != nil {
+				return err
+			}
+
+			log.Println("leader lock lost, background jobs stopped")
+		}
+	}
+}
+
+// acquireLeaderLock waits until the leader lock is taken and returns the connection holding it.
+// It returns nil if the context is done first.
+func (r *PostgresRepository) acquireLeaderLock(ctx context.Context) *sql.Conn {
+	ticker := time.NewTicker(LeaderCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		conn, err := r.tryLeaderLock(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("failed to take leader lock: %s\n", err)
+		}
+		if conn != nil {
+			return conn
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryLeaderLock returns the connection holding the leader lock or nil if another instance holds it.
+func (r *PostgresRepository) tryLeaderLock(ctx context.Context) (*sql.Conn, error) {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection: %w", err)
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, LeaderLockKey).Scan(&locked); err != nil {
+		discardConn(conn)
+
+		return nil, fmt.Errorf("failed to try advisory lock: %w", err)
+	}
+
+	if !locked {
+		return nil, conn.Close()
+	}
+
+	return conn, nil
+}
+
+// lead runs the jobs until they return or the connection holding the leader lock fails.
+// The jobs are stopped and awaited before it returns, so they never outlive the lock.
+func (r *PostgresRepository) lead(
+	ctx context.Context,
+	conn *sql.Conn,
+	jobs func(ctx context.Context) error,
+) error {
+	jobsCtx, stopJobs := context.WithCancel(ctx)
+	defer stopJobs()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- jobs(jobsCtx)
+	}()
+
+	ticker := time.NewTicker(LeaderCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+		}
+
+		if err := conn.PingContext(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("connection holding leader lock failed: %s\n", err)
+
+			stopJobs()
+			<-done
+
+			return nil
+		}
+	}
+}
+
+// discardConn closes the connection instead of returning it to the pool,
+// which ends the session and releases its advisory locks.
+func discardConn(conn *sql.Conn) {
+	_ = conn.Raw(func(any) error {
+		return driver.ErrBadConn
+	})
+}
@@ -0,0 +1,133 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ethereum/go-ethereum"
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+)
+
+// methodNotFoundCode is the JSON-RPC error code of unsupported methods.
+const methodNotFoundCode = -32601
+
+// blockReceipts are the receipts of the block which match its receipt root.
+type blockReceipts struct {
+	blockHash geth.Hash
+	receipts  []*types.Receipt
+}
+
+// GetVerifiedReceipt returns the receipt of the transaction included in the block.
+// The transaction and receipt tries of the block are rebuilt and compared with the roots in its header,
+// so neither the transaction nor the receipt can be forged by the endpoint.
+// If the endpoint does not support eth_getBlockReceipts, the receipt is requested as usual
+// and reported as unverified.
+func (e *Ethereum) GetVerifiedReceipt(
+	ctx context.Context,
+	block *types.Block,
+	txHash geth.Hash,
+) (receipt *types.Receipt, verified bool, err error) {
+	index := -1
+	for i, tx := range block.Transactions() {
+		if tx.Hash() == txHash {
+			index = i
+
+			break
+		}
+	}
+	if index < 0 {
+		return nil, false, fmt.Errorf("transaction %s not found in block %s", txHash, block.Hash())
+	}
+
+	receipts, err := e.getBlockReceipts(ctx, block)
+	if isMethodNotFound(err) {
+		log.Printf("endpoint does not support block receipts, receipt of transaction %s is not verified\n", txHash)
+
+		receipt, err := e.GetReceipt(ctx, txHash)
+
+		return receipt, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	receipt = receipts[index]
+
+	// Only the cumulative gas is committed to by the receipt root.
+	receipt.GasUsed = receipt.CumulativeGasUsed
+	if index > 0 {
+		receipt.GasUsed -= receipts[index-1].CumulativeGasUsed
+	}
+
+	return receipt, true, nil
+}
+
+// getBlockReceipts returns the receipts of the block after checking them against the header.
+// The receipts of the last block are cached, since a block may contain several payments.
+func (e *Ethereum) getBlockReceipts(ctx context.Context, block *types.Block) ([]*types.Receipt, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.lastReceipts.blockHash == block.Hash() {
+		return e.lastReceipts.receipts, nil
+	}
+
+	if root := types.DeriveSha(block.Transactions(), trie.NewStackTrie(nil)); root != block.TxHash() {
+		return nil, fmt.Errorf("transaction root of block %s is %s instead of %s", block.Hash(), root, block.TxHash())
+	}
+
+	receipts, err := e.client().BlockReceipts(ctx, rpc.BlockNumberOrHashWithHash(block.Hash(), false))
+	if errors.Is(err, ethereum.NotFound) {
+		return nil, common.FlagError(fmt.Errorf("receipts of block %s not found", block.Hash()), common.FlagNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get receipts of block %s: %w", block.Hash(), err)
+	}
+
+	if len(receipts) != len(block.Transactions()) {
+		return nil, fmt.Errorf(
+			"got %d receipts of block %s with %d transactions", len(receipts), block.Hash(), len(block.Transactions()),
+		)
+	}
+
+	if root := types.DeriveSha(types.Receipts(receipts), trie.NewStackTrie(nil)); root != block.ReceiptHash() {
+		return nil, fmt.Errorf("receipt root of block %s is %s instead of %s", block.Hash(), root, block.ReceiptHash())
+	}
+
+	e.lastReceipts = blockReceipts{
+		blockHash: block.Hash(),
+		receipts:  receipts,
+	}
+
+	return receipts, nil
+}
+
+// IncludedIn reports whether the transfer was emitted by the transaction with the receipt.
+func (t TokenTransfer) IncludedIn(receipt *types.Receipt) bool {
+	for _, log := range receipt.Logs {
+		transfer, ok := parseTokenTransfer(*log)
+		if !ok {
+			continue
+		}
+
+		if transfer.LogIndex == t.LogIndex && transfer.Token == t.Token && transfer.From == t.From &&
+			transfer.To == t.To && transfer.Value.Cmp(t.Value) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isMethodNotFound(err error) bool {
+	var rpcErr rpc.Error
+
+	return errors.As(err, &rpcErr) && rpcErr.ErrorCode() == methodNotFoundCode
+}
@@ -0,0 +1,96 @@
+package infrastructure_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestEthereum_GetVerifiedReceipt(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	node := newFakeNode(t)
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	to := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	token := geth.HexToAddress("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+
+	txs := signTransfers(t, key, to, 2)
+
+	transfer := infrastructure.TokenTransfer{
+		TxHash:   txs[1].Hash(),
+		LogIndex: 0,
+		Token:    token,
+		From:     from,
+		To:       to,
+		Value:    big.NewInt(5),
+	}
+	receipts := []*types.Receipt{
+		{
+			Status:            types.ReceiptStatusSuccessful,
+			CumulativeGasUsed: 21_000,
+			Logs:              []*types.Log{},
+			TxHash:            txs[0].Hash(),
+			GasUsed:           21_000,
+		},
+		{
+			Status:            types.ReceiptStatusSuccessful,
+			CumulativeGasUsed: 71_000,
+			Logs: []*types.Log{{
+				Address: token,
+				Topics: []geth.Hash{
+					infrastructure.TransferEventTopic,
+					geth.BytesToHash(from.Bytes()),
+					geth.BytesToHash(to.Bytes()),
+				},
+				Data:   geth.LeftPadBytes(transfer.Value.Bytes(), 32),
+				TxHash: txs[1].Hash(),
+			}},
+			TxHash: txs[1].Hash(),
+			// The reported gas is ignored in favor of the committed cumulative gas.
+			GasUsed: 1,
+		},
+	}
+	block := node.mine(txs, receipts)
+
+	sut := newTestEthereum(ctx, t, node)
+
+	receipt, verified, err := sut.GetVerifiedReceipt(ctx, block, txs[1].Hash())
+	require.NoError(t, err)
+	assert.True(t, verified)
+	assert.Equal(t, uint64(50_000), receipt.GasUsed)
+	assert.True(t, transfer.IncludedIn(receipt))
+
+	forged := transfer
+	forged.Value = big.NewInt(500)
+	assert.False(t, forged.IncludedIn(receipt))
+
+	node.tamperReceipts(block.NumberU64(), func(receipts []*types.Receipt) {
+		receipts[0].Status = types.ReceiptStatusFailed
+	})
+
+	_, _, err = newTestEthereum(ctx, t, node).GetVerifiedReceipt(ctx, block, txs[0].Hash())
+	assert.ErrorContains(t, err, "receipt root")
+}
+
+func newTestEthereum(ctx context.Context, t *testing.T, node *fakeNode) *infrastructure.Ethereum {
+	t.Helper()
+
+	endpoints, err := infrastructure.DialEndpoints(ctx, []string{node.URL}, testMaxHeadAge, testMaxLatency)
+	require.NoError(t, err)
+
+	return infrastructure.NewEthereum(endpoints, nil, nil, nil, testPollInterval)
+}
@@ -0,0 +1,150 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// QuorumTimeout limits the time a provider has to return a header.
+const QuorumTimeout = 10 * time.Second
+
+var (
+	// quorumDisagreements counts headers returned by quorum providers which differ from the verified block.
+	quorumDisagreements = expvar.NewInt("quorum_disagreements")
+	// quorumPausedBlock is the number of the block waiting for the quorum, or zero.
+	quorumPausedBlock = expvar.NewInt("quorum_paused_block")
+)
+
+// ErrQuorumNotReached is returned when too few providers confirm a block.
+var ErrQuorumNotReached = errors.New("quorum not reached")
+
+type quorumProvider struct {
+	url    string
+	client *ethclient.Client
+}
+
+// Quorum verifies blocks against independent providers, so a single compromised or buggy provider
+// cannot make the service process a block which is not on the canonical chain.
+// A block is verified when at least size providers return a header with the same hash and transaction root.
+type Quorum struct {
+	providers []quorumProvider
+	size      int
+}
+
+// DialQuorum dials the providers. All of them must be reachable and serve the chain.
+func DialQuorum(ctx context.Context, urls []string, size int, chainID *big.Int) (*Quorum, error) {
+	if size < 1 || size > len(urls) {
+		return nil, fmt.Errorf("quorum size must be between 1 and %d providers, got %d", len(urls), size)
+	}
+
+	providers := make([]quorumProvider, 0, len(urls))
+
+	for _, url := range urls {
+		client, err := ethclient.DialContext(ctx, url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial to quorum provider %s: %w", url, err)
+		}
+
+		providerChainID, err := client.ChainID(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get chain id of quorum provider %s: %w", url, err)
+		}
+		if providerChainID.Cmp(chainID) != 0 {
+			return nil, fmt.Errorf("quorum provider %s serves chain %s instead of %s", url, providerChainID, chainID)
+		}
+
+		providers = append(providers, quorumProvider{url: url, client: client})
+	}
+
+	return &Quorum{
+		providers: providers,
+		size:      size,
+	}, nil
+}
+
+// Verify checks that the transactions of the block match its transaction root
+// and that enough providers agree on the hash and the transaction root of the block.
+// Providers which do not have the block yet are not counted, the block can be verified again later.
+func (q *Quorum) Verify(ctx context.Context, block *types.Block) error {
+	if txRoot := types.DeriveSha(block.Transactions(), trie.NewStackTrie(nil)); txRoot != block.TxHash() {
+		return fmt.Errorf("transactions of block %d do not match its transaction root", block.NumberU64())
+	}
+
+	headers := q.getHeaders(ctx, block)
+
+	confirmations := 0
+
+	for i, header := range headers {
+		switch {
+		case header == nil:
+			continue
+		case header.Hash() == block.Hash() && header.TxHash == block.TxHash():
+			confirmations++
+		default:
+			quorumDisagreements.Add(1)
+			log.Printf(
+				"quorum provider %s disagrees on block %d: hash %s and transaction root %s instead of %s and %s\n",
+				q.providers[i].url, block.NumberU64(), header.Hash(), header.TxHash, block.Hash(), block.TxHash(),
+			)
+		}
+	}
+
+	if confirmations < q.size {
+		quorumPausedBlock.Set(block.Number().Int64())
+
+		return fmt.Errorf(
+			"%w: block %d %s is confirmed by %d of %d required providers",
+			ErrQuorumNotReached, block.NumberU64(), block.Hash(), confirmations, q.size,
+		)
+	}
+
+	quorumPausedBlock.Set(0)
+
+	return nil
+}
+
+// getHeaders requests the header with the number of the block from every provider.
+// The header is nil if the provider failed or does not have it.
+func (q *Quorum) getHeaders(ctx context.Context, block *types.Block) []*types.Header {
+	ctx, cancel := context.WithTimeout(ctx, QuorumTimeout)
+	defer cancel()
+
+	headers := make([]*types.Header, len(q.providers))
+
+	var wg sync.WaitGroup
+
+	for i, provider := range q.providers {
+		wg.Add(1)
+
+		go func(i int, provider quorumProvider) {
+			defer wg.Done()
+
+			header, err := provider.client.HeaderByNumber(ctx, block.Number())
+			if errors.Is(err, ethereum.NotFound) {
+				return
+			}
+			if err != nil {
+				log.Printf("failed to get block %d from quorum provider %s: %s\n", block.NumberU64(), provider.url, err)
+
+				return
+			}
+
+			headers[i] = header
+		}(i, provider)
+	}
+
+	wg.Wait()
+
+	return headers
+}
@@ -0,0 +1,43 @@
+package infrastructure_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestQuorum_Verify(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	primary := newFakeNode(t)
+	primary.extend(1, 0)
+
+	agreeing := primary.mirror(t)
+	disagreeing := newFakeNode(t)
+	disagreeing.extend(1, 1)
+	lagging := newFakeNode(t)
+
+	providers := []string{agreeing.URL, disagreeing.URL, lagging.URL}
+	chainID := big.NewInt(fakeChainID)
+
+	quorum, err := infrastructure.DialQuorum(ctx, providers, 1, chainID)
+	require.NoError(t, err)
+	assert.NoError(t, quorum.Verify(ctx, primary.block(1)))
+
+	quorum, err = infrastructure.DialQuorum(ctx, providers, 2, chainID)
+	require.NoError(t, err)
+	assert.ErrorIs(t, quorum.Verify(ctx, primary.block(1)), infrastructure.ErrQuorumNotReached)
+
+	_, err = infrastructure.DialQuorum(ctx, providers, 4, chainID)
+	assert.Error(t, err)
+
+	_, err = infrastructure.DialQuorum(ctx, providers, 1, big.NewInt(1))
+	assert.Error(t, err)
+}
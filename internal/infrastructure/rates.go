@@ -0,0 +1,203 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+const (
+	RateSourceStatic = "static"
+
+	// roundDataWords is the number of words returned by latestRoundData:
+	// roundId, answer, startedAt, updatedAt and answeredInRound.
+	roundDataWords = 5
+)
+
+var latestRoundDataSelector = crypto.Keccak256([]byte("latestRoundData()"))[:4]
+
+// StaticRateProvider returns exchange rates set in the configuration.
+// The rates are timestamped with the time the provider was created.
+type StaticRateProvider struct {
+	rates     map[string]*big.Rat
+	createdAt time.Time
+}
+
+// NewStaticRateProvider creates a provider from prices of one ether by currency codes.
+func NewStaticRateProvider(rawRates map[string]string) (*StaticRateProvider, error) {
+	rates, err := parseRates(rawRates)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StaticRateProvider{
+		rates:     rates,
+		createdAt: time.Now().UTC(),
+	}, nil
+}
+
+func (p *StaticRateProvider) GetRate(_ context.Context, currency string) (domain.ExchangeRate, error) {
+	rate, ok := p.rates[currency]
+	if !ok {
+		return domain.ExchangeRate{}, unknownCurrencyError(currency)
+	}
+
+	return domain.NewExchangeRate(currency, rate, p.createdAt, RateSourceStatic), nil
+}
+
+// FileRateProvider reads exchange rates from a JSON file with prices of one ether by currency codes,
+// e.g. {"USD": "3012.45"}. The file is read on every request, so it can be updated by another process.
+// The rates are timestamped with the modification time of the file.
+type FileRateProvider struct {
+	path string
+}
+
+func NewFileRateProvider(path string) (*FileRateProvider, error) {
+	provider := &FileRateProvider{path: path}
+
+	// The file is checked at once to fail on start instead of on the first invoice.
+	if _, _, err := provider.read(); err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+func (p *FileRateProvider) GetRate(_ context.Context, currency string) (domain.ExchangeRate, error) {
+	rates, modifiedAt, err := p.read()
+	if err != nil {
+		return domain.ExchangeRate{}, err
+	}
+
+	rate, ok := rates[currency]
+	if !ok {
+		return domain.ExchangeRate{}, unknownCurrencyError(currency)
+	}
+
+	return domain.NewExchangeRate(currency, rate, modifiedAt, "file:"+p.path), nil
+}
+
+func (p *FileRateProvider) read() (map[string]*big.Rat, time.Time, error) {
+	file, err := os.Open(p.path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to open exchange rates file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to stat exchange rates file: %w", err)
+	}
+
+	var rawRates map[string]string
+	if err := json.NewDecoder(file).Decode(&rawRates); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to decode exchange rates file %s: %w", p.path, err)
+	}
+
+	rates, err := parseRates(rawRates)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("exchange rates file %s: %w", p.path, err)
+	}
+
+	return rates, info.ModTime().UTC(), nil
+}
+
+// ChainlinkRateProvider reads exchange rates from Chainlink price feeds,
+// which are aggregator contracts with prices of one ether, e.g. ETH / USD.
+type ChainlinkRateProvider struct {
+	ethereum *Ethereum
+	feeds    map[string]geth.Address
+	// maxAge is the longest time since the last update of a feed for its rate to be used.
+	maxAge time.Duration
+}
+
+func NewChainlinkRateProvider(
+	ethereum *Ethereum,
+	feeds map[string]geth.Address,
+	maxAge time.Duration,
+) *ChainlinkRateProvider {
+	return &ChainlinkRateProvider{
+		ethereum: ethereum,
+		feeds:    feeds,
+		maxAge:   maxAge,
+	}
+}
+
+func (p *ChainlinkRateProvider) GetRate(ctx context.Context, currency string) (domain.ExchangeRate, error) {
+	feed, ok := p.feeds[currency]
+	if !ok {
+		return domain.ExchangeRate{}, unknownCurrencyError(currency)
+	}
+
+	rawDecimals, err := p.ethereum.callContract(ctx, feed, decimalsSelector)
+	if err != nil {
+		return domain.ExchangeRate{}, err
+	}
+
+	decimals, err := decodeDecimals(rawDecimals)
+	if err != nil {
+		return domain.ExchangeRate{}, fmt.Errorf("price feed %s: %w", feed, err)
+	}
+
+	roundData, err := p.ethereum.callContract(ctx, feed, latestRoundDataSelector)
+	if err != nil {
+		return domain.ExchangeRate{}, err
+	}
+	if len(roundData) != roundDataWords*wordLength {
+		return domain.ExchangeRate{}, fmt.Errorf("price feed %s: unexpected round data length %d", feed, len(roundData))
+	}
+
+	answer := roundData[wordLength : 2*wordLength]
+	// The answer is a signed integer, the highest bit is set for negative ones.
+	if answer[0]&0x80 != 0 || new(big.Int).SetBytes(answer).Sign() == 0 {
+		return domain.ExchangeRate{}, fmt.Errorf("price feed %s returned a non-positive price", feed)
+	}
+
+	updatedAt := time.Unix(new(big.Int).SetBytes(roundData[3*wordLength:4*wordLength]).Int64(), 0).UTC()
+	if age := time.Since(updatedAt); age > p.maxAge {
+		return domain.ExchangeRate{}, fmt.Errorf("price feed %s was updated %s ago, which is too long", feed, age.Round(time.Second))
+	}
+
+	rate := new(big.Rat).SetFrac(
+		new(big.Int).SetBytes(answer),
+		new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil),
+	)
+
+	return domain.NewExchangeRate(currency, rate, updatedAt, "chainlink:"+feed.Hex()), nil
+}
+
+func parseRates(rawRates map[string]string) (map[string]*big.Rat, error) {
+	rates := make(map[string]*big.Rat, len(rawRates))
+
+	for rawCurrency, rawRate := range rawRates {
+		currency, err := domain.ParseCurrency(rawCurrency)
+		if err != nil {
+			return nil, err
+		}
+
+		rate, err := domain.ParseDecimal(rawRate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate of %s: %w", currency, err)
+		}
+		if rate.Sign() <= 0 {
+			return nil, fmt.Errorf("rate of %s must be positive", currency)
+		}
+
+		rates[currency] = rate
+	}
+
+	return rates, nil
+}
+
+func unknownCurrencyError(currency string) error {
+	return common.FlagError(fmt.Errorf("exchange rate of %s not found", currency), common.FlagNotFound)
+}
@@ -0,0 +1,64 @@
+package infrastructure_test
+
+import (
+	"context"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestStaticRateProvider(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sut, err := infrastructure.NewStaticRateProvider(map[string]string{"usd": "3012.45"})
+	require.NoError(t, err)
+
+	rate, err := sut.GetRate(ctx, "USD")
+	require.NoError(t, err)
+	assert.Equal(t, big.NewRat(301245, 100), rate.Rate())
+	assert.Equal(t, infrastructure.RateSourceStatic, rate.Source())
+
+	_, err = sut.GetRate(ctx, "EUR")
+	assert.True(t, common.IsFlaggedError(err, common.FlagNotFound))
+
+	_, err = infrastructure.NewStaticRateProvider(map[string]string{"USD": "0"})
+	assert.Error(t, err, "rates must be positive")
+}
+
+func TestFileRateProvider(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "rates.json")
+	modifiedAt := time.Unix(1_700_000_000, 0).UTC()
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"USD": "3000"}`), 0o600))
+	require.NoError(t, os.Chtimes(path, modifiedAt, modifiedAt))
+
+	sut, err := infrastructure.NewFileRateProvider(path)
+	require.NoError(t, err)
+
+	rate, err := sut.GetRate(ctx, "USD")
+	require.NoError(t, err)
+	assert.Equal(t, big.NewRat(3000, 1), rate.Rate())
+	assert.Equal(t, modifiedAt, rate.Timestamp())
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"USD": "3100.5"}`), 0o600))
+
+	rate, err = sut.GetRate(ctx, "USD")
+	require.NoError(t, err)
+	assert.Equal(t, big.NewRat(6201, 2), rate.Rate(), "the file must be read on every request")
+
+	_, err = infrastructure.NewFileRateProvider(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,69 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+)
+
+// LogRangeLimit is the largest range of blocks requested by a single eth_getLogs call,
+// most providers reject larger ones.
+const LogRangeLimit = 10_000
+
+// GetBlock returns the canonical block with the number or the head block if the number is nil.
+func (e *Ethereum) GetBlock(ctx context.Context, number *big.Int) (*types.Block, error) {
+	block, err := e.client().BlockByNumber(ctx, number)
+	if errors.Is(err, ethereum.NotFound) {
+		return nil, common.FlagError(fmt.Errorf("block %s not found", number), common.FlagNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get block %s: %w", number, err)
+	}
+
+	return block, nil
+}
+
+// GetTokenTransfersTo returns ERC-20 Transfer events to any of the addresses
+// emitted in the blocks from fromBlock to toBlock inclusive.
+// The range is requested in parts of LogRangeLimit blocks.
+func (e *Ethereum) GetTokenTransfersTo(
+	ctx context.Context,
+	addresses []geth.Address,
+	fromBlock uint64,
+	toBlock uint64,
+) ([]TokenTransfer, error) {
+	recipients := make([]geth.Hash, 0, len(addresses))
+	for _, address := range addresses {
+		recipients = append(recipients, geth.BytesToHash(address.Bytes()))
+	}
+
+	var transfers []TokenTransfer
+
+	for from := fromBlock; from <= toBlock; from += LogRangeLimit {
+		to := min(from+LogRangeLimit-1, toBlock)
+
+		logs, err := e.client().FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Topics:    [][]geth.Hash{{TransferEventTopic}, nil, recipients},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get transfer logs of blocks %d-%d: %w", from, to, err)
+		}
+
+		for _, log := range logs {
+			if transfer, ok := parseTokenTransfer(log); ok {
+				transfers = append(transfers, transfer)
+			}
+		}
+	}
+
+	return transfers, nil
+}
@@ -0,0 +1,72 @@
+package infrastructure_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestEthereum_GetTokenTransfersTo(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	node := newFakeNode(t)
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	invoice := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	other := geth.HexToAddress("0x5f4eC3Df9cbd43714FE2740f5E3616155c5b8419")
+	token := geth.HexToAddress("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+
+	txs := signTransfers(t, key, token, 2)
+
+	transferLog := func(tx *types.Transaction, to geth.Address, value int64) *types.Receipt {
+		return &types.Receipt{
+			Status:            types.ReceiptStatusSuccessful,
+			CumulativeGasUsed: 50_000,
+			Logs: []*types.Log{{
+				Address: token,
+				Topics: []geth.Hash{
+					infrastructure.TransferEventTopic,
+					geth.BytesToHash(from.Bytes()),
+					geth.BytesToHash(to.Bytes()),
+				},
+				Data:   geth.LeftPadBytes(big.NewInt(value).Bytes(), 32),
+				TxHash: tx.Hash(),
+			}},
+			TxHash:  tx.Hash(),
+			GasUsed: 50_000,
+		}
+	}
+
+	node.mine(txs[:1], []*types.Receipt{transferLog(txs[0], other, 3)})
+	block := node.mine(txs[1:], []*types.Receipt{transferLog(txs[1], invoice, 5)})
+	node.extend(1, 0)
+
+	sut := newTestEthereum(ctx, t, node)
+
+	head, err := sut.GetBlock(ctx, nil)
+	require.NoError(t, err)
+
+	transfers, err := sut.GetTokenTransfersTo(ctx, []geth.Address{invoice}, 0, head.NumberU64())
+	require.NoError(t, err)
+	require.Len(t, transfers, 1)
+	assert.Equal(t, block.NumberU64(), transfers[0].BlockNumber)
+	assert.Equal(t, txs[1].Hash(), transfers[0].TxHash)
+	assert.Equal(t, big.NewInt(5), transfers[0].Value)
+
+	transfers, err = sut.GetTokenTransfersTo(ctx, []geth.Address{invoice}, block.NumberU64()+1, head.NumberU64())
+	require.NoError(t, err)
+	assert.Empty(t, transfers)
+}
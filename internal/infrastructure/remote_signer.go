@@ -0,0 +1,130 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+// RemoteSigner signs transactions with an external signer holding the invoice keys,
+// which may require every transaction to be approved by an operator.
+// Web3Signer is asked with eth_signTransaction, Clef with account_signTransaction of its external API.
+// The returned transaction is checked to be the requested one and to be sent from the invoice address.
+type RemoteSigner struct {
+	client   *rpc.Client
+	protocol string
+	// wallet derives the invoice addresses, which are the accounts of the signer.
+	wallet Wallet
+}
+
+func DialRemoteSigner(ctx context.Context, url string, protocol string, wallet Wallet) (*RemoteSigner, error) {
+	switch protocol {
+	case common.SignerProtocolWeb3Signer, common.SignerProtocolClef:
+	default:
+		return nil, fmt.Errorf("unknown signer protocol %q", protocol)
+	}
+
+	client, err := rpc.DialContext(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial to signer %s: %w", url, err)
+	}
+
+	return &RemoteSigner{
+		client:   client,
+		protocol: protocol,
+		wallet:   wallet,
+	}, nil
+}
+
+// signTransactionArgs are the transaction fields accepted by eth_signTransaction and account_signTransaction.
+type signTransactionArgs struct {
+	From                 geth.MixedcaseAddress  `json:"from"`
+	To                   *geth.MixedcaseAddress `json:"to"`
+	Gas                  hexutil.Uint64         `json:"gas"`
+	MaxFeePerGas         *hexutil.Big           `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas *hexutil.Big           `json:"maxPriorityFeePerGas"`
+	Value                *hexutil.Big           `json:"value"`
+	Nonce                hexutil.Uint64         `json:"nonce"`
+	Data                 hexutil.Bytes          `json:"data"`
+	// ChainID is only sent to Clef, Web3Signer signs for the chain it is configured with.
+	ChainID *hexutil.Big `json:"chainId,omitempty"`
+}
+
+// clefSignTransactionResult is the result of account_signTransaction.
+type clefSignTransactionResult struct {
+	Raw hexutil.Bytes `json:"raw"`
+}
+
+func (s *RemoteSigner) SignInvoiceTransaction(
+	ctx context.Context,
+	id domain.ID,
+	tx *types.Transaction,
+	signer types.Signer,
+) (*types.Transaction, error) {
+	from, err := s.wallet.GetInvoiceAccount(id)
+	if err != nil {
+		return nil, err
+	}
+
+	to := geth.NewMixedcaseAddress(*tx.To())
+	args := signTransactionArgs{
+		From:                 geth.NewMixedcaseAddress(*from),
+		To:                   &to,
+		Gas:                  hexutil.Uint64(tx.Gas()),
+		MaxFeePerGas:         (*hexutil.Big)(tx.GasFeeCap()),
+		MaxPriorityFeePerGas: (*hexutil.Big)(tx.GasTipCap()),
+		Value:                (*hexutil.Big)(tx.Value()),
+		Nonce:                hexutil.Uint64(tx.Nonce()),
+		Data:                 tx.Data(),
+		ChainID:              nil,
+	}
+
+	var raw hexutil.Bytes
+
+	switch s.protocol {
+	case common.SignerProtocolClef:
+		args.ChainID = (*hexutil.Big)(new(big.Int).Set(tx.ChainId()))
+
+		var result clefSignTransactionResult
+		if err := s.client.CallContext(ctx, &result, "account_signTransaction", args); err != nil {
+			return nil, fmt.Errorf("signer refused transaction of invoice %d: %w", id, err)
+		}
+
+		raw = result.Raw
+	default:
+		if err := s.client.CallContext(ctx, &raw, "eth_signTransaction", args); err != nil {
+			return nil, fmt.Errorf("signer refused transaction of invoice %d: %w", id, err)
+		}
+	}
+
+	signed := new(types.Transaction)
+	if err := signed.UnmarshalBinary(raw); err != nil {
+		return nil, fmt.Errorf("failed to decode transaction of invoice %d signed by signer: %w", id, err)
+	}
+
+	if signer.Hash(signed) != signer.Hash(tx) {
+		return nil, fmt.Errorf("signer returned another transaction %s for invoice %d", signed.Hash(), id)
+	}
+
+	sender, err := types.Sender(signer, signed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover sender of transaction of invoice %d: %w", id, err)
+	}
+	if sender != *from {
+		return nil, fmt.Errorf("signer signed transaction of invoice %d with %s instead of %s", id, sender, from)
+	}
+
+	return signed, nil
+}
+
+func (s *RemoteSigner) Close() {
+	s.client.Close()
+}
@@ -0,0 +1,196 @@
+package infrastructure_test
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestRemoteSigner_SignInvoiceTransaction(t *testing.T) {
+	t.Parallel()
+
+	for _, protocol := range []string{common.SignerProtocolWeb3Signer, common.SignerProtocolClef} {
+		protocol := protocol
+
+		t.Run(protocol, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			signer := types.LatestSignerForChainID(big.NewInt(fakeChainID))
+
+			keys, err := infrastructure.NewHDWallet(testMnemonic)
+			require.NoError(t, err)
+
+			addresses, err := infrastructure.NewWatchOnlyWallet(accountXPub(t, testMnemonic))
+			require.NoError(t, err)
+
+			remote := newFakeSigner(t, keys, 1)
+
+			sut, err := infrastructure.DialRemoteSigner(ctx, remote.url, protocol, addresses)
+			require.NoError(t, err)
+			t.Cleanup(sut.Close)
+
+			to := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+			tx := types.NewTx(&types.DynamicFeeTx{
+				ChainID:   big.NewInt(fakeChainID),
+				Nonce:     2,
+				GasTipCap: big.NewInt(1),
+				GasFeeCap: big.NewInt(3),
+				Gas:       infrastructure.TransferGasLimit,
+				To:        &to,
+				Value:     big.NewInt(1_000),
+			})
+
+			signed, err := sut.SignInvoiceTransaction(ctx, 1, tx, signer)
+			require.NoError(t, err)
+			assert.Equal(t, signer.Hash(tx), signer.Hash(signed))
+
+			from, err := addresses.GetInvoiceAccount(1)
+			require.NoError(t, err)
+
+			sender, err := types.Sender(signer, signed)
+			require.NoError(t, err)
+			assert.Equal(t, *from, sender)
+
+			_, err = sut.SignInvoiceTransaction(ctx, 2, tx, signer)
+			assert.ErrorContains(t, err, "refused")
+
+			remote.tamper = true
+			_, err = sut.SignInvoiceTransaction(ctx, 1, tx, signer)
+			assert.ErrorContains(t, err, "another transaction")
+		})
+	}
+}
+
+// fakeSigner is a local stand-in for Web3Signer and Clef which signs with the keys of the listed invoices.
+type fakeSigner struct {
+	url    string
+	wallet *infrastructure.HDWallet
+	ids    map[geth.Address]domain.ID
+	// tamper makes the signer change the value of the transaction before signing it.
+	tamper bool
+}
+
+type fakeSignArgs struct {
+	From                 geth.Address   `json:"from"`
+	To                   *geth.Address  `json:"to"`
+	Gas                  hexutil.Uint64 `json:"gas"`
+	MaxFeePerGas         *hexutil.Big   `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas *hexutil.Big   `json:"maxPriorityFeePerGas"`
+	Value                *hexutil.Big   `json:"value"`
+	Nonce                hexutil.Uint64 `json:"nonce"`
+	Data                 hexutil.Bytes  `json:"data"`
+	ChainID              *hexutil.Big   `json:"chainId"`
+}
+
+func newFakeSigner(t *testing.T, wallet *infrastructure.HDWallet, ids ...domain.ID) *fakeSigner {
+	t.Helper()
+
+	signer := &fakeSigner{
+		wallet: wallet,
+		ids:    make(map[geth.Address]domain.ID, len(ids)),
+	}
+
+	for _, id := range ids {
+		address, err := wallet.GetInvoiceAccount(id)
+		require.NoError(t, err)
+
+		signer.ids[*address] = id
+	}
+
+	server := rpc.NewServer()
+	require.NoError(t, server.RegisterName("eth", &fakeWeb3SignerAPI{signer: signer}))
+	require.NoError(t, server.RegisterName("account", &fakeClefAPI{signer: signer}))
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	t.Cleanup(server.Stop)
+
+	signer.url = httpServer.URL
+
+	return signer
+}
+
+func (s *fakeSigner) sign(args fakeSignArgs) (*types.Transaction, error) {
+	id, ok := s.ids[args.From]
+	if !ok {
+		return nil, fmt.Errorf("account %s is locked", args.From)
+	}
+
+	value := args.Value.ToInt()
+	if s.tamper {
+		value = new(big.Int).Add(value, big.NewInt(1))
+	}
+
+	// Web3Signer is configured with the chain id.
+	chainID := big.NewInt(fakeChainID)
+	if args.ChainID != nil {
+		chainID = args.ChainID.ToInt()
+	}
+
+	tx := types.NewTx(&types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     uint64(args.Nonce),
+		GasTipCap: args.MaxPriorityFeePerGas.ToInt(),
+		GasFeeCap: args.MaxFeePerGas.ToInt(),
+		Gas:       uint64(args.Gas),
+		To:        args.To,
+		Value:     value,
+		Data:      args.Data,
+	})
+
+	return s.wallet.SignInvoiceTransaction(context.Background(), id, tx, types.LatestSignerForChainID(chainID))
+}
+
+type fakeWeb3SignerAPI struct {
+	signer *fakeSigner
+}
+
+func (api *fakeWeb3SignerAPI) SignTransaction(args fakeSignArgs) (hexutil.Bytes, error) {
+	tx, err := api.signer.sign(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.MarshalBinary()
+}
+
+type fakeClefAPI struct {
+	signer *fakeSigner
+}
+
+type fakeClefResult struct {
+	Raw hexutil.Bytes      `json:"raw"`
+	Tx  *types.Transaction `json:"tx"`
+}
+
+func (api *fakeClefAPI) SignTransaction(args fakeSignArgs) (*fakeClefResult, error) {
+	if args.ChainID == nil {
+		return nil, fmt.Errorf("chain id is required")
+	}
+
+	tx, err := api.signer.sign(args)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &fakeClefResult{Raw: raw, Tx: tx}, nil
+}
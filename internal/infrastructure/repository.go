@@ -1,8 +1,10 @@
 package infrastructure
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	geth "github.com/ethereum/go-ethereum/common"
 
@@ -14,7 +16,15 @@ type Repository struct {
 	invoices       *sync.Map
 	addressesIndex *sync.Map
 
-	lastID domain.ID
+	lastID     domain.ID
+	checkpoint *Checkpoint
+	// recentBlocks are the hashes of the checkpoint blocks within the reorg window by their numbers.
+	recentBlocks map[uint64]geth.Hash
+
+	webhookDeliveries []*WebhookDelivery
+	webhookAttempts   []WebhookAttempt
+
+	discrepancies []*domain.Discrepancy
 
 	mu *sync.Mutex
 }
@@ -24,25 +34,52 @@ func NewRepository() *Repository {
 		invoices:       new(sync.Map),
 		addressesIndex: new(sync.Map),
 		lastID:         0,
+		recentBlocks:   make(map[uint64]geth.Hash),
 		mu:             &sync.Mutex{},
 	}
 }
 
-func (r *Repository) GetID() domain.ID {
+func (r *Repository) GetID(_ context.Context) (domain.ID, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	r.lastID++
 
-	return r.lastID
+	return r.lastID, nil
 }
 
-func (r *Repository) Save(invoice *domain.Invoice) {
-	r.invoices.Store(invoice.ID(), invoice)
-	r.addressesIndex.Store(invoice.Address().Hex(), invoice)
+// Save stores a copy of the invoice, so changes of invoices returned by the repository
+// are not visible to others until they are saved.
+// Saving an invoice which has been saved by someone else since it was loaded is rejected.
+func (r *Repository) Save(_ context.Context, invoice *domain.Invoice) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var version uint64
+	if value, ok := r.invoices.Load(invoice.ID()); ok {
+		saved, ok := value.(*domain.Invoice)
+		if !ok {
+			return fmt.Errorf("invoice with id %d has invalid type", invoice.ID())
+		}
+
+		version = saved.Version()
+	}
+
+	if invoice.Version() != version {
+		return common.FlagError(
+			fmt.Errorf("invoice with id %d: %w", invoice.ID(), domain.ErrConcurrentUpdate),
+			common.FlagConflict,
+		)
+	}
+
+	invoice.SetVersion(version + 1)
+	r.invoices.Store(invoice.ID(), invoice.Clone())
+	r.addressesIndex.Store(invoice.Address().Hex(), invoice.ID())
+
+	return nil
 }
 
-func (r *Repository) GetByID(id domain.ID) (*domain.Invoice, error) {
+func (r *Repository) GetByID(_ context.Context, id domain.ID) (*domain.Invoice, error) {
 	invoice, ok := r.invoices.Load(id)
 	if !ok {
 		return nil, common.FlagError(fmt.Errorf("invoice with id %d not found", id), common.FlagNotFound)
@@ -53,10 +90,10 @@ func (r *Repository) GetByID(id domain.ID) (*domain.Invoice, error) {
 		return nil, fmt.Errorf("invoice with id %d has invalid type", id)
 	}
 
-	return typedInvoice, nil
+	return typedInvoice.Clone(), nil
 }
 
-func (r *Repository) GetByAddress(address *geth.Address) (*domain.Invoice, error) {
+func (r *Repository) GetByAddress(ctx context.Context, address *geth.Address) (*domain.Invoice, error) {
 	value, ok := r.addressesIndex.Load(address.Hex())
 	if !ok {
 		return nil, common.FlagError(
@@ -65,10 +102,226 @@ func (r *Repository) GetByAddress(address *geth.Address) (*domain.Invoice, error
 		)
 	}
 
-	invoice, ok := value.(*domain.Invoice)
+	id, ok := value.(domain.ID)
 	if !ok {
 		return nil, fmt.Errorf("invoice with address %q has invalid type", address.Hex())
 	}
 
-	return invoice, nil
+	return r.GetByID(ctx, id)
+}
+
+func (r *Repository) GetUnconfirmed(_ context.Context) ([]*domain.Invoice, error) {
+	var invoices []*domain.Invoice
+
+	r.invoices.Range(func(_, value any) bool {
+		invoice, ok := value.(*domain.Invoice)
+		if ok && invoice.HasUnconfirmedPayments() {
+			invoices = append(invoices, invoice.Clone())
+		}
+
+		return true
+	})
+
+	return invoices, nil
+}
+
+func (r *Repository) GetOverdue(_ context.Context, now time.Time) ([]*domain.Invoice, error) {
+	var invoices []*domain.Invoice
+
+	r.invoices.Range(func(_, value any) bool {
+		invoice, ok := value.(*domain.Invoice)
+		if ok && invoice.CanExpire(now) {
+			invoices = append(invoices, invoice.Clone())
+		}
+
+		return true
+	})
+
+	return invoices, nil
+}
+
+func (r *Repository) GetWithPendingTransfers(_ context.Context) ([]*domain.Invoice, error) {
+	var invoices []*domain.Invoice
+
+	r.invoices.Range(func(_, value any) bool {
+		invoice, ok := value.(*domain.Invoice)
+		if ok && invoice.PendingTransfer() != nil {
+			invoices = append(invoices, invoice.Clone())
+		}
+
+		return true
+	})
+
+	return invoices, nil
+}
+
+func (r *Repository) GetUnswept(_ context.Context) ([]*domain.Invoice, error) {
+	var invoices []*domain.Invoice
+
+	r.invoices.Range(func(_, value any) bool {
+		invoice, ok := value.(*domain.Invoice)
+		if !ok || invoice.Token() != nil || invoice.PendingTransfer() != nil || invoice.Sweep() != nil {
+			return true
+		}
+
+		switch invoice.Status() {
+		case domain.InvoiceStatusPaid, domain.InvoiceStatusOverpaid:
+			invoices = append(invoices, invoice.Clone())
+		default:
+		}
+
+		return true
+	})
+
+	return invoices, nil
+}
+
+func (r *Repository) GetOpen(_ context.Context) ([]*domain.Invoice, error) {
+	var invoices []*domain.Invoice
+
+	r.invoices.Range(func(_, value any) bool {
+		invoice, ok := value.(*domain.Invoice)
+		if ok && invoice.IsOpen() {
+			invoices = append(invoices, invoice.Clone())
+		}
+
+		return true
+	})
+
+	return invoices, nil
+}
+
+func (r *Repository) GetByBlockHash(_ context.Context, hash geth.Hash) ([]*domain.Invoice, error) {
+	var invoices []*domain.Invoice
+
+	r.invoices.Range(func(_, value any) bool {
+		invoice, ok := value.(*domain.Invoice)
+		if !ok {
+			return true
+		}
+
+		for _, payment := range invoice.Payments() {
+			if payment.BlockHash() == hash {
+				invoices = append(invoices, invoice.Clone())
+
+				break
+			}
+		}
+
+		return true
+	})
+
+	return invoices, nil
+}
+
+func (r *Repository) GetCheckpoint(_ context.Context) (Checkpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.checkpoint == nil {
+		return Checkpoint{}, common.FlagError(fmt.Errorf("checkpoint not found"), common.FlagNotFound)
+	}
+
+	checkpoint := *r.checkpoint
+	checkpoint.Ancestors = make(map[uint64]geth.Hash)
+
+	for number, hash := range r.recentBlocks {
+		if checkpoint.IsAncestor(number) {
+			checkpoint.Ancestors[number] = hash
+		}
+	}
+
+	return checkpoint, nil
+}
+
+// SaveCheckpoint keeps the recent blocks the same way as the SQL repositories.
+func (r *Repository) SaveCheckpoint(_ context.Context, checkpoint Checkpoint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	checkpoint.Ancestors = nil
+	r.checkpoint = &checkpoint
+	r.recentBlocks[checkpoint.Number] = checkpoint.Hash
+
+	for number := range r.recentBlocks {
+		if number != checkpoint.Number && !checkpoint.IsAncestor(number) {
+			delete(r.recentBlocks, number)
+		}
+	}
+
+	return nil
+}
+
+func (r *Repository) SaveWebhookDelivery(_ context.Context, delivery *WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if delivery.ID == 0 {
+		delivery.ID = uint64(len(r.webhookDeliveries)) + 1
+		r.webhookDeliveries = append(r.webhookDeliveries, delivery)
+	}
+
+	return nil
+}
+
+func (r *Repository) GetDueWebhookDeliveries(_ context.Context, now time.Time) ([]*WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deliveries []*WebhookDelivery
+
+	for _, delivery := range r.webhookDeliveries {
+		if delivery.Status == WebhookDeliveryStatusPending && !delivery.NextAttemptAt.After(now) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (r *Repository) SaveWebhookAttempt(_ context.Context, attempt WebhookAttempt) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.webhookAttempts = append(r.webhookAttempts, attempt)
+
+	return nil
+}
+
+func (r *Repository) SaveDiscrepancy(_ context.Context, discrepancy *domain.Discrepancy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if discrepancy.ID() == 0 {
+		discrepancy.SetID(uint64(len(r.discrepancies)) + 1)
+		r.discrepancies = append(r.discrepancies, discrepancy)
+	}
+
+	return nil
+}
+
+func (r *Repository) GetDiscrepancy(_ context.Context, id uint64) (*domain.Discrepancy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id == 0 || id > uint64(len(r.discrepancies)) {
+		return nil, common.FlagError(fmt.Errorf("discrepancy with id %d not found", id), common.FlagNotFound)
+	}
+
+	return r.discrepancies[id-1], nil
+}
+
+func (r *Repository) GetDiscrepancies(_ context.Context, status domain.DiscrepancyStatus) ([]*domain.Discrepancy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var discrepancies []*domain.Discrepancy
+
+	for _, discrepancy := range r.discrepancies {
+		if status == "" || discrepancy.Status() == status {
+			discrepancies = append(discrepancies, discrepancy)
+		}
+	}
+
+	return discrepancies, nil
 }
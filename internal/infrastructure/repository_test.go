@@ -1,12 +1,17 @@
 package infrastructure_test
 
 import (
+	"context"
 	"math/big"
 	"sync"
 	"testing"
+	"time"
 
+	geth "github.com/ethereum/go-ethereum/common"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
 	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
 )
 
@@ -14,14 +19,49 @@ func TestRepository_GetID(t *testing.T) {
 	t.Parallel()
 
 	const callTimes = 1_000_000
+	ctx := context.Background()
 	sut := infrastructure.NewRepository()
 
 	callParallelAndWait(callTimes-1, func() {
-		sut.GetID()
+		_, err := sut.GetID(ctx)
+		assert.NoError(t, err)
 	})
-	lastID := sut.GetID()
+	lastID, err := sut.GetID(ctx)
+	require.NoError(t, err)
 
-	assert.Equal(t, big.NewInt(callTimes), lastID)
+	assert.Equal(t, domain.ID(callTimes), lastID)
+}
+
+func TestRepository_SaveKeepsCopy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	sut := infrastructure.NewRepository()
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	invoice := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 1, time.Time{}, nil, nil, nil,
+	)
+	require.NoError(t, sut.Save(ctx, invoice))
+
+	first, err := sut.GetByID(ctx, 1)
+	require.NoError(t, err)
+	second, err := sut.GetByAddress(ctx, &address)
+	require.NoError(t, err)
+
+	first.Detect(domain.NewDetectedPayment(
+		geth.Hash{1}, domain.PaymentKindTransaction, 0, 1, geth.Hash{2},
+		address, big.NewInt(2), time.Unix(1, 0).UTC(), 21_000, big.NewInt(1), true,
+	))
+	assert.Empty(t, second.Payments(), "unsaved changes must not be visible")
+
+	require.NoError(t, sut.Save(ctx, first))
+	assert.ErrorIs(t, sut.Save(ctx, second), domain.ErrConcurrentUpdate)
+
+	saved, err := sut.GetByID(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, domain.InvoiceStatusPaid, saved.Status())
+	assert.Equal(t, big.NewInt(2), saved.Balance())
 }
 
 func callParallelAndWait(times int, f func()) {
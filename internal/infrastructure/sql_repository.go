@@ -0,0 +1,1127 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+const decimalBase = 10
+
+// sqlDialect describes the differences between the supported SQL databases.
+type sqlDialect struct {
+	// numberedPlaceholders replaces "?" placeholders with "$1", "$2", ...
+	numberedPlaceholders bool
+
+	// migrations are applied in order, each exactly once.
+	// Never edit an applied migration, append a new one instead.
+	migrations []string
+}
+
+// sqlRepository implements the parts of the invoice repository
+// that are the same for every database/sql backed storage.
+type sqlRepository struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func newSQLRepository(ctx context.Context, db *sql.DB, dialect sqlDialect) (*sqlRepository, error) {
+	r := &sqlRepository{
+		db:      db,
+		dialect: dialect,
+	}
+
+	if err := r.migrate(ctx); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return r, nil
+}
+
+func (r *sqlRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r *sqlRepository) Save(ctx context.Context, invoice *domain.Invoice) error {
+	var version uint64
+
+	err := r.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+
+		version, err = r.save(ctx, tx, invoice)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	invoice.SetVersion(version)
+
+	return nil
+}
+
+// save inserts a new invoice or updates the one loaded from the repository and returns its new version.
+// The update locks the invoice row until the transaction ends and is rejected
+// if the invoice has been saved by someone else since it was loaded,
+// so its payments and transfers are never rewritten from a stale copy.
+func (r *sqlRepository) save(ctx context.Context, tx *sql.Tx, invoice *domain.Invoice) (uint64, error) {
+	var (
+		tokenAddress  sql.NullString
+		tokenSymbol   string
+		tokenDecimals uint8
+	)
+	if token := invoice.Token(); token != nil {
+		tokenAddress = sql.NullString{String: token.Address().Hex(), Valid: true}
+		tokenSymbol = token.Symbol()
+		tokenDecimals = token.Decimals()
+	}
+
+	fiat := newFiatColumns(invoice.Fiat())
+
+	version := invoice.Version() + 1
+
+	result, err := tx.ExecContext(ctx, r.query(`
+		INSERT INTO invoices (
+			id, price, balance, address, status, tolerance, required_confirmations, created_at, expires_at,
+			token_address, token_symbol, token_decimals,
+			fiat_currency, fiat_amount, exchange_rate, exchange_rate_at, exchange_rate_source, version
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			price                  = excluded.price,
+			balance                = excluded.balance,
+			address                = excluded.address,
+			status                 = excluded.status,
+			tolerance              = excluded.tolerance,
+			required_confirmations = excluded.required_confirmations,
+			created_at             = excluded.created_at,
+			expires_at             = excluded.expires_at,
+			token_address          = excluded.token_address,
+			token_symbol           = excluded.token_symbol,
+			token_decimals         = excluded.token_decimals,
+			fiat_currency          = excluded.fiat_currency,
+			fiat_amount            = excluded.fiat_amount,
+			exchange_rate          = excluded.exchange_rate,
+			exchange_rate_at       = excluded.exchange_rate_at,
+			exchange_rate_source   = excluded.exchange_rate_source,
+			version                = excluded.version
+		WHERE invoices.version = ?`),
+		invoice.ID(),
+		invoice.Price().String(),
+		invoice.Balance().String(),
+		invoice.Address().Hex(),
+		string(invoice.Status()),
+		invoice.Tolerance().String(),
+		invoice.RequiredConfirmations(),
+		invoice.CreatedAt().Unix(),
+		unixOrNull(invoice.ExpiresAt()),
+		tokenAddress,
+		tokenSymbol,
+		tokenDecimals,
+		fiat.currency,
+		fiat.amount,
+		fiat.rate,
+		fiat.rateAt,
+		fiat.rateSource,
+		version,
+		invoice.Version(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save invoice with id %d: %w", invoice.ID(), err)
+	}
+
+	saved, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to save invoice with id %d: %w", invoice.ID(), err)
+	}
+	if saved == 0 {
+		return 0, common.FlagError(
+			fmt.Errorf("invoice with id %d: %w", invoice.ID(), domain.ErrConcurrentUpdate),
+			common.FlagConflict,
+		)
+	}
+
+	if _, err := tx.ExecContext(ctx, r.query(`DELETE FROM payments WHERE invoice_id = ?`), invoice.ID()); err != nil {
+		return 0, fmt.Errorf("failed to delete payments of invoice with id %d: %w", invoice.ID(), err)
+	}
+
+	for _, payment := range invoice.Payments() {
+		_, err := tx.ExecContext(ctx, r.query(`
+			INSERT INTO payments (
+				invoice_id, tx_hash, kind, payment_index, block_number, block_hash, sender, value, block_time,
+				confirmations, status, gas_used, effective_gas_price, late, verified
+			)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			invoice.ID(),
+			payment.TxHash().Hex(),
+			string(payment.Kind()),
+			payment.Index(),
+			payment.BlockNumber(),
+			payment.BlockHash().Hex(),
+			payment.Sender().Hex(),
+			payment.Value().String(),
+			payment.Timestamp().Unix(),
+			payment.Confirmations(),
+			string(payment.Status()),
+			payment.GasUsed(),
+			payment.EffectiveGasPrice().String(),
+			payment.IsLate(),
+			payment.IsVerified(),
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to save payment %s of invoice with id %d: %w", payment.TxHash(), invoice.ID(), err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, r.query(`DELETE FROM transfers WHERE invoice_id = ?`), invoice.ID()); err != nil {
+		return 0, fmt.Errorf("failed to delete transfers of invoice with id %d: %w", invoice.ID(), err)
+	}
+
+	for _, transfer := range invoice.Transfers() {
+		_, err := tx.ExecContext(ctx, r.query(`
+			INSERT INTO transfers (
+				invoice_id, kind, tx_hash, to_address, value, nonce, max_fee, created_at,
+				status, block_number, gas_used, effective_gas_price
+			)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			invoice.ID(),
+			string(transfer.Kind()),
+			transfer.TxHash().Hex(),
+			transfer.To().Hex(),
+			transfer.Value().String(),
+			transfer.Nonce(),
+			transfer.MaxFee().String(),
+			transfer.CreatedAt().Unix(),
+			string(transfer.Status()),
+			transfer.BlockNumber(),
+			transfer.GasUsed(),
+			transfer.EffectiveGasPrice().String(),
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to save transfer %s of invoice with id %d: %w", transfer.TxHash(), invoice.ID(), err)
+		}
+	}
+
+	return version, nil
+}
+
+func (r *sqlRepository) GetByID(ctx context.Context, id domain.ID) (*domain.Invoice, error) {
+	invoice, err := r.getInvoice(ctx, "id = ?", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, common.FlagError(fmt.Errorf("invoice with id %d not found", id), common.FlagNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invoice with id %d: %w", id, err)
+	}
+
+	return invoice, nil
+}
+
+func (r *sqlRepository) GetByAddress(ctx context.Context, address *geth.Address) (*domain.Invoice, error) {
+	invoice, err := r.getInvoice(ctx, "address = ?", address.Hex())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, common.FlagError(
+			fmt.Errorf("invoice with address %q not found", address.Hex()),
+			common.FlagNotFound,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invoice with address %q: %w", address.Hex(), err)
+	}
+
+	return invoice, nil
+}
+
+func (r *sqlRepository) GetUnconfirmed(ctx context.Context) ([]*domain.Invoice, error) {
+	return r.getInvoices(ctx, r.query(`
+		SELECT DISTINCT invoice_id
+		FROM payments
+		WHERE status = ?`),
+		string(domain.PaymentStatusConfirming),
+	)
+}
+
+func (r *sqlRepository) GetByBlockHash(ctx context.Context, hash geth.Hash) ([]*domain.Invoice, error) {
+	return r.getInvoices(ctx, r.query(`
+		SELECT DISTINCT invoice_id
+		FROM payments
+		WHERE block_hash = ?`),
+		hash.Hex(),
+	)
+}
+
+func (r *sqlRepository) GetOverdue(ctx context.Context, now time.Time) ([]*domain.Invoice, error) {
+	return r.getInvoices(ctx, r.query(`
+		SELECT id
+		FROM invoices
+		WHERE status IN (?, ?) AND expires_at < ?`),
+		string(domain.InvoiceStatusPending),
+		string(domain.InvoiceStatusPartiallyPaid),
+		now.Unix(),
+	)
+}
+
+func (r *sqlRepository) GetWithPendingTransfers(ctx context.Context) ([]*domain.Invoice, error) {
+	return r.getInvoices(ctx, r.query(`
+		SELECT DISTINCT invoice_id
+		FROM transfers
+		WHERE status = ?`),
+		string(domain.TransferStatusPending),
+	)
+}
+
+func (r *sqlRepository) GetUnswept(ctx context.Context) ([]*domain.Invoice, error) {
+	return r.getInvoices(ctx, r.query(`
+		SELECT id
+		FROM invoices
+		WHERE status IN (?, ?) AND token_address IS NULL AND NOT EXISTS (
+			SELECT 1
+			FROM transfers
+			WHERE transfers.invoice_id = invoices.id AND (kind = ? AND status <> ? OR status = ?)
+		)`),
+		string(domain.InvoiceStatusPaid),
+		string(domain.InvoiceStatusOverpaid),
+		string(domain.TransferKindSweep),
+		string(domain.TransferStatusFailed),
+		string(domain.TransferStatusPending),
+	)
+}
+
+// GetOpen returns invoices which addresses may still hold funds:
+// not swept and not expired without payments.
+func (r *sqlRepository) GetOpen(ctx context.Context) ([]*domain.Invoice, error) {
+	return r.getInvoices(ctx, r.query(`
+		SELECT id
+		FROM invoices
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM transfers
+			WHERE transfers.invoice_id = invoices.id AND kind = ? AND status = ?
+		) AND (status <> ? OR EXISTS (
+			SELECT 1
+			FROM payments
+			WHERE payments.invoice_id = invoices.id
+		))`),
+		string(domain.TransferKindSweep),
+		string(domain.TransferStatusConfirmed),
+		string(domain.InvoiceStatusExpired),
+	)
+}
+
+// getInvoices loads invoices which ids are selected by the query.
+func (r *sqlRepository) getInvoices(ctx context.Context, query string, args ...any) ([]*domain.Invoice, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select invoices: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []domain.ID
+
+	for rows.Next() {
+		var id domain.ID
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan invoice id: %w", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to select invoices: %w", err)
+	}
+
+	invoices := make([]*domain.Invoice, 0, len(ids))
+
+	for _, id := range ids {
+		invoice, err := r.GetByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, nil
+}
+
+// getInvoice reads the invoice with its payments and transfers in one read-only transaction,
+// so they are consistent even if the invoice is saved at the same time.
+func (r *sqlRepository) getInvoice(ctx context.Context, condition string, args ...any) (*domain.Invoice, error) {
+	var invoice *domain.Invoice
+
+	err := r.inReadTx(ctx, func(tx *sql.Tx) error {
+		var err error
+
+		invoice, err = r.readInvoice(ctx, tx, condition, args...)
+
+		return err
+	})
+
+	return invoice, err
+}
+
+func (r *sqlRepository) readInvoice(
+	ctx context.Context,
+	tx *sql.Tx,
+	condition string,
+	args ...any,
+) (*domain.Invoice, error) {
+	var (
+		id                               domain.ID
+		rawPrice, rawBalance, rawAddress string
+		rawTolerance                     string
+		status                           domain.InvoiceStatus
+		requiredConfirmations            uint64
+		createdAt                        int64
+		expiresAt                        sql.NullInt64
+		tokenAddress                     sql.NullString
+		tokenSymbol                      string
+		tokenDecimals                    uint8
+		fiat                             fiatColumns
+		version                          uint64
+	)
+
+	err := tx.QueryRowContext(ctx, r.query(`
+		SELECT
+			id, price, balance, address, status, tolerance, required_confirmations, created_at, expires_at,
+			token_address, token_symbol, token_decimals,
+			fiat_currency, fiat_amount, exchange_rate, exchange_rate_at, exchange_rate_source, version
+		FROM invoices
+		WHERE `+condition),
+		args...,
+	).Scan(
+		&id, &rawPrice, &rawBalance, &rawAddress, &status, &rawTolerance,
+		&requiredConfirmations, &createdAt, &expiresAt,
+		&tokenAddress, &tokenSymbol, &tokenDecimals,
+		&fiat.currency, &fiat.amount, &fiat.rate, &fiat.rateAt, &fiat.rateSource, &version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	price, err := parseBigInt(rawPrice)
+	if err != nil {
+		return nil, fmt.Errorf("invoice with id %d has invalid price: %w", id, err)
+	}
+
+	balance, err := parseBigInt(rawBalance)
+	if err != nil {
+		return nil, fmt.Errorf("invoice with id %d has invalid balance: %w", id, err)
+	}
+
+	tolerance, err := parseBigInt(rawTolerance)
+	if err != nil {
+		return nil, fmt.Errorf("invoice with id %d has invalid tolerance: %w", id, err)
+	}
+
+	address := geth.HexToAddress(rawAddress)
+
+	var token *domain.Token
+	if tokenAddress.Valid {
+		token = domain.NewToken(geth.HexToAddress(tokenAddress.String), tokenSymbol, tokenDecimals)
+	}
+
+	fiatPrice, err := fiat.fiatPrice()
+	if err != nil {
+		return nil, fmt.Errorf("invoice with id %d has invalid fiat price: %w", id, err)
+	}
+
+	payments, err := r.getPayments(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	transfers, err := r.getTransfers(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	invoice := domain.NewInvoice(
+		id,
+		price,
+		balance,
+		&address,
+		token,
+		fiatPrice,
+		status,
+		tolerance,
+		requiredConfirmations,
+		time.Unix(createdAt, 0).UTC(),
+		timeOrNil(expiresAt),
+		payments,
+		transfers,
+	)
+	invoice.SetVersion(version)
+
+	return invoice, nil
+}
+
+func (r *sqlRepository) getPayments(ctx context.Context, tx *sql.Tx, invoiceID domain.ID) ([]*domain.Payment, error) {
+	rows, err := tx.QueryContext(ctx, r.query(`
+		SELECT
+			tx_hash, kind, payment_index, block_number, block_hash, sender, value, block_time,
+			confirmations, status, gas_used, effective_gas_price, late, verified
+		FROM payments
+		WHERE invoice_id = ?
+		ORDER BY block_number, tx_hash, payment_index`),
+		invoiceID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payments of invoice with id %d: %w", invoiceID, err)
+	}
+	defer rows.Close()
+
+	var payments []*domain.Payment
+
+	for rows.Next() {
+		var (
+			rawTxHash, rawBlockHash, rawSender  string
+			rawValue, rawGasPrice               string
+			kind                                domain.PaymentKind
+			index                               uint64
+			blockNumber, confirmations, gasUsed uint64
+			blockTime                           int64
+			status                              domain.PaymentStatus
+			late, verified                      bool
+		)
+
+		err := rows.Scan(
+			&rawTxHash, &kind, &index, &blockNumber, &rawBlockHash, &rawSender, &rawValue, &blockTime,
+			&confirmations, &status, &gasUsed, &rawGasPrice, &late, &verified,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan payment of invoice with id %d: %w", invoiceID, err)
+		}
+
+		value, err := parseBigInt(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("payment %s has invalid value: %w", rawTxHash, err)
+		}
+
+		gasPrice, err := parseBigInt(rawGasPrice)
+		if err != nil {
+			return nil, fmt.Errorf("payment %s has invalid effective gas price: %w", rawTxHash, err)
+		}
+
+		payments = append(payments, domain.NewPayment(
+			geth.HexToHash(rawTxHash),
+			kind,
+			index,
+			blockNumber,
+			geth.HexToHash(rawBlockHash),
+			geth.HexToAddress(rawSender),
+			value,
+			time.Unix(blockTime, 0).UTC(),
+			confirmations,
+			status,
+			gasUsed,
+			gasPrice,
+			late,
+			verified,
+		))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get payments of invoice with id %d: %w", invoiceID, err)
+	}
+
+	return payments, nil
+}
+
+func (r *sqlRepository) getTransfers(ctx context.Context, tx *sql.Tx, invoiceID domain.ID) ([]*domain.Transfer, error) {
+	rows, err := tx.QueryContext(ctx, r.query(`
+		SELECT
+			kind, tx_hash, to_address, value, nonce, max_fee, created_at,
+			status, block_number, gas_used, effective_gas_price
+		FROM transfers
+		WHERE invoice_id = ?
+		ORDER BY created_at, nonce`),
+		invoiceID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfers of invoice with id %d: %w", invoiceID, err)
+	}
+	defer rows.Close()
+
+	var transfers []*domain.Transfer
+
+	for rows.Next() {
+		var (
+			kind                             domain.TransferKind
+			rawTxHash, rawTo                 string
+			rawValue, rawMaxFee, rawGasPrice string
+			nonce, blockNumber, gasUsed      uint64
+			createdAt                        int64
+			status                           domain.TransferStatus
+		)
+
+		err := rows.Scan(
+			&kind, &rawTxHash, &rawTo, &rawValue, &nonce, &rawMaxFee, &createdAt,
+			&status, &blockNumber, &gasUsed, &rawGasPrice,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan transfer of invoice with id %d: %w", invoiceID, err)
+		}
+
+		value, err := parseBigInt(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("transfer %s has invalid value: %w", rawTxHash, err)
+		}
+
+		maxFee, err := parseBigInt(rawMaxFee)
+		if err != nil {
+			return nil, fmt.Errorf("transfer %s has invalid max fee: %w", rawTxHash, err)
+		}
+
+		gasPrice, err := parseBigInt(rawGasPrice)
+		if err != nil {
+			return nil, fmt.Errorf("transfer %s has invalid effective gas price: %w", rawTxHash, err)
+		}
+
+		transfers = append(transfers, domain.NewTransfer(
+			kind,
+			geth.HexToHash(rawTxHash),
+			geth.HexToAddress(rawTo),
+			value,
+			nonce,
+			maxFee,
+			time.Unix(createdAt, 0).UTC(),
+			status,
+			blockNumber,
+			gasUsed,
+			gasPrice,
+		))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get transfers of invoice with id %d: %w", invoiceID, err)
+	}
+
+	return transfers, nil
+}
+
+// fiatColumns are the columns of the fiat price of an invoice.
+// The currency is NULL for invoices priced in wei.
+type fiatColumns struct {
+	currency   sql.NullString
+	amount     string
+	rate       string
+	rateAt     int64
+	rateSource string
+}
+
+func newFiatColumns(price *domain.FiatPrice) fiatColumns {
+	if price == nil {
+		return fiatColumns{}
+	}
+
+	return fiatColumns{
+		currency:   sql.NullString{String: price.Currency(), Valid: true},
+		amount:     domain.FormatDecimal(price.Amount()),
+		rate:       domain.FormatDecimal(price.Rate().Rate()),
+		rateAt:     price.Rate().Timestamp().Unix(),
+		rateSource: price.Rate().Source(),
+	}
+}
+
+func (c fiatColumns) fiatPrice() (*domain.FiatPrice, error) {
+	if !c.currency.Valid {
+		return nil, nil
+	}
+
+	amount, err := domain.ParseDecimal(c.amount)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount: %w", err)
+	}
+
+	rate, err := domain.ParseDecimal(c.rate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exchange rate: %w", err)
+	}
+
+	return domain.NewFiatPrice(
+		amount,
+		domain.NewExchangeRate(c.currency.String, rate, time.Unix(c.rateAt, 0).UTC(), c.rateSource),
+	), nil
+}
+
+func parseBigInt(raw string) (*big.Int, error) {
+	value, ok := new(big.Int).SetString(raw, decimalBase)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a decimal integer", raw)
+	}
+
+	return value, nil
+}
+
+// unixOrNull stores an optional time as unix seconds.
+func unixOrNull(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
+
+func timeOrNil(unix sql.NullInt64) *time.Time {
+	if !unix.Valid {
+		return nil
+	}
+
+	t := time.Unix(unix.Int64, 0).UTC()
+
+	return &t
+}
+
+// GetCheckpoint returns the checkpoint with the hashes of the recent blocks preceding it.
+func (r *sqlRepository) GetCheckpoint(ctx context.Context) (Checkpoint, error) {
+	var checkpoint Checkpoint
+
+	err := r.inReadTx(ctx, func(tx *sql.Tx) error {
+		var rawHash string
+
+		err := tx.QueryRowContext(ctx, `SELECT number, hash FROM block_checkpoint`).Scan(&checkpoint.Number, &rawHash)
+		if errors.Is(err, sql.ErrNoRows) {
+			return common.FlagError(fmt.Errorf("checkpoint not found"), common.FlagNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get checkpoint: %w", err)
+		}
+
+		checkpoint.Hash = geth.HexToHash(rawHash)
+
+		checkpoint.Ancestors, err = r.getAncestors(ctx, tx, checkpoint)
+
+		return err
+	})
+	if err != nil {
+		return Checkpoint{}, err
+	}
+
+	return checkpoint, nil
+}
+
+func (r *sqlRepository) getAncestors(ctx context.Context, tx *sql.Tx, checkpoint Checkpoint) (map[uint64]geth.Hash, error) {
+	rows, err := tx.QueryContext(ctx, r.query(`SELECT number, hash FROM recent_blocks WHERE number < ?`), checkpoint.Number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recent blocks: %w", err)
+	}
+	defer rows.Close()
+
+	ancestors := make(map[uint64]geth.Hash)
+
+	for rows.Next() {
+		var (
+			number  uint64
+			rawHash string
+		)
+
+		if err := rows.Scan(&number, &rawHash); err != nil {
+			return nil, fmt.Errorf("failed to scan recent block: %w", err)
+		}
+
+		if checkpoint.IsAncestor(number) {
+			ancestors[number] = geth.HexToHash(rawHash)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get recent blocks: %w", err)
+	}
+
+	return ancestors, nil
+}
+
+// SaveCheckpoint saves the checkpoint and keeps its block as an ancestor of the following checkpoints.
+// Blocks after the checkpoint, which were orphaned by a chain reorganization,
+// and blocks which left the reorg window are forgotten.
+// The ancestors of the given checkpoint are ignored.
+func (r *sqlRepository) SaveCheckpoint(ctx context.Context, checkpoint Checkpoint) error {
+	return r.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, r.query(`
+			INSERT INTO block_checkpoint (id, number, hash)
+			VALUES (1, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				number = excluded.number,
+				hash   = excluded.hash`),
+			checkpoint.Number,
+			checkpoint.Hash.Hex(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to save checkpoint: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, r.query(`
+			INSERT INTO recent_blocks (number, hash)
+			VALUES (?, ?)
+			ON CONFLICT (number) DO UPDATE SET
+				hash = excluded.hash`),
+			checkpoint.Number,
+			checkpoint.Hash.Hex(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to save recent block: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, r.query(`DELETE FROM recent_blocks WHERE number > ? OR number + ? <= ?`),
+			checkpoint.Number,
+			ReorgWindowSize,
+			checkpoint.Number,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to delete old recent blocks: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// WebhookDeliveriesBatchSize limits the number of due deliveries returned at once.
+const WebhookDeliveriesBatchSize = 100
+
+// SaveWebhookDelivery inserts a new delivery and sets its ID or updates the state of an existing one.
+func (r *sqlRepository) SaveWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	if delivery.ID != 0 {
+		_, err := r.db.ExecContext(ctx, r.query(`
+			UPDATE webhook_deliveries
+			SET status = ?, attempts = ?, next_attempt_at = ?
+			WHERE id = ?`),
+			string(delivery.Status),
+			delivery.Attempts,
+			delivery.NextAttemptAt.Unix(),
+			delivery.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update webhook delivery %d: %w", delivery.ID, err)
+		}
+
+		return nil
+	}
+
+	err := r.db.QueryRowContext(ctx, r.query(`
+		INSERT INTO webhook_deliveries (
+			event_id, event_type, url, payload, status, attempts, next_attempt_at, created_at
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id`),
+		delivery.EventID,
+		delivery.EventType,
+		delivery.URL,
+		string(delivery.Payload),
+		string(delivery.Status),
+		delivery.Attempts,
+		delivery.NextAttemptAt.Unix(),
+		delivery.CreatedAt.Unix(),
+	).Scan(&delivery.ID)
+	if err != nil {
+		return fmt.Errorf("failed to save webhook delivery of event %s: %w", delivery.EventID, err)
+	}
+
+	return nil
+}
+
+// GetDueWebhookDeliveries returns pending deliveries which next attempt is due, oldest first.
+func (r *sqlRepository) GetDueWebhookDeliveries(ctx context.Context, now time.Time) ([]*WebhookDelivery, error) {
+	rows, err := r.db.QueryContext(ctx, r.query(`
+		SELECT id, event_id, event_type, url, payload, status, attempts, next_attempt_at, created_at
+		FROM webhook_deliveries
+		WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY id
+		LIMIT ?`),
+		string(WebhookDeliveryStatusPending),
+		now.Unix(),
+		WebhookDeliveriesBatchSize,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+
+	for rows.Next() {
+		var (
+			delivery                 WebhookDelivery
+			payload                  string
+			nextAttemptAt, createdAt int64
+		)
+
+		err := rows.Scan(
+			&delivery.ID, &delivery.EventID, &delivery.EventType, &delivery.URL, &payload,
+			&delivery.Status, &delivery.Attempts, &nextAttemptAt, &createdAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+
+		delivery.Payload = []byte(payload)
+		delivery.NextAttemptAt = time.Unix(nextAttemptAt, 0).UTC()
+		delivery.CreatedAt = time.Unix(createdAt, 0).UTC()
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get due webhook deliveries: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+func (r *sqlRepository) SaveWebhookAttempt(ctx context.Context, attempt WebhookAttempt) error {
+	_, err := r.db.ExecContext(ctx, r.query(`
+		INSERT INTO webhook_attempts (delivery_id, attempt, status_code, error, created_at)
+		VALUES (?, ?, ?, ?, ?)`),
+		attempt.DeliveryID,
+		attempt.Attempt,
+		attempt.StatusCode,
+		attempt.Error,
+		attempt.CreatedAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save attempt %d of webhook delivery %d: %w", attempt.Attempt, attempt.DeliveryID, err)
+	}
+
+	return nil
+}
+
+// SaveDiscrepancy inserts a new discrepancy and sets its ID or updates an existing one.
+func (r *sqlRepository) SaveDiscrepancy(ctx context.Context, discrepancy *domain.Discrepancy) error {
+	if discrepancy.ID() != 0 {
+		_, err := r.db.ExecContext(ctx, r.query(`
+			UPDATE discrepancies
+			SET expected = ?, actual = ?, block_number = ?, status = ?, resolution = ?, resolved_at = ?
+			WHERE id = ?`),
+			discrepancy.Expected().String(),
+			discrepancy.Actual().String(),
+			discrepancy.BlockNumber(),
+			string(discrepancy.Status()),
+			discrepancy.Resolution(),
+			unixOrNull(discrepancy.ResolvedAt()),
+			discrepancy.ID(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update discrepancy %d: %w", discrepancy.ID(), err)
+		}
+
+		return nil
+	}
+
+	var id uint64
+
+	err := r.db.QueryRowContext(ctx, r.query(`
+		INSERT INTO discrepancies (
+			invoice_id, address, expected, actual, block_number, status, resolution, created_at, resolved_at
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id`),
+		discrepancy.InvoiceID(),
+		discrepancy.Address().Hex(),
+		discrepancy.Expected().String(),
+		discrepancy.Actual().String(),
+		discrepancy.BlockNumber(),
+		string(discrepancy.Status()),
+		discrepancy.Resolution(),
+		discrepancy.CreatedAt().Unix(),
+		unixOrNull(discrepancy.ResolvedAt()),
+	).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("failed to save discrepancy of invoice with id %d: %w", discrepancy.InvoiceID(), err)
+	}
+
+	discrepancy.SetID(id)
+
+	return nil
+}
+
+func (r *sqlRepository) GetDiscrepancy(ctx context.Context, id uint64) (*domain.Discrepancy, error) {
+	discrepancies, err := r.getDiscrepancies(ctx, `WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(discrepancies) == 0 {
+		return nil, common.FlagError(fmt.Errorf("discrepancy with id %d not found", id), common.FlagNotFound)
+	}
+
+	return discrepancies[0], nil
+}
+
+// GetDiscrepancies returns discrepancies with the status, or all of them if the status is empty, oldest first.
+func (r *sqlRepository) GetDiscrepancies(ctx context.Context, status domain.DiscrepancyStatus) ([]*domain.Discrepancy, error) {
+	if status == "" {
+		return r.getDiscrepancies(ctx, "")
+	}
+
+	return r.getDiscrepancies(ctx, `WHERE status = ?`, string(status))
+}
+
+func (r *sqlRepository) getDiscrepancies(ctx context.Context, where string, args ...any) ([]*domain.Discrepancy, error) {
+	rows, err := r.db.QueryContext(ctx, r.query(`
+		SELECT
+			id, invoice_id, address, expected, actual, block_number, status, resolution, created_at, resolved_at
+		FROM discrepancies `+where+`
+		ORDER BY id`),
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get discrepancies: %w", err)
+	}
+	defer rows.Close()
+
+	var discrepancies []*domain.Discrepancy
+
+	for rows.Next() {
+		var (
+			id                     uint64
+			invoiceID              domain.ID
+			rawAddress             string
+			rawExpected, rawActual string
+			blockNumber            uint64
+			status                 domain.DiscrepancyStatus
+			resolution             string
+			createdAt              int64
+			resolvedAt             sql.NullInt64
+		)
+
+		err := rows.Scan(
+			&id, &invoiceID, &rawAddress, &rawExpected, &rawActual,
+			&blockNumber, &status, &resolution, &createdAt, &resolvedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan discrepancy: %w", err)
+		}
+
+		expected, err := parseBigInt(rawExpected)
+		if err != nil {
+			return nil, fmt.Errorf("discrepancy %d has invalid expected balance: %w", id, err)
+		}
+
+		actual, err := parseBigInt(rawActual)
+		if err != nil {
+			return nil, fmt.Errorf("discrepancy %d has invalid actual balance: %w", id, err)
+		}
+
+		discrepancies = append(discrepancies, domain.NewDiscrepancy(
+			id,
+			invoiceID,
+			geth.HexToAddress(rawAddress),
+			expected,
+			actual,
+			blockNumber,
+			status,
+			resolution,
+			time.Unix(createdAt, 0).UTC(),
+			timeOrNil(resolvedAt),
+		))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get discrepancies: %w", err)
+	}
+
+	return discrepancies, nil
+}
+
+func (r *sqlRepository) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if err := f(tx); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// inReadTx runs f in a read-only transaction, so all its queries see the same snapshot of the database.
+// Postgres needs the repeatable read isolation for that, SQLite transactions are serializable anyway.
+func (r *sqlRepository) inReadTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	// Nothing is written, so the transaction is rolled back instead of committed.
+	defer func() { _ = tx.Rollback() }()
+
+	return f(tx)
+}
+
+// query adapts a query written with "?" placeholders to the dialect.
+func (r *sqlRepository) query(query string) string {
+	if !r.dialect.numberedPlaceholders {
+		return query
+	}
+
+	var (
+		builder strings.Builder
+		number  int
+	)
+
+	for _, char := range query {
+		if char != '?' {
+			builder.WriteRune(char)
+
+			continue
+		}
+
+		number++
+		builder.WriteString("$" + strconv.Itoa(number))
+	}
+
+	return builder.String()
+}
+
+func (r *sqlRepository) migrate(ctx context.Context) error {
+	if _, err := r.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY
+		)`,
+	); err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var applied int
+	if err := r.db.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`,
+	).Scan(&applied); err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	migrations := r.dialect.migrations
+	for version := applied + 1; version <= len(migrations); version++ {
+		err := r.inTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, migrations[version-1]); err != nil {
+				return err
+			}
+
+			_, err := tx.ExecContext(ctx, r.query(`INSERT INTO schema_migrations (version) VALUES (?)`), version)
+
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+	}
+
+	return nil
+}
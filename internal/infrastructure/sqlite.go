@@ -0,0 +1,210 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+const (
+	SQLiteDriverName  = "sqlite"
+	SQLiteBusyTimeout = 5000
+)
+
+var sqliteDialect = sqlDialect{
+	numberedPlaceholders: false,
+	migrations: []string{
+		`CREATE TABLE invoice_ids (
+			id INTEGER PRIMARY KEY AUTOINCREMENT
+		)`,
+		`CREATE TABLE invoices (
+			id      INTEGER PRIMARY KEY,
+			price   TEXT    NOT NULL,
+			balance TEXT    NOT NULL,
+			address TEXT    NOT NULL UNIQUE,
+			status  TEXT    NOT NULL
+		)`,
+		`CREATE TABLE block_checkpoint (
+			id     INTEGER PRIMARY KEY CHECK (id = 1),
+			number INTEGER NOT NULL,
+			hash   TEXT    NOT NULL
+		)`,
+		`ALTER TABLE invoices ADD COLUMN required_confirmations INTEGER NOT NULL DEFAULT 1`,
+		`CREATE TABLE deposits (
+			invoice_id    INTEGER NOT NULL REFERENCES invoices (id),
+			tx_hash       TEXT    NOT NULL,
+			block_number  INTEGER NOT NULL,
+			block_hash    TEXT    NOT NULL,
+			value         TEXT    NOT NULL,
+			confirmations INTEGER NOT NULL,
+			status        TEXT    NOT NULL,
+			PRIMARY KEY (invoice_id, tx_hash)
+		)`,
+		`CREATE INDEX deposits_status_idx ON deposits (status)`,
+		`CREATE INDEX deposits_block_hash_idx ON deposits (block_hash)`,
+		`ALTER TABLE deposits ADD COLUMN gas_used INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE deposits ADD COLUMN effective_gas_price TEXT NOT NULL DEFAULT '0'`,
+		`ALTER TABLE deposits RENAME TO payments`,
+		`DROP INDEX deposits_status_idx`,
+		`DROP INDEX deposits_block_hash_idx`,
+		`CREATE INDEX payments_status_idx ON payments (status)`,
+		`CREATE INDEX payments_block_hash_idx ON payments (block_hash)`,
+		`ALTER TABLE payments ADD COLUMN sender TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE payments ADD COLUMN block_time INTEGER NOT NULL DEFAULT 0`,
+		`CREATE UNIQUE INDEX payments_tx_hash_idx ON payments (tx_hash)`,
+		`ALTER TABLE invoices ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE invoices ADD COLUMN expires_at INTEGER`,
+		`CREATE INDEX invoices_expires_at_idx ON invoices (status, expires_at)`,
+		`ALTER TABLE payments ADD COLUMN late BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE invoices ADD COLUMN tolerance TEXT NOT NULL DEFAULT '0'`,
+		`CREATE TABLE webhook_deliveries (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			event_id        TEXT    NOT NULL,
+			event_type      TEXT    NOT NULL,
+			url             TEXT    NOT NULL,
+			payload         TEXT    NOT NULL,
+			status          TEXT    NOT NULL,
+			attempts        INTEGER NOT NULL,
+			next_attempt_at INTEGER NOT NULL,
+			created_at      INTEGER NOT NULL
+		)`,
+		`CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (status, next_attempt_at)`,
+		`CREATE TABLE webhook_attempts (
+			delivery_id INTEGER NOT NULL REFERENCES webhook_deliveries (id),
+			attempt     INTEGER NOT NULL,
+			status_code INTEGER NOT NULL,
+			error       TEXT    NOT NULL,
+			created_at  INTEGER NOT NULL,
+			PRIMARY KEY (delivery_id, attempt)
+		)`,
+		`CREATE TABLE transfers (
+			invoice_id          INTEGER NOT NULL REFERENCES invoices (id),
+			kind                TEXT    NOT NULL,
+			tx_hash             TEXT    NOT NULL UNIQUE,
+			to_address          TEXT    NOT NULL,
+			value               TEXT    NOT NULL,
+			nonce               INTEGER NOT NULL,
+			max_fee             TEXT    NOT NULL,
+			created_at          INTEGER NOT NULL,
+			status              TEXT    NOT NULL,
+			block_number        INTEGER NOT NULL,
+			gas_used            INTEGER NOT NULL,
+			effective_gas_price TEXT    NOT NULL
+		)`,
+		`CREATE INDEX transfers_invoice_id_idx ON transfers (invoice_id)`,
+		`CREATE INDEX transfers_status_idx ON transfers (status)`,
+		`ALTER TABLE invoices ADD COLUMN token_address TEXT`,
+		`ALTER TABLE invoices ADD COLUMN token_symbol TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE invoices ADD COLUMN token_decimals INTEGER NOT NULL DEFAULT 0`,
+		// SQLite can't change the primary key, so the payments table is rebuilt
+		// to allow several payments made by one transaction.
+		`CREATE TABLE payments_v2 (
+			invoice_id          INTEGER NOT NULL REFERENCES invoices (id),
+			tx_hash             TEXT    NOT NULL,
+			kind                TEXT    NOT NULL,
+			payment_index       INTEGER NOT NULL,
+			block_number        INTEGER NOT NULL,
+			block_hash          TEXT    NOT NULL,
+			sender              TEXT    NOT NULL,
+			value               TEXT    NOT NULL,
+			block_time          INTEGER NOT NULL,
+			confirmations       INTEGER NOT NULL,
+			status              TEXT    NOT NULL,
+			gas_used            INTEGER NOT NULL,
+			effective_gas_price TEXT    NOT NULL,
+			late                BOOLEAN NOT NULL,
+			PRIMARY KEY (invoice_id, tx_hash, kind, payment_index)
+		)`,
+		`INSERT INTO payments_v2 (
+			invoice_id, tx_hash, kind, payment_index, block_number, block_hash, sender, value, block_time,
+			confirmations, status, gas_used, effective_gas_price, late
+		)
+		SELECT
+			invoice_id, tx_hash, 'transaction', 0, block_number, block_hash, sender, value, block_time,
+			confirmations, status, gas_used, effective_gas_price, late
+		FROM payments`,
+		`DROP TABLE payments`,
+		`ALTER TABLE payments_v2 RENAME TO payments`,
+		`CREATE INDEX payments_status_idx ON payments (status)`,
+		`CREATE INDEX payments_block_hash_idx ON payments (block_hash)`,
+		`CREATE UNIQUE INDEX payments_source_idx ON payments (tx_hash, kind, payment_index)`,
+		`ALTER TABLE invoices ADD COLUMN fiat_currency TEXT`,
+		`ALTER TABLE invoices ADD COLUMN fiat_amount TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE invoices ADD COLUMN exchange_rate TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE invoices ADD COLUMN exchange_rate_at INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE invoices ADD COLUMN exchange_rate_source TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE payments ADD COLUMN verified BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE TABLE discrepancies (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			invoice_id   INTEGER NOT NULL REFERENCES invoices (id),
+			address      TEXT    NOT NULL,
+			expected     TEXT    NOT NULL,
+			actual       TEXT    NOT NULL,
+			block_number INTEGER NOT NULL,
+			status       TEXT    NOT NULL,
+			resolution   TEXT    NOT NULL,
+			created_at   INTEGER NOT NULL,
+			resolved_at  INTEGER
+		)`,
+		`CREATE INDEX discrepancies_status_idx ON discrepancies (status)`,
+		`ALTER TABLE invoices ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		`CREATE TABLE recent_blocks (
+			number INTEGER PRIMARY KEY,
+			hash   TEXT    NOT NULL
+		)`,
+	},
+}
+
+// SQLiteRepository is a persistent invoice repository.
+// Invoice ids are allocated from an AUTOINCREMENT sequence,
+// so they are never reused, even after a restart.
+type SQLiteRepository struct {
+	*sqlRepository
+}
+
+func NewSQLiteRepository(ctx context.Context, path string) (*SQLiteRepository, error) {
+	dsn := fmt.Sprintf(
+		"file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)",
+		path, SQLiteBusyTimeout,
+	)
+
+	db, err := sql.Open(SQLiteDriverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database %s: %w", path, err)
+	}
+
+	// SQLite allows only one writer at a time.
+	db.SetMaxOpenConns(1)
+
+	repository, err := newSQLRepository(ctx, db, sqliteDialect)
+	if err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+
+	return &SQLiteRepository{sqlRepository: repository}, nil
+}
+
+func (r *SQLiteRepository) GetID(ctx context.Context) (domain.ID, error) {
+	result, err := r.db.ExecContext(ctx, `INSERT INTO invoice_ids DEFAULT VALUES`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate invoice id: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get allocated invoice id: %w", err)
+	}
+
+	// AUTOINCREMENT remembers the largest id in sqlite_sequence,
+	// so previous rows are not needed to keep ids monotonic.
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM invoice_ids WHERE id < ?`, id); err != nil {
+		return 0, fmt.Errorf("failed to clean up allocated invoice ids: %w", err)
+	}
+
+	return domain.ID(id), nil
+}
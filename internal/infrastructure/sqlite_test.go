@@ -0,0 +1,415 @@
+package infrastructure_test
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestSQLiteRepository_GetIDSurvivesRestart(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "invoices.db")
+
+	sut, err := infrastructure.NewSQLiteRepository(ctx, path)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := sut.GetID(ctx)
+		require.NoError(t, err)
+	}
+	require.NoError(t, sut.Close())
+
+	sut, err = infrastructure.NewSQLiteRepository(ctx, path)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, sut.Close()) })
+
+	id, err := sut.GetID(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, domain.ID(4), id)
+}
+
+func TestSQLiteRepository_Save(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sut, err := infrastructure.NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "invoices.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, sut.Close()) })
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	createdAt := time.Unix(1, 0).UTC()
+	expiresAt := time.Unix(100, 0).UTC()
+	invoice := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 2, createdAt, &expiresAt, nil, nil,
+	)
+	require.NoError(t, sut.Save(ctx, invoice))
+
+	overdue, err := sut.GetOverdue(ctx, expiresAt)
+	require.NoError(t, err)
+	assert.Empty(t, overdue)
+
+	overdue, err = sut.GetOverdue(ctx, expiresAt.Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, []*domain.Invoice{invoice}, overdue)
+
+	invoice.Detect(domain.NewDetectedPayment(
+		geth.Hash{1}, domain.PaymentKindTransaction, 0, 10, geth.Hash{2},
+		address, big.NewInt(2), time.Unix(10, 0).UTC(), 21_000, big.NewInt(1), true,
+	))
+	require.NoError(t, sut.Save(ctx, invoice))
+
+	unconfirmed, err := sut.GetUnconfirmed(ctx)
+	require.NoError(t, err)
+	require.Len(t, unconfirmed, 1)
+	assert.Equal(t, domain.InvoiceStatusDetected, unconfirmed[0].Status())
+	assert.Equal(t, invoice.Payments(), unconfirmed[0].Payments())
+
+	invoice.UpdateConfirmations(11)
+	require.NoError(t, sut.Save(ctx, invoice))
+
+	byID, err := sut.GetByID(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, domain.InvoiceStatusPaid, byID.Status())
+	assert.Equal(t, big.NewInt(2), byID.Balance())
+
+	unconfirmed, err = sut.GetUnconfirmed(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, unconfirmed)
+
+	byAddress, err := sut.GetByAddress(ctx, &address)
+	require.NoError(t, err)
+	assert.Equal(t, byID, byAddress)
+
+	_, err = sut.GetByID(ctx, 2)
+	assert.True(t, common.IsFlaggedError(err, common.FlagNotFound))
+}
+
+func TestSQLiteRepository_RejectsStaleSave(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sut, err := infrastructure.NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "invoices.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, sut.Close()) })
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	expiresAt := time.Unix(100, 0).UTC()
+	invoice := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 2, time.Time{}, &expiresAt, nil, nil,
+	)
+	require.NoError(t, sut.Save(ctx, invoice))
+
+	detecting, err := sut.GetByID(ctx, 1)
+	require.NoError(t, err)
+	expiring, err := sut.GetByID(ctx, 1)
+	require.NoError(t, err)
+
+	detecting.Detect(domain.NewDetectedPayment(
+		geth.Hash{1}, domain.PaymentKindTransaction, 0, 10, geth.Hash{2},
+		address, big.NewInt(2), time.Unix(10, 0).UTC(), 21_000, big.NewInt(1), true,
+	))
+	require.NoError(t, sut.Save(ctx, detecting))
+
+	require.True(t, expiring.Expire(expiresAt.Add(time.Second)))
+	err = sut.Save(ctx, expiring)
+	assert.ErrorIs(t, err, domain.ErrConcurrentUpdate)
+	assert.True(t, common.IsFlaggedError(err, common.FlagConflict))
+
+	saved, err := sut.GetByID(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, domain.InvoiceStatusDetected, saved.Status())
+	assert.Len(t, saved.Payments(), 1)
+	assert.Equal(t, detecting.Version(), saved.Version())
+
+	// A new invoice can't overwrite a saved one either.
+	duplicate := domain.NewInvoice(
+		1, big.NewInt(3), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 2, time.Time{}, nil, nil, nil,
+	)
+	assert.ErrorIs(t, sut.Save(ctx, duplicate), domain.ErrConcurrentUpdate)
+}
+func TestSQLiteRepository_Checkpoint(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sut, err := infrastructure.NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "invoices.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, sut.Close()) })
+
+	_, err = sut.GetCheckpoint(ctx)
+	assert.True(t, common.IsFlaggedError(err, common.FlagNotFound))
+
+	hash := func(number uint64, fork int64) geth.Hash {
+		return geth.BigToHash(new(big.Int).SetUint64(number<<8 + uint64(fork)))
+	}
+
+	ancestors := make(map[uint64]geth.Hash)
+	for number := uint64(1); number <= infrastructure.ReorgWindowSize+2; number++ {
+		checkpoint := infrastructure.Checkpoint{
+			Number:    number,
+			Hash:      hash(number, 0),
+			Ancestors: nil,
+		}
+		require.NoError(t, sut.SaveCheckpoint(ctx, checkpoint))
+
+		saved, err := sut.GetCheckpoint(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, checkpoint.Number, saved.Number)
+		assert.Equal(t, checkpoint.Hash, saved.Hash)
+		assert.Equal(t, ancestors, saved.Ancestors)
+
+		ancestors[number] = checkpoint.Hash
+		delete(ancestors, number+1-infrastructure.ReorgWindowSize)
+	}
+
+	// The chain is reorganized from the block 100, so the orphaned blocks are forgotten.
+	reorganized := infrastructure.Checkpoint{Number: 100, Hash: hash(100, 1), Ancestors: nil}
+	require.NoError(t, sut.SaveCheckpoint(ctx, reorganized))
+
+	saved, err := sut.GetCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Len(t, saved.Ancestors, 100-3)
+	assert.Equal(t, hash(99, 0), saved.Ancestors[99])
+	assert.NotContains(t, saved.Ancestors, uint64(2))
+
+	require.NoError(t, sut.SaveCheckpoint(ctx, infrastructure.Checkpoint{Number: 101, Hash: hash(101, 1), Ancestors: nil}))
+
+	saved, err = sut.GetCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, hash(100, 1), saved.Ancestors[100])
+}
+
+func TestSQLiteRepository_WebhookDeliveries(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sut, err := infrastructure.NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "invoices.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, sut.Close()) })
+
+	now := time.Unix(100, 0).UTC()
+	delivery := &infrastructure.WebhookDelivery{
+		EventID:       "event",
+		EventType:     "invoice.paid",
+		URL:           "http://localhost/webhooks",
+		Payload:       []byte(`{}`),
+		Status:        infrastructure.WebhookDeliveryStatusPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+	require.NoError(t, sut.SaveWebhookDelivery(ctx, delivery))
+	assert.NotZero(t, delivery.ID)
+
+	due, err := sut.GetDueWebhookDeliveries(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, []*infrastructure.WebhookDelivery{delivery}, due)
+
+	delivery.Attempts++
+	delivery.NextAttemptAt = now.Add(time.Minute)
+	require.NoError(t, sut.SaveWebhookAttempt(ctx, infrastructure.WebhookAttempt{
+		DeliveryID: delivery.ID,
+		Attempt:    delivery.Attempts,
+		StatusCode: 500,
+		Error:      "webhook endpoint responded with status 500",
+		CreatedAt:  now,
+	}))
+	require.NoError(t, sut.SaveWebhookDelivery(ctx, delivery))
+
+	due, err = sut.GetDueWebhookDeliveries(ctx, now)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+
+	due, err = sut.GetDueWebhookDeliveries(ctx, delivery.NextAttemptAt)
+	require.NoError(t, err)
+	assert.Equal(t, []*infrastructure.WebhookDelivery{delivery}, due)
+}
+
+func TestSQLiteRepository_Transfers(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sut, err := infrastructure.NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "invoices.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, sut.Close()) })
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	invoice := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(2), &address, nil, nil, domain.InvoiceStatusPaid, big.NewInt(0), 1,
+		time.Unix(1, 0).UTC(), nil, nil, nil,
+	)
+	require.NoError(t, sut.Save(ctx, invoice))
+
+	unswept, err := sut.GetUnswept(ctx)
+	require.NoError(t, err)
+	assert.Len(t, unswept, 1)
+
+	transfer := domain.NewPendingTransfer(
+		domain.TransferKindSweep,
+		geth.Hash{1},
+		geth.HexToAddress("0x2B5AD5c4795c026514f8317c7a215E218DcCD6cF"),
+		big.NewInt(1),
+		0,
+		big.NewInt(1),
+		time.Unix(2, 0).UTC(),
+	)
+	require.NoError(t, invoice.AddTransfer(transfer))
+	require.NoError(t, sut.Save(ctx, invoice))
+
+	unswept, err = sut.GetUnswept(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, unswept)
+
+	pending, err := sut.GetWithPendingTransfers(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, invoice.Transfers(), pending[0].Transfers())
+
+	transfer.Confirm(10, 21_000, big.NewInt(1))
+	require.NoError(t, sut.Save(ctx, invoice))
+
+	pending, err = sut.GetWithPendingTransfers(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	byID, err := sut.GetByID(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, transfer, byID.Sweep())
+}
+
+func TestSQLiteRepository_TokenInvoices(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sut, err := infrastructure.NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "invoices.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, sut.Close()) })
+
+	token := domain.NewToken(geth.HexToAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"), "USDC", 6)
+	first := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	second := geth.HexToAddress("0x28a8746e75304c0780E011BEd21C72cD78cd535E")
+
+	// One transaction pays both invoices, the first one twice.
+	transfer := func(logIndex uint64, to geth.Address) *domain.Payment {
+		return domain.NewDetectedPayment(
+			geth.Hash{1}, domain.PaymentKindTokenTransfer, logIndex, 10, geth.Hash{2},
+			to, big.NewInt(1), time.Unix(10, 0).UTC(), 50_000, big.NewInt(1), false,
+		)
+	}
+
+	firstInvoice := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(0), &first, token, nil, domain.InvoiceStatusPending, big.NewInt(0), 1,
+		time.Unix(1, 0).UTC(), nil, nil, nil,
+	)
+	firstInvoice.Detect(transfer(0, first))
+	firstInvoice.Detect(transfer(1, first))
+	require.NoError(t, sut.Save(ctx, firstInvoice))
+
+	secondInvoice := domain.NewInvoice(
+		2, big.NewInt(2), big.NewInt(0), &second, token, nil, domain.InvoiceStatusPending, big.NewInt(0), 1,
+		time.Unix(1, 0).UTC(), nil, nil, nil,
+	)
+	secondInvoice.Detect(transfer(2, second))
+	require.NoError(t, sut.Save(ctx, secondInvoice))
+
+	for _, invoice := range []*domain.Invoice{firstInvoice, secondInvoice} {
+		saved, err := sut.GetByID(ctx, invoice.ID())
+		require.NoError(t, err)
+		assert.Equal(t, invoice, saved)
+	}
+
+	unswept, err := sut.GetUnswept(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, unswept, "token invoices can't be swept")
+}
+
+func TestSQLiteRepository_FiatPrice(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sut, err := infrastructure.NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "invoices.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, sut.Close()) })
+
+	rate := domain.NewExchangeRate(
+		"USD", big.NewRat(301245, 100), time.Unix(1, 0).UTC(), "chainlink:0x5f4eC3Df9cbd43714FE2740f5E3616155c5b8419",
+	)
+	fiat := domain.NewFiatPrice(big.NewRat(1999, 100), rate)
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	invoice := domain.NewInvoice(
+		1, rate.ToWEI(fiat.Amount()), big.NewInt(0), &address, nil, fiat, domain.InvoiceStatusPending, big.NewInt(0), 1,
+		time.Unix(1, 0).UTC(), nil, nil, nil,
+	)
+	require.NoError(t, sut.Save(ctx, invoice))
+
+	saved, err := sut.GetByID(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, invoice, saved)
+}
+
+func TestSQLiteRepository_Discrepancies(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sut, err := infrastructure.NewSQLiteRepository(ctx, filepath.Join(t.TempDir(), "invoices.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, sut.Close()) })
+
+	address := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+	open := domain.NewInvoice(
+		1, big.NewInt(2), big.NewInt(0), &address, nil, nil, domain.InvoiceStatusPending, big.NewInt(0), 1, time.Unix(1, 0).UTC(), nil, nil, nil,
+	)
+	require.NoError(t, sut.Save(ctx, open))
+
+	expiredAddress := geth.HexToAddress("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	expired := domain.NewInvoice(
+		2, big.NewInt(2), big.NewInt(0), &expiredAddress, nil, nil, domain.InvoiceStatusExpired, big.NewInt(0), 1, time.Unix(1, 0).UTC(), nil, nil, nil,
+	)
+	require.NoError(t, sut.Save(ctx, expired))
+
+	invoices, err := sut.GetOpen(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []*domain.Invoice{open}, invoices)
+
+	discrepancy := domain.NewOpenDiscrepancy(open.ID(), address, big.NewInt(2), big.NewInt(1), 10, time.Unix(100, 0).UTC())
+	require.NoError(t, sut.SaveDiscrepancy(ctx, discrepancy))
+	assert.NotZero(t, discrepancy.ID())
+
+	discrepancies, err := sut.GetDiscrepancies(ctx, domain.DiscrepancyStatusOpen)
+	require.NoError(t, err)
+	assert.Equal(t, []*domain.Discrepancy{discrepancy}, discrepancies)
+
+	require.NoError(t, discrepancy.Resolve("refunded by the payer", time.Unix(200, 0).UTC()))
+	require.NoError(t, sut.SaveDiscrepancy(ctx, discrepancy))
+
+	discrepancies, err = sut.GetDiscrepancies(ctx, domain.DiscrepancyStatusOpen)
+	require.NoError(t, err)
+	assert.Empty(t, discrepancies)
+
+	saved, err := sut.GetDiscrepancy(ctx, discrepancy.ID())
+	require.NoError(t, err)
+	assert.Equal(t, discrepancy, saved)
+
+	_, err = sut.GetDiscrepancy(ctx, discrepancy.ID()+1)
+	assert.True(t, common.IsFlaggedError(err, common.FlagNotFound))
+}
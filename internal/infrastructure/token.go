@@ -0,0 +1,192 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+const (
+	// transferTopics is the number of topics of the ERC-20 Transfer event:
+	// the signature, the sender and the recipient. ERC-721 also indexes the token id.
+	transferTopics = 3
+	wordLength     = 32
+	maxDecimals    = 255
+)
+
+var (
+	// TransferEventTopic is the signature of the ERC-20 Transfer(address,address,uint256) event.
+	TransferEventTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
+	decimalsSelector = crypto.Keccak256([]byte("decimals()"))[:4]
+	symbolSelector   = crypto.Keccak256([]byte("symbol()"))[:4]
+	balanceSelector  = crypto.Keccak256([]byte("balanceOf(address)"))[:4]
+)
+
+// TokenTransfer is an ERC-20 Transfer event.
+type TokenTransfer struct {
+	BlockNumber uint64
+	TxHash      geth.Hash
+	LogIndex    uint64
+	Token       geth.Address
+	From        geth.Address
+	To          geth.Address
+	Value       *big.Int
+}
+
+// GetToken reads the symbol and decimals of the ERC-20 token contract.
+func (e *Ethereum) GetToken(ctx context.Context, address geth.Address) (*domain.Token, error) {
+	code, err := e.client().CodeAt(ctx, address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get code of %s: %w", address, err)
+	}
+	if len(code) == 0 {
+		return nil, common.FlagError(fmt.Errorf("token contract %s not found", address), common.FlagNotFound)
+	}
+
+	rawDecimals, err := e.callContract(ctx, address, decimalsSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	decimals, err := decodeDecimals(rawDecimals)
+	if err != nil {
+		return nil, fmt.Errorf("token %s: %w", address, err)
+	}
+
+	rawSymbol, err := e.callContract(ctx, address, symbolSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	symbol, err := decodeSymbol(rawSymbol)
+	if err != nil {
+		return nil, fmt.Errorf("token %s: %w", address, err)
+	}
+
+	return domain.NewToken(address, symbol, decimals), nil
+}
+
+// GetTokenTransfers returns ERC-20 Transfer events emitted in the block.
+// Logs of other events with the same signature, like ERC-721 transfers, are skipped.
+func (e *Ethereum) GetTokenTransfers(ctx context.Context, blockHash geth.Hash) ([]TokenTransfer, error) {
+	logs, err := e.client().FilterLogs(ctx, ethereum.FilterQuery{
+		BlockHash: &blockHash,
+		Topics:    [][]geth.Hash{{TransferEventTopic}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer logs of block %s: %w", blockHash, err)
+	}
+
+	transfers := make([]TokenTransfer, 0, len(logs))
+
+	for _, log := range logs {
+		if transfer, ok := parseTokenTransfer(log); ok {
+			transfers = append(transfers, transfer)
+		}
+	}
+
+	return transfers, nil
+}
+
+func parseTokenTransfer(log types.Log) (TokenTransfer, bool) {
+	if len(log.Topics) != transferTopics || log.Topics[0] != TransferEventTopic || len(log.Data) != wordLength {
+		return TokenTransfer{}, false
+	}
+
+	return TokenTransfer{
+		BlockNumber: log.BlockNumber,
+		TxHash:      log.TxHash,
+		LogIndex:    uint64(log.Index),
+		Token:       log.Address,
+		From:        geth.BytesToAddress(log.Topics[1].Bytes()),
+		To:          geth.BytesToAddress(log.Topics[2].Bytes()),
+		Value:       new(big.Int).SetBytes(log.Data),
+	}, true
+}
+
+func (e *Ethereum) getTokenBalance(
+	ctx context.Context,
+	token geth.Address,
+	owner geth.Address,
+	blockNumber *big.Int,
+) (*big.Int, error) {
+	data := append(append([]byte{}, balanceSelector...), geth.LeftPadBytes(owner.Bytes(), wordLength)...)
+
+	result, err := e.callContractAt(ctx, token, data, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) != wordLength {
+		return nil, fmt.Errorf("token %s: unexpected balance length %d", token, len(result))
+	}
+
+	return new(big.Int).SetBytes(result), nil
+}
+
+func (e *Ethereum) callContract(ctx context.Context, address geth.Address, data []byte) ([]byte, error) {
+	return e.callContractAt(ctx, address, data, nil)
+}
+
+// callContractAt calls the contract at the block, or at the head block if the number is nil.
+func (e *Ethereum) callContractAt(
+	ctx context.Context,
+	address geth.Address,
+	data []byte,
+	blockNumber *big.Int,
+) ([]byte, error) {
+	result, err := e.client().CallContract(ctx, ethereum.CallMsg{To: &address, Data: data}, blockNumber)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call contract %s: %w", address, err)
+	}
+
+	return result, nil
+}
+
+func decodeDecimals(data []byte) (uint8, error) {
+	if len(data) != wordLength {
+		return 0, fmt.Errorf("unexpected decimals length %d", len(data))
+	}
+
+	decimals := new(big.Int).SetBytes(data)
+	if !decimals.IsUint64() || decimals.Uint64() > maxDecimals {
+		return 0, fmt.Errorf("decimals %s are out of range", decimals)
+	}
+
+	return uint8(decimals.Uint64()), nil
+}
+
+// decodeSymbol decodes the symbol returned as a string
+// or as bytes32 by some early tokens.
+func decodeSymbol(data []byte) (string, error) {
+	if len(data) == wordLength {
+		return string(bytes.TrimRight(data, "\x00")), nil
+	}
+
+	stringType, err := abi.NewType("string", "", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create string type: %w", err)
+	}
+
+	values, err := abi.Arguments{{Type: stringType}}.Unpack(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode symbol: %w", err)
+	}
+
+	symbol, ok := values[0].(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected symbol type %T", values[0])
+	}
+
+	return symbol, nil
+}
@@ -0,0 +1,125 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Call types of the callTracer which transfer ether to the recipient.
+const (
+	callTypeCall         = "CALL"
+	callTypeSelfDestruct = "SELFDESTRUCT"
+)
+
+// InternalTransfer is ether sent by a contract while executing a transaction.
+type InternalTransfer struct {
+	TxHash geth.Hash
+	// Index is the position of the call in the trace of the transaction in depth-first order.
+	// The transaction itself has index zero and is never reported.
+	Index uint64
+	From  geth.Address
+	To    geth.Address
+	Value *big.Int
+}
+
+type txTrace struct {
+	TxHash geth.Hash `json:"txHash"`
+	Result callFrame `json:"result"`
+}
+
+// callFrame is a call traced by the callTracer of geth.
+type callFrame struct {
+	Type  string        `json:"type"`
+	From  geth.Address  `json:"from"`
+	To    *geth.Address `json:"to"`
+	Value *hexutil.Big  `json:"value"`
+	Error string        `json:"error"`
+	Calls []callFrame   `json:"calls"`
+}
+
+// GetInternalTransfers traces the block with the callTracer and returns ether transferred by internal calls.
+// Calls which failed or were reverted together with their parent are skipped,
+// as well as delegate and static calls, which do not transfer ether.
+// The endpoint must support the debug namespace.
+func (e *Ethereum) GetInternalTransfers(ctx context.Context, block *types.Block) ([]InternalTransfer, error) {
+	var traces []txTrace
+
+	err := e.client().Client().CallContext(
+		ctx, &traces, "debug_traceBlockByHash", block.Hash(), map[string]any{"tracer": "callTracer"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to trace block %s: %w", block.Hash(), err)
+	}
+
+	if len(traces) != len(block.Transactions()) {
+		return nil, fmt.Errorf(
+			"got %d traces of block %s with %d transactions", len(traces), block.Hash(), len(block.Transactions()),
+		)
+	}
+
+	var transfers []InternalTransfer
+
+	for i, trace := range traces {
+		if trace.Result.Error != "" {
+			continue
+		}
+
+		// Traces are in the order of transactions, some clients do not return their hashes.
+		txHash := block.Transactions()[i].Hash()
+		if trace.TxHash != (geth.Hash{}) && trace.TxHash != txHash {
+			return nil, fmt.Errorf("trace %d of block %s is of transaction %s instead of %s", i, block.Hash(), trace.TxHash, txHash)
+		}
+
+		index := uint64(0)
+		transfers = collectInternalTransfers(transfers, txHash, trace.Result.Calls, &index)
+	}
+
+	return transfers, nil
+}
+
+func collectInternalTransfers(
+	transfers []InternalTransfer,
+	txHash geth.Hash,
+	calls []callFrame,
+	index *uint64,
+) []InternalTransfer {
+	for _, call := range calls {
+		*index++
+
+		if call.Error != "" {
+			// The whole subtree is reverted, but its calls still take positions in the trace.
+			*index += countCalls(call.Calls)
+
+			continue
+		}
+
+		isTransfer := call.Type == callTypeCall || call.Type == callTypeSelfDestruct
+		if isTransfer && call.To != nil && call.Value != nil && call.Value.ToInt().Sign() > 0 {
+			transfers = append(transfers, InternalTransfer{
+				TxHash: txHash,
+				Index:  *index,
+				From:   call.From,
+				To:     *call.To,
+				Value:  call.Value.ToInt(),
+			})
+		}
+
+		transfers = collectInternalTransfers(transfers, txHash, call.Calls, index)
+	}
+
+	return transfers
+}
+
+func countCalls(calls []callFrame) uint64 {
+	count := uint64(len(calls))
+	for _, call := range calls {
+		count += countCalls(call.Calls)
+	}
+
+	return count
+}
@@ -0,0 +1,73 @@
+package infrastructure_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestEthereum_GetInternalTransfers(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	node := newFakeNode(t)
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	customer := crypto.PubkeyToAddress(key.PublicKey)
+	wallet := geth.HexToAddress("0x41675C099F32341bf84BFc5382aF534df5C7461a")
+	library := geth.HexToAddress("0x29fcB43b46531BcA003ddC8FCB67FFE91900C762")
+	invoice := geth.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9")
+
+	txs := signTransfers(t, key, wallet, 2)
+	block := node.mine(txs, []*types.Receipt{
+		{Status: types.ReceiptStatusSuccessful, CumulativeGasUsed: 60_000, Logs: []*types.Log{}, TxHash: txs[0].Hash()},
+		{Status: types.ReceiptStatusFailed, CumulativeGasUsed: 160_000, Logs: []*types.Log{}, TxHash: txs[1].Hash()},
+	})
+
+	wei := func(value int64) *hexutil.Big {
+		return (*hexutil.Big)(big.NewInt(value))
+	}
+
+	node.trace(block.NumberU64(),
+		fakeTrace{TxHash: txs[0].Hash(), Result: fakeCall{
+			Type: "CALL", From: customer, To: wallet, Value: wei(0),
+			Calls: []fakeCall{
+				{Type: "CALL", From: wallet, To: invoice, Value: wei(3), Calls: []fakeCall{
+					{Type: "STATICCALL", From: invoice, To: library},
+				}},
+				{Type: "DELEGATECALL", From: wallet, To: library, Value: wei(3)},
+				{Type: "CALL", From: wallet, To: invoice, Value: wei(7), Error: "execution reverted", Calls: []fakeCall{
+					{Type: "CALL", From: invoice, To: invoice, Value: wei(1)},
+				}},
+				{Type: "SELFDESTRUCT", From: wallet, To: invoice, Value: wei(2)},
+			},
+		}},
+		fakeTrace{TxHash: txs[1].Hash(), Result: fakeCall{
+			Type: "CALL", From: customer, To: wallet, Value: wei(0), Error: "out of gas",
+			Calls: []fakeCall{
+				{Type: "CALL", From: wallet, To: invoice, Value: wei(5)},
+			},
+		}},
+	)
+
+	sut := newTestEthereum(ctx, t, node)
+
+	transfers, err := sut.GetInternalTransfers(ctx, block)
+	require.NoError(t, err)
+	assert.Equal(t, []infrastructure.InternalTransfer{
+		{TxHash: txs[0].Hash(), Index: 1, From: wallet, To: invoice, Value: big.NewInt(3)},
+		{TxHash: txs[0].Hash(), Index: 6, From: wallet, To: invoice, Value: big.NewInt(2)},
+	}, transfers)
+}
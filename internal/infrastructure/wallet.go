@@ -0,0 +1,153 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/ethereum/go-ethereum/accounts"
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+)
+
+// ExternalChain is the BIP-44 change level used for invoice addresses.
+const ExternalChain = 0
+
+// Wallet derives invoice addresses.
+// Invoice with id N gets the address at m/44'/60'/0'/0/N.
+type Wallet interface {
+	GetInvoiceAccount(id domain.ID) (*geth.Address, error)
+}
+
+// Signer signs transactions sent from invoice addresses.
+// The signed transaction must be the same as the given one and be sent from the invoice address.
+type Signer interface {
+	SignInvoiceTransaction(
+		ctx context.Context,
+		id domain.ID,
+		tx *types.Transaction,
+		signer types.Signer,
+	) (*types.Transaction, error)
+}
+
+// HDWallet derives invoice addresses from the mnemonic.
+// It holds private keys of all invoice addresses in memory and is the default Signer.
+type HDWallet struct {
+	wallet *hdwallet.Wallet
+}
+
+func NewHDWallet(mnemonic string) (*HDWallet, error) {
+	wallet, err := hdwallet.NewFromMnemonic(mnemonic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create wallet: %w", err)
+	}
+
+	return &HDWallet{wallet: wallet}, nil
+}
+
+func (w *HDWallet) GetInvoiceAccount(id domain.ID) (*geth.Address, error) {
+	account, err := w.deriveInvoiceAccount(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &account.Address, nil
+}
+
+func (w *HDWallet) SignInvoiceTransaction(
+	_ context.Context,
+	id domain.ID,
+	tx *types.Transaction,
+	signer types.Signer,
+) (*types.Transaction, error) {
+	account, err := w.deriveInvoiceAccount(id)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := w.wallet.PrivateKey(account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get private key of invoice %d: %w", id, err)
+	}
+
+	signed, err := types.SignTx(tx, signer, privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transaction of invoice %d: %w", id, err)
+	}
+
+	return signed, nil
+}
+
+func (w *HDWallet) deriveInvoiceAccount(id domain.ID) (accounts.Account, error) {
+	path := InvoiceDerivationPath(id)
+	if path.String() == accounts.DefaultRootDerivationPath.String() {
+		return accounts.Account{}, fmt.Errorf("you can't use default root derivation path")
+	}
+
+	account, err := w.wallet.Derive(path, false)
+	if err != nil {
+		return accounts.Account{}, fmt.Errorf("failed to derive account with path %s: %w", path, err)
+	}
+
+	return account, nil
+}
+
+// InvoiceDerivationPath returns the path of the invoice address under the default root derivation path.
+func InvoiceDerivationPath(id domain.ID) accounts.DerivationPath {
+	path := accounts.DefaultRootDerivationPath
+
+	path = append(path, id)
+
+	return path
+}
+
+// WatchOnlyWallet derives invoice addresses from the account-level extended public key,
+// which is the key at m/44'/60'/0'. It holds no private keys,
+// so funds can't be moved by the service in this mode.
+type WatchOnlyWallet struct {
+	// chain is the public key of the external chain at m/44'/60'/0'/0.
+	chain *hdkeychain.ExtendedKey
+}
+
+func NewWatchOnlyWallet(xpub string) (*WatchOnlyWallet, error) {
+	account, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse extended public key: %w", err)
+	}
+
+	if account.IsPrivate() {
+		return nil, fmt.Errorf("extended private key given, only the public one is allowed in watch-only mode")
+	}
+
+	chain, err := account.Derive(ExternalChain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive external chain: %w", err)
+	}
+
+	return &WatchOnlyWallet{chain: chain}, nil
+}
+
+func (w *WatchOnlyWallet) GetInvoiceAccount(id domain.ID) (*geth.Address, error) {
+	// Hardened children can't be derived from a public key.
+	if id >= hdkeychain.HardenedKeyStart {
+		return nil, fmt.Errorf("invoice id %d is too large for public derivation", id)
+	}
+
+	child, err := w.chain.Derive(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive account of invoice %d: %w", id, err)
+	}
+
+	publicKey, err := child.ECPubKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key of invoice %d: %w", id, err)
+	}
+
+	address := crypto.PubkeyToAddress(*publicKey.ToECDSA())
+
+	return &address, nil
+}
@@ -0,0 +1,74 @@
+package infrastructure_test
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+const testMnemonic = "tag volcano eight thank tide danger coast health above argue embrace heavy"
+
+func TestWatchOnlyWallet_GetInvoiceAccount(t *testing.T) {
+	t.Parallel()
+
+	hdWallet, err := infrastructure.NewHDWallet(testMnemonic)
+	require.NoError(t, err)
+
+	sut, err := infrastructure.NewWatchOnlyWallet(accountXPub(t, testMnemonic))
+	require.NoError(t, err)
+
+	for _, id := range []domain.ID{1, 2, 1_000} {
+		expected, err := hdWallet.GetInvoiceAccount(id)
+		require.NoError(t, err)
+
+		actual, err := sut.GetInvoiceAccount(id)
+		require.NoError(t, err)
+
+		assert.Equal(t, expected, actual)
+	}
+
+	_, err = sut.GetInvoiceAccount(hdkeychain.HardenedKeyStart)
+	assert.Error(t, err)
+}
+
+func TestNewWatchOnlyWallet_RejectsPrivateKey(t *testing.T) {
+	t.Parallel()
+
+	seed, err := hdwallet.NewSeedFromMnemonic(testMnemonic)
+	require.NoError(t, err)
+
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+
+	_, err = infrastructure.NewWatchOnlyWallet(master.String())
+	assert.Error(t, err)
+}
+
+// accountXPub returns the extended public key at m/44'/60'/0'.
+// Hardened keys are derived the same way as the hdwallet package does by default.
+func accountXPub(t *testing.T, mnemonic string) string {
+	t.Helper()
+
+	seed, err := hdwallet.NewSeedFromMnemonic(mnemonic)
+	require.NoError(t, err)
+
+	key, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+
+	for _, index := range []uint32{44, 60, 0} {
+		key, err = key.DeriveNonStandard(hdkeychain.HardenedKeyStart + index)
+		require.NoError(t, err)
+	}
+
+	public, err := key.Neuter()
+	require.NoError(t, err)
+
+	return public.String()
+}
@@ -0,0 +1,370 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	ResubscribeInterval = 5 * time.Second
+
+	// ReorgWindowSize is the number of recent blocks that are checked for chain reorganizations.
+	ReorgWindowSize = 128
+)
+
+// Checkpoint is the last block which transactions were processed.
+type Checkpoint struct {
+	Number uint64
+	Hash   geth.Hash
+	// Ancestors are hashes of the processed blocks preceding the checkpoint by their numbers.
+	// Repositories keep those within the reorg window, so the watcher detects reorganizations
+	// deeper than one block after a restart.
+	Ancestors map[uint64]geth.Hash
+}
+
+// IsAncestor reports whether the block with the number is kept as an ancestor of the checkpoint.
+func (c Checkpoint) IsAncestor(number uint64) bool {
+	return number < c.Number && c.Number-number < ReorgWindowSize
+}
+
+// BlockEvent is a block added to the canonical chain
+// or, if Removed is set, a block orphaned by a chain reorganization.
+// Block is set only for added blocks.
+type BlockEvent struct {
+	Number  uint64
+	Hash    geth.Hash
+	Block   *types.Block
+	Removed bool
+}
+
+// SubscribeBlocks streams blocks in order, starting from the block following the checkpoint.
+// If the checkpoint is empty, streaming starts from the current head.
+// Blocks mined while the service was down or the subscription was broken
+// are backfilled before switching back to new heads.
+// When the chain is reorganized, orphaned blocks are streamed as removed, newest first,
+// followed by the blocks of the new canonical chain.
+// HTTP endpoints are polled for the head instead, the stream is the same.
+// When another endpoint becomes active, streaming resumes from it after the last streamed block.
+func (e *Ethereum) SubscribeBlocks(ctx context.Context, from Checkpoint) (<-chan BlockEvent, error) {
+	events := make(chan BlockEvent)
+
+	watcher := newBlockWatcher(e.endpoints, e.quorum, e.pollInterval, from, events)
+
+	go watcher.run(ctx)
+
+	return events, nil
+}
+
+type blockWatcher struct {
+	endpoints    *EndpointPool
+	quorum       *Quorum
+	pollInterval time.Duration
+	events       chan<- BlockEvent
+
+	// next is the number of the block to emit next, zero means the current head.
+	next uint64
+	// window holds hashes of the recently emitted blocks by their numbers.
+	window map[uint64]geth.Hash
+}
+
+func newBlockWatcher(
+	endpoints *EndpointPool,
+	quorum *Quorum,
+	pollInterval time.Duration,
+	from Checkpoint,
+	events chan<- BlockEvent,
+) *blockWatcher {
+	w := &blockWatcher{
+		endpoints:    endpoints,
+		quorum:       quorum,
+		pollInterval: pollInterval,
+		events:       events,
+		next:         0,
+		window:       make(map[uint64]geth.Hash, ReorgWindowSize),
+	}
+
+	if from.Hash != (geth.Hash{}) {
+		w.next = from.Number + 1
+		w.window[from.Number] = from.Hash
+
+		for number, hash := range from.Ancestors {
+			if from.IsAncestor(number) {
+				w.window[number] = hash
+			}
+		}
+	}
+
+	return w
+}
+
+func (w *blockWatcher) client() *ethclient.Client {
+	return w.endpoints.Client()
+}
+
+// run streams blocks from the active endpoint until the context is done.
+// Streaming is restarted when the subscription breaks or another endpoint becomes active.
+func (w *blockWatcher) run(ctx context.Context) {
+	defer close(w.events)
+
+	for {
+		switched := w.endpoints.Switched()
+
+		if IsHTTPEndpoint(w.endpoints.ActiveURL()) {
+			w.poll(ctx, switched)
+		} else {
+			w.listenHeaders(ctx, switched)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-switched:
+			log.Printf("resuming from block %d on endpoint %s\n", w.next, w.endpoints.ActiveURL())
+		case <-time.After(ResubscribeInterval):
+		}
+	}
+}
+
+// poll emits blocks up to the head requested at every tick until the endpoint is switched.
+// A failed request is retried at the next tick from the block it stopped at.
+func (w *blockWatcher) poll(ctx context.Context, switched <-chan struct{}) {
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.pollHead(ctx); err != nil {
+			log.Printf("failed to poll blocks: %s\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("polling blocks stopped")
+
+			return
+		case <-switched:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *blockWatcher) pollHead(ctx context.Context) error {
+	head, err := w.client().HeaderByNumber(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get head: %w", err)
+	}
+
+	if err := w.catchUp(ctx, head); err != nil {
+		return fmt.Errorf("failed to catch up with head %d: %w", head.Number, err)
+	}
+
+	return nil
+}
+
+// listenHeaders emits blocks until the subscription breaks or the endpoint is switched.
+func (w *blockWatcher) listenHeaders(ctx context.Context, switched <-chan struct{}) {
+	headers := make(chan *types.Header)
+
+	headersSubscription, err := w.client().SubscribeNewHead(ctx, headers)
+	if err != nil {
+		log.Printf("failed to subscribe to headers: %s\n", err)
+
+		return
+	}
+	defer headersSubscription.Unsubscribe()
+
+	head, err := w.client().HeaderByNumber(ctx, nil)
+	if err != nil {
+		log.Printf("failed to get head: %s\n", err)
+
+		return
+	}
+
+	if err := w.catchUp(ctx, head); err != nil {
+		log.Printf("failed to catch up with head %d: %s\n", head.Number, err)
+
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("unsubscribed from headers")
+
+			return
+		case <-switched:
+			return
+		case err := <-headersSubscription.Err():
+			log.Printf("subscription error: %s\n", err)
+
+			return
+		case header := <-headers:
+			if err := w.catchUp(ctx, header); err != nil {
+				log.Printf("failed to catch up with head %d: %s\n", header.Number, err)
+
+				return
+			}
+		}
+	}
+}
+
+// catchUp emits every block from the next one up to the head inclusive.
+// If the head is on another branch, orphaned blocks are removed first.
+func (w *blockWatcher) catchUp(ctx context.Context, head *types.Header) error {
+	headNumber := head.Number.Uint64()
+	if w.next == 0 {
+		w.next = headNumber
+	}
+
+	if headNumber < w.next {
+		known, ok := w.window[headNumber]
+		if !ok || known == head.Hash() {
+			return nil
+		}
+
+		if err := w.reorganize(ctx, head); err != nil {
+			return err
+		}
+	}
+
+	if w.next < headNumber {
+		log.Printf("backfilling blocks from %d to %d\n", w.next, headNumber)
+	}
+
+	for w.next <= headNumber {
+		block, err := w.getBlock(ctx, w.next, head)
+		if err != nil {
+			return err
+		}
+
+		if parent, ok := w.window[w.next-1]; ok && parent != block.ParentHash() {
+			if err := w.reorganize(ctx, block.Header()); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// A disputed block is not emitted, so streaming pauses until it is verified on the next attempt.
+		if w.quorum != nil {
+			if err := w.quorum.Verify(ctx, block); err != nil {
+				return fmt.Errorf("failed to verify block %d: %w", w.next, err)
+			}
+		}
+
+		log.Printf("new block %d received with %d transactions\n", w.next, len(block.Transactions()))
+
+		event := BlockEvent{
+			Number:  block.NumberU64(),
+			Hash:    block.Hash(),
+			Block:   block,
+			Removed: false,
+		}
+		if err := w.emit(ctx, event); err != nil {
+			return err
+		}
+
+		w.window[block.NumberU64()] = block.Hash()
+		delete(w.window, block.NumberU64()-ReorgWindowSize)
+		w.next++
+	}
+
+	return nil
+}
+
+func (w *blockWatcher) getBlock(ctx context.Context, number uint64, head *types.Header) (*types.Block, error) {
+	var (
+		block *types.Block
+		err   error
+	)
+
+	if number == head.Number.Uint64() {
+		block, err = w.client().BlockByHash(ctx, head.Hash())
+	} else {
+		block, err = w.client().BlockByNumber(ctx, new(big.Int).SetUint64(number))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get block %d: %w", number, err)
+	}
+
+	return block, nil
+}
+
+// reorganize removes the emitted blocks which are not ancestors of the header
+// and rewinds to the common ancestor.
+func (w *blockWatcher) reorganize(ctx context.Context, header *types.Header) error {
+	ancestor, err := w.commonAncestor(ctx, header)
+	if err != nil {
+		return fmt.Errorf("failed to find common ancestor of block %s: %w", header.Hash(), err)
+	}
+
+	log.Printf("chain reorganization detected, rewinding from block %d to %d\n", w.next-1, ancestor)
+
+	for number := w.next - 1; number > ancestor; number-- {
+		hash, ok := w.window[number]
+		if !ok {
+			continue
+		}
+
+		event := BlockEvent{
+			Number:  number,
+			Hash:    hash,
+			Block:   nil,
+			Removed: true,
+		}
+		if err := w.emit(ctx, event); err != nil {
+			return err
+		}
+
+		delete(w.window, number)
+	}
+
+	w.next = ancestor + 1
+
+	return nil
+}
+
+// commonAncestor walks the branch of the header back
+// until it meets a block from the window and returns its number.
+func (w *blockWatcher) commonAncestor(ctx context.Context, header *types.Header) (uint64, error) {
+	for {
+		number := header.Number.Uint64()
+		if number == 0 {
+			return 0, nil
+		}
+
+		known, ok := w.window[number-1]
+		if !ok {
+			log.Printf("chain reorganization is deeper than %d known blocks\n", len(w.window))
+
+			return number - 1, nil
+		}
+
+		if known == header.ParentHash {
+			return number - 1, nil
+		}
+
+		parent, err := w.client().HeaderByHash(ctx, header.ParentHash)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get header %s: %w", header.ParentHash, err)
+		}
+
+		header = parent
+	}
+}
+
+func (w *blockWatcher) emit(ctx context.Context, event BlockEvent) error {
+	select {
+	case w.events <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,188 @@
+package infrastructure_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	geth "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+const (
+	testPollInterval  = 10 * time.Millisecond
+	testEventTimeout  = 5 * time.Second
+	testMaxHeadAge    = time.Minute
+	testMaxLatency    = time.Second
+	testCheckInterval = 20 * time.Millisecond
+)
+
+func TestIsHTTPEndpoint(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, infrastructure.IsHTTPEndpoint("https://mainnet.infura.io/v3/key"))
+	assert.True(t, infrastructure.IsHTTPEndpoint("http://localhost:8545"))
+	assert.False(t, infrastructure.IsHTTPEndpoint("wss://mainnet.infura.io/ws/v3/key"))
+	assert.False(t, infrastructure.IsHTTPEndpoint("/var/run/geth.ipc"))
+}
+
+func TestEthereum_SubscribeBlocksPolling(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	node := newFakeNode(t)
+	node.extend(2, 0)
+
+	sut := newTestEthereum(ctx, t, node)
+
+	events, err := sut.SubscribeBlocks(ctx, infrastructure.Checkpoint{Number: 0, Hash: node.block(0).Hash()})
+	require.NoError(t, err)
+
+	assertAdded(t, events, node.block(1))
+	assertAdded(t, events, node.block(2))
+
+	node.extend(1, 0)
+	orphaned := node.block(3)
+	assertAdded(t, events, orphaned)
+
+	node.rewind(2)
+	node.extend(2, 1)
+
+	removed := nextEvent(t, events)
+	assert.True(t, removed.Removed)
+	assert.Equal(t, orphaned.Hash(), removed.Hash)
+
+	assertAdded(t, events, node.block(3))
+	assertAdded(t, events, node.block(4))
+}
+
+func TestEthereum_SubscribeBlocksBackfill(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	node := newFakeNode(t)
+	node.extend(4, 0)
+
+	sut := newTestEthereum(ctx, t, node)
+
+	events, err := sut.SubscribeBlocks(ctx, infrastructure.Checkpoint{Number: 1, Hash: node.block(1).Hash()})
+	require.NoError(t, err)
+
+	for number := uint64(2); number <= 4; number++ {
+		assertAdded(t, events, node.block(number))
+	}
+}
+
+func TestEthereum_SubscribeBlocksReorgAfterRestart(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	node := newFakeNode(t)
+	node.extend(4, 0)
+
+	orphaned := make(map[uint64]geth.Hash)
+	for number := uint64(1); number <= 4; number++ {
+		orphaned[number] = node.block(number).Hash()
+	}
+
+	checkpoint := infrastructure.Checkpoint{
+		Number:    4,
+		Hash:      orphaned[4],
+		Ancestors: map[uint64]geth.Hash{1: orphaned[1], 2: orphaned[2], 3: orphaned[3]},
+	}
+
+	// The blocks after the block 1 are orphaned while the service is down.
+	node.rewind(1)
+	node.extend(4, 1)
+
+	sut := newTestEthereum(ctx, t, node)
+
+	events, err := sut.SubscribeBlocks(ctx, checkpoint)
+	require.NoError(t, err)
+
+	for number := uint64(4); number >= 2; number-- {
+		removed := nextEvent(t, events)
+		assert.True(t, removed.Removed)
+		assert.Equal(t, number, removed.Number)
+		assert.Equal(t, orphaned[number], removed.Hash, "block %d", number)
+	}
+
+	for number := uint64(2); number <= 5; number++ {
+		assertAdded(t, events, node.block(number))
+	}
+}
+
+func TestEthereum_SubscribeBlocksFailover(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	primary := newFakeNode(t)
+	backup := primary.mirror(t)
+	primary.extend(1, 0)
+
+	endpoints, err := infrastructure.DialEndpoints(ctx, []string{primary.URL, backup.URL}, testMaxHeadAge, testMaxLatency)
+	require.NoError(t, err)
+	assert.Equal(t, primary.URL, endpoints.ActiveURL())
+
+	go func() {
+		_ = endpoints.RunHealthChecks(ctx, testCheckInterval)()
+	}()
+
+	sut := infrastructure.NewEthereum(endpoints, nil, nil, nil, testPollInterval)
+
+	events, err := sut.SubscribeBlocks(ctx, infrastructure.Checkpoint{Number: 0, Hash: primary.block(0).Hash()})
+	require.NoError(t, err)
+
+	assertAdded(t, events, primary.block(1))
+
+	primary.setDown(true)
+	primary.extend(2, 0)
+
+	assertAdded(t, events, backup.block(2))
+	assertAdded(t, events, backup.block(3))
+	assert.Equal(t, backup.URL, endpoints.ActiveURL())
+
+	primary.setDown(false)
+	primary.extend(1, 0)
+
+	assertAdded(t, events, primary.block(4))
+	assert.Eventually(t, func() bool {
+		return endpoints.ActiveURL() == primary.URL
+	}, testEventTimeout, testCheckInterval)
+}
+
+func assertAdded(t *testing.T, events <-chan infrastructure.BlockEvent, block *types.Block) {
+	t.Helper()
+
+	event := nextEvent(t, events)
+	assert.False(t, event.Removed)
+	assert.Equal(t, block.NumberU64(), event.Number)
+	assert.Equal(t, block.Hash(), event.Hash)
+}
+
+func nextEvent(t *testing.T, events <-chan infrastructure.BlockEvent) infrastructure.BlockEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		require.True(t, ok, "events channel closed")
+
+		return event
+	case <-time.After(testEventTimeout):
+		require.FailNow(t, "no block event received")
+
+		return infrastructure.BlockEvent{}
+	}
+}
@@ -0,0 +1,109 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	WebhookTimeout = 10 * time.Second
+
+	WebhookEventIDHeader   = "X-Webhook-Event-Id"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryStatusPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryStatusDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryStatusFailed    WebhookDeliveryStatus = "failed"
+)
+
+// WebhookDelivery is an event which has to be delivered to a webhook endpoint.
+type WebhookDelivery struct {
+	ID            uint64
+	EventID       string
+	EventType     string
+	URL           string
+	Payload       []byte
+	Status        WebhookDeliveryStatus
+	Attempts      uint64
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+}
+
+// WebhookAttempt is a record of a single attempt to deliver a webhook.
+// StatusCode is zero if no response was received.
+type WebhookAttempt struct {
+	DeliveryID uint64
+	Attempt    uint64
+	StatusCode int
+	Error      string
+	CreatedAt  time.Time
+}
+
+// WebhookClient sends webhooks signed with a shared secret.
+// The WebhookSignatureHeader contains the hex encoded HMAC-SHA256
+// of the WebhookTimestampHeader value and the body joined with a dot,
+// so receivers can reject replayed requests.
+type WebhookClient struct {
+	client *http.Client
+	secret []byte
+}
+
+func NewWebhookClient(secret string) *WebhookClient {
+	return &WebhookClient{
+		client: &http.Client{Timeout: WebhookTimeout},
+		secret: []byte(secret),
+	}
+}
+
+// Send posts the payload to the URL and returns the response status code.
+// Any status code other than 2xx is returned with an error.
+func (c *WebhookClient) Send(ctx context.Context, url, eventID string, payload []byte) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventIDHeader, eventID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, c.Sign(timestamp, payload))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// The body is drained so the connection can be reused.
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp.StatusCode, fmt.Errorf("webhook endpoint responded with status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+func (c *WebhookClient) Sign(timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
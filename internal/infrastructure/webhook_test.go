@@ -0,0 +1,60 @@
+package infrastructure_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+func TestWebhookClient_Send(t *testing.T) {
+	t.Parallel()
+
+	const secret = "secret"
+	payload := []byte(`{"type":"invoice.paid"}`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, payload, body)
+		assert.Equal(t, "event", r.Header.Get(infrastructure.WebhookEventIDHeader))
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get(infrastructure.WebhookTimestampHeader) + "."))
+		mac.Write(body)
+		assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get(infrastructure.WebhookSignatureHeader))
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	sut := infrastructure.NewWebhookClient(secret)
+
+	statusCode, err := sut.Send(context.Background(), server.URL, "event", payload)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, statusCode)
+}
+
+func TestWebhookClient_SendFailed(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	sut := infrastructure.NewWebhookClient("secret")
+
+	statusCode, err := sut.Send(context.Background(), server.URL, "event", []byte(`{}`))
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
+	"golang.org/x/term"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+const (
+	keystoreCreateCommand = "create"
+	keystoreRotateCommand = "rotate"
+)
+
+// mnemonicBits is the entropy of generated mnemonics, which have 24 words.
+const mnemonicBits = 256
+
+// stdin is shared by prompts, so input read ahead by one of them is not lost for the next.
+var stdin = bufio.NewReader(os.Stdin)
+
+// manageKeystore creates and rotates the encrypted mnemonic files read with MNEMONIC_FILE.
+func manageKeystore(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s needs a subcommand: %s or %s", keystoreCommand, keystoreCreateCommand, keystoreRotateCommand)
+	}
+
+	switch args[0] {
+	case keystoreCreateCommand:
+		return createKeystore(args[1:])
+	case keystoreRotateCommand:
+		return rotateKeystore(args[1:])
+	default:
+		return fmt.Errorf("unknown %s subcommand %q", keystoreCommand, args[0])
+	}
+}
+
+// createKeystore writes a new mnemonic, or the one typed by the operator, encrypted with a passphrase.
+func createKeystore(args []string) error {
+	flags := flag.NewFlagSet(keystoreCommand+" "+keystoreCreateCommand, flag.ContinueOnError)
+	out := flags.String("out", "", "file to write the encrypted mnemonic to")
+	importMnemonic := flags.Bool("import", false, "encrypt an existing mnemonic instead of generating a new one")
+	passphraseFile := flags.String("passphrase-file", "", "file with the passphrase, it is prompted for if not set")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *out == "" {
+		return errors.New("-out must be set")
+	}
+
+	// Overwriting an existing file would lose the mnemonic of the invoices created with it.
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("file %s already exists, use %s to change its passphrase", *out, keystoreRotateCommand)
+	}
+
+	var mnemonic string
+	if *importMnemonic {
+		var err error
+
+		mnemonic, err = promptSecret("Mnemonic: ")
+		if err != nil {
+			return fmt.Errorf("failed to read mnemonic: %w", err)
+		}
+	}
+
+	passphrase, err := newPassphrase(*passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	if !*importMnemonic {
+		mnemonic, err = hdwallet.NewMnemonic(mnemonicBits)
+		if err != nil {
+			return fmt.Errorf("failed to generate mnemonic: %w", err)
+		}
+
+		// The mnemonic is the only backup of the invoice keys, the file is useless without the passphrase.
+		fmt.Fprintf(os.Stderr, "Write down the mnemonic and keep it offline:\n\n%s\n\n", mnemonic)
+	}
+
+	if err := infrastructure.WriteMnemonicFile(*out, mnemonic, passphrase); err != nil {
+		return err
+	}
+
+	log.Printf("encrypted mnemonic written to %s\n", *out)
+
+	return nil
+}
+
+// rotateKeystore encrypts the mnemonic file with a new passphrase.
+func rotateKeystore(args []string) error {
+	flags := flag.NewFlagSet(keystoreCommand+" "+keystoreRotateCommand, flag.ContinueOnError)
+	file := flags.String("file", "", "encrypted mnemonic file")
+	passphraseFile := flags.String("passphrase-file", "", "file with the current passphrase, it is prompted for if not set")
+	newPassphraseFile := flags.String("new-passphrase-file", "", "file with the new passphrase, it is prompted for if not set")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return errors.New("-file must be set")
+	}
+
+	mnemonic, err := decryptMnemonic(*file, *passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := newPassphrase(*newPassphraseFile)
+	if err != nil {
+		return err
+	}
+
+	if err := infrastructure.WriteMnemonicFile(*file, mnemonic, passphrase); err != nil {
+		return err
+	}
+
+	log.Printf("passphrase of %s changed\n", *file)
+
+	return nil
+}
+
+// decryptMnemonic reads the mnemonic file with the passphrase from passphraseFile,
+// or with the passphrase prompted for on the terminal if it is empty.
+func decryptMnemonic(mnemonicFile string, passphraseFile string) (string, error) {
+	var (
+		passphrase string
+		err        error
+	)
+
+	if passphraseFile != "" {
+		passphrase, err = readPassphraseFile(passphraseFile)
+	} else {
+		passphrase, err = promptSecret(fmt.Sprintf("Passphrase of %s: ", mnemonicFile))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	return infrastructure.ReadMnemonicFile(mnemonicFile, passphrase)
+}
+
+// newPassphrase reads the passphrase to encrypt with from the file,
+// or prompts for it twice, so a typo does not make the mnemonic file unreadable.
+func newPassphrase(passphraseFile string) (string, error) {
+	if passphraseFile != "" {
+		passphrase, err := readPassphraseFile(passphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase: %w", err)
+		}
+
+		return passphrase, nil
+	}
+
+	passphrase, err := promptSecret("New passphrase: ")
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	confirmation, err := promptSecret("Repeat passphrase: ")
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	if passphrase != confirmation {
+		return "", errors.New("passphrases do not match")
+	}
+
+	return passphrase, nil
+}
+
+// readPassphraseFile reads the passphrase from the file, e.g. a mounted secret.
+// The trailing line break is not a part of the passphrase.
+func readPassphraseFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// promptSecret reads a line from the terminal without echoing it.
+// If the standard input is not a terminal, e.g. when the secret is piped, the line is read as is.
+func promptSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		secret, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+
+		return string(secret), err
+	}
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -16,8 +16,27 @@ import (
 	"github.com/F0rzend/demo_ethereum_payment/internal/transport"
 )
 
+const (
+	recoverCommand  = "recover"
+	signCommand     = "sign"
+	keystoreCommand = "keystore"
+)
+
 func main() {
-	if err := run(); err != nil {
+	var err error
+
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == recoverCommand:
+		err = recoverInvoices(os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == signCommand:
+		err = signBundle(os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == keystoreCommand:
+		err = manageKeystore(os.Args[2:])
+	default:
+		err = run()
+	}
+
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -31,23 +50,104 @@ func run() error {
 		return fmt.Errorf("cannot get config from env: %w", err)
 	}
 
-	ethereum, err := infrastructure.NewEthereum(ctx, config.EthereumRPC, config.Mnemonic)
+	wallet, err := newWallet(config)
+	if err != nil {
+		return fmt.Errorf("cannot create wallet: %w", err)
+	}
+
+	endpoints, err := infrastructure.DialEndpoints(ctx, config.EthereumRPCs, config.RPCMaxHeadAge, config.RPCMaxLatency)
+	if err != nil {
+		return fmt.Errorf("cannot connect to ethereum: %w", err)
+	}
+
+	var quorum *infrastructure.Quorum
+	if len(config.QuorumRPCs) > 0 {
+		quorum, err = infrastructure.DialQuorum(ctx, config.QuorumRPCs, config.QuorumSize, endpoints.ChainID())
+		if err != nil {
+			return fmt.Errorf("cannot connect to quorum providers: %w", err)
+		}
+	}
+
+	signer, closeSigner, err := newSigner(ctx, config, wallet)
+	if err != nil {
+		return fmt.Errorf("cannot create signer: %w", err)
+	}
+	defer closeSigner()
+
+	ethereum := infrastructure.NewEthereum(endpoints, quorum, wallet, signer, config.PollInterval)
+
+	repository, closeRepository, err := newRepository(ctx, config)
+	if err != nil {
+		return fmt.Errorf("cannot create repository: %w", err)
+	}
+	defer func() {
+		if err := closeRepository(); err != nil {
+			log.Printf("failed to close repository: %s\n", err)
+		}
+	}()
+
+	rates, err := newRateProvider(config, ethereum)
 	if err != nil {
-		return fmt.Errorf("cannot create ethereum gataway: %w", err)
+		return fmt.Errorf("cannot create rate provider: %w", err)
 	}
 
-	repository := infrastructure.NewRepository()
-	app := application.NewApplication(ethereum, repository)
+	app := application.NewApplication(
+		ethereum,
+		repository,
+		config.RequiredConfirmations,
+		config.Tolerance,
+		config.InvoiceTTL,
+		config.TreasuryAddress,
+		rates,
+		config.TraceInternalCalls,
+	)
+
+	var webhooks *application.Webhooks
+	if len(config.WebhookURLs) > 0 {
+		webhooks = application.NewWebhooks(
+			infrastructure.NewWebhookClient(config.WebhookSecret),
+			repository,
+			config.WebhookURLs,
+		)
+		app.OnEvent(webhooks.Handle)
+	}
 
 	server := transport.NewHTTPServer(ctx, config.ServerAddress, app)
+	adminServer := transport.NewAdminHTTPServer(ctx, config.AdminServerAddress, config.AdminToken, app)
 
 	g, ctx := errgroup.WithContext(ctx)
 
+	_, shutdownAdminFn := adminServer.ShutdownOnContextDone(ctx)
 	ctx, shutdownFn := server.ShutdownOnContextDone(ctx)
 
+	// The background jobs change invoices, so they run on one instance at a time.
+	jobs := func(ctx context.Context) error {
+		g, ctx := errgroup.WithContext(ctx)
+
+		g.Go(app.RunTransactionHandler(ctx))
+		g.Go(app.RunExpirationJob(ctx))
+
+		if webhooks != nil {
+			g.Go(webhooks.RunDispatcher(ctx))
+		}
+
+		if config.TreasuryAddress != nil && config.SweepInterval > 0 {
+			g.Go(app.RunSweeper(ctx, config.SweepInterval))
+		}
+
+		if config.ReconcileInterval > 0 {
+			g.Go(app.RunReconciler(ctx, config.ReconcileInterval, config.ReconcileOpenDiscrepancy))
+		}
+
+		return g.Wait()
+	}
+
 	g.Go(shutdownFn)
-	g.Go(app.RunTransactionHandler(ctx))
+	g.Go(shutdownAdminFn)
+	g.Go(endpoints.RunHealthChecks(ctx, config.HealthCheckInterval))
 	g.Go(server.Run)
+	g.Go(adminServer.Run)
+	g.Go(runBackgroundJobs(ctx, repository, jobs))
 
 	if err := g.Wait(); err != nil {
 		return fmt.Errorf("an unexpected error occurred while the application was running: %w", err)
@@ -57,3 +157,102 @@ func run() error {
 
 	return nil
 }
+
+// runBackgroundJobs runs the jobs right away, unless the repository is shared by several instances.
+// Then only the instance holding the leader lock runs them.
+func runBackgroundJobs(
+	ctx context.Context,
+	repository application.Repository,
+	jobs func(ctx context.Context) error,
+) common.ErrorGroupGoroutine {
+	if postgres, ok := repository.(*infrastructure.PostgresRepository); ok {
+		return postgres.RunAsLeader(ctx, jobs)
+	}
+
+	return func() error {
+		return jobs(ctx)
+	}
+}
+
+func newWallet(config *common.Config) (infrastructure.Wallet, error) {
+	if config.XPub != "" {
+		if config.SignerURL == "" {
+			log.Println("running in watch-only mode")
+		}
+
+		return infrastructure.NewWatchOnlyWallet(config.XPub)
+	}
+
+	if config.MnemonicFile != "" {
+		mnemonic, err := decryptMnemonic(config.MnemonicFile, config.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return infrastructure.NewHDWallet(mnemonic)
+	}
+
+	log.Printf("mnemonic is read in plain text from %s, consider %s\n", common.MnemonicKey, common.MnemonicFileKey)
+
+	return infrastructure.NewHDWallet(config.Mnemonic)
+}
+
+// newSigner returns the remote signer if it is configured, otherwise the wallet if it holds the keys.
+// The signer is nil in watch-only mode.
+func newSigner(
+	ctx context.Context,
+	config *common.Config,
+	wallet infrastructure.Wallet,
+) (infrastructure.Signer, func(), error) {
+	if config.SignerURL != "" {
+		signer, err := infrastructure.DialRemoteSigner(ctx, config.SignerURL, config.SignerProtocol, wallet)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		log.Printf("transfers are signed by %s signer\n", config.SignerProtocol)
+
+		return signer, signer.Close, nil
+	}
+
+	if signer, ok := wallet.(infrastructure.Signer); ok {
+		return signer, func() {}, nil
+	}
+
+	return nil, func() {}, nil
+}
+
+func newRateProvider(config *common.Config, ethereum *infrastructure.Ethereum) (application.RateProvider, error) {
+	switch config.RateProvider {
+	case common.RateProviderStatic:
+		return infrastructure.NewStaticRateProvider(config.ExchangeRates)
+	case common.RateProviderFile:
+		return infrastructure.NewFileRateProvider(config.ExchangeRatesFile)
+	case common.RateProviderChainlink:
+		return infrastructure.NewChainlinkRateProvider(ethereum, config.ChainlinkFeeds, config.RateMaxAge), nil
+	default:
+		// Fiat invoices are disabled.
+		return nil, nil
+	}
+}
+
+func newRepository(ctx context.Context, config *common.Config) (application.Repository, func() error, error) {
+	switch config.StorageDriver {
+	case common.StorageDriverSQLite:
+		repository, err := infrastructure.NewSQLiteRepository(ctx, config.StorageDSN)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open sqlite repository: %w", err)
+		}
+
+		return repository, repository.Close, nil
+	case common.StorageDriverPostgres:
+		repository, err := infrastructure.NewPostgresRepository(ctx, config.StorageDSN)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open postgres repository: %w", err)
+		}
+
+		return repository, repository.Close, nil
+	default:
+		return infrastructure.NewRepository(), func() error { return nil }, nil
+	}
+}
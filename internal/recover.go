@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/application"
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+// defaultGapLimit is the address gap limit of BIP-44 wallets.
+const defaultGapLimit = 20
+
+// recoverInvoices rebuilds invoices of the configured storage from the chain.
+// It uses the same environment as the service, which must not be running at the same time.
+func recoverInvoices(args []string) error {
+	flags := flag.NewFlagSet(recoverCommand, flag.ContinueOnError)
+	gapLimit := flags.Uint64("gap-limit", defaultGapLimit, "number of consecutive unused invoice addresses to stop at")
+	fromBlock := flags.Uint64(
+		"from-block", 0, "first block to scan for payments, e.g. the deployment block (default is the stored checkpoint)",
+	)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	config, err := common.ConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("cannot get config from env: %w", err)
+	}
+
+	wallet, err := newWallet(config)
+	if err != nil {
+		return fmt.Errorf("cannot create wallet: %w", err)
+	}
+
+	endpoints, err := infrastructure.DialEndpoints(ctx, config.EthereumRPCs, config.RPCMaxHeadAge, config.RPCMaxLatency)
+	if err != nil {
+		return fmt.Errorf("cannot connect to ethereum: %w", err)
+	}
+
+	ethereum := infrastructure.NewEthereum(endpoints, nil, wallet, nil, config.PollInterval)
+
+	repository, closeRepository, err := newRepository(ctx, config)
+	if err != nil {
+		return fmt.Errorf("cannot create repository: %w", err)
+	}
+	defer func() {
+		if err := closeRepository(); err != nil {
+			log.Printf("failed to close repository: %s\n", err)
+		}
+	}()
+
+	start, err := recoveryStart(ctx, flags, *fromBlock, repository)
+	if err != nil {
+		return err
+	}
+
+	if config.StorageDriver == common.StorageDriverMemory {
+		log.Println("recovering into memory storage, recovered invoices will be lost on exit")
+	}
+
+	app := application.NewApplication(
+		ethereum,
+		repository,
+		config.RequiredConfirmations,
+		config.Tolerance,
+		config.InvoiceTTL,
+		config.TreasuryAddress,
+		nil,
+		config.TraceInternalCalls,
+	)
+
+	report, err := app.Recover(ctx, *gapLimit, start)
+	if err != nil {
+		return fmt.Errorf("failed to recover invoices: %w", err)
+	}
+
+	log.Printf(
+		"recovered %d invoices with %d payments and %d transfers up to block %d, %d addresses checked, %d invoices already existed\n",
+		len(report.Recovered), report.Payments, report.Transfers, report.HeadNumber, report.Checked, len(report.Skipped),
+	)
+
+	if len(report.Unexplained) > 0 {
+		log.Printf("invoices %v were not recovered and must be recovered manually\n", report.Unexplained)
+	}
+
+	return nil
+}
+
+// recoveryStart returns the block given by the from-block flag or, if the flag is not set, the stored checkpoint,
+// so the whole chain is never scanned by accident.
+func recoveryStart(
+	ctx context.Context,
+	flags *flag.FlagSet,
+	fromBlock uint64,
+	repository application.Repository,
+) (uint64, error) {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "from-block"
+	})
+
+	if set {
+		return fromBlock, nil
+	}
+
+	checkpoint, err := repository.GetCheckpoint(ctx)
+	if common.IsFlaggedError(err, common.FlagNotFound) {
+		return 0, fmt.Errorf("there is no stored checkpoint, so the -from-block flag is required")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot get checkpoint: %w", err)
+	}
+
+	log.Printf("scanning from the stored checkpoint at block %d\n", checkpoint.Number)
+
+	return checkpoint.Number, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/F0rzend/demo_ethereum_payment/internal/common"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
+)
+
+// signBundle signs a bundle exported by the service with the mnemonic,
+// which is read from MNEMONIC or decrypted from MNEMONIC_FILE.
+// It needs no network access, so it can be run on an air-gapped machine.
+func signBundle(args []string) error {
+	flags := flag.NewFlagSet(signCommand, flag.ContinueOnError)
+	in := flags.String("in", "", "unsigned bundle exported by the service")
+	out := flags.String("out", "", "file to write the signed bundle to")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *in == "" || *out == "" {
+		return errors.New("both -in and -out must be set")
+	}
+
+	mnemonic := os.Getenv(common.MnemonicKey)
+	if mnemonicFile := os.Getenv(common.MnemonicFileKey); mnemonicFile != "" {
+		var err error
+
+		mnemonic, err = decryptMnemonic(mnemonicFile, os.Getenv(common.PassphraseFileKey))
+		if err != nil {
+			return err
+		}
+	}
+	if mnemonic == "" {
+		return fmt.Errorf("environment variable %s or %s not set", common.MnemonicKey, common.MnemonicFileKey)
+	}
+
+	wallet, err := infrastructure.NewHDWallet(mnemonic)
+	if err != nil {
+		return fmt.Errorf("cannot create wallet: %w", err)
+	}
+
+	raw, err := os.ReadFile(*in)
+	if err != nil {
+		return fmt.Errorf("failed to read unsigned bundle: %w", err)
+	}
+
+	var unsigned infrastructure.UnsignedBundle
+	if err := json.Unmarshal(raw, &unsigned); err != nil {
+		return fmt.Errorf("failed to parse unsigned bundle: %w", err)
+	}
+
+	for _, tx := range unsigned.Transactions {
+		log.Printf(
+			"%s of invoice %d: %s wei from %s to %s, nonce %d, fee up to %s wei per gas\n",
+			tx.Kind, tx.InvoiceID, tx.Value, tx.From, tx.To, tx.Nonce, tx.GasFeeCap,
+		)
+	}
+
+	signed, err := infrastructure.SignBundle(context.Background(), wallet, &unsigned)
+	if err != nil {
+		return fmt.Errorf("failed to sign bundle: %w", err)
+	}
+
+	raw, err = json.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode signed bundle: %w", err)
+	}
+
+	if err := os.WriteFile(*out, raw, 0o600); err != nil {
+		return fmt.Errorf("failed to write signed bundle: %w", err)
+	}
+
+	log.Printf("signed %d transactions for chain %s\n", len(signed.Transactions), signed.ChainID)
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+)
+
+// GetAdminRouter serves the endpoints which move funds from invoice addresses, including transfers signed offline,
+// the reconciliation of their balances and the metrics.
+// If the token is set, every request must carry it as a bearer token.
+func (s *HTTPHandlers) GetAdminRouter(token string) http.Handler {
+	r := chi.NewRouter()
+
+	r.Use(
+		middleware.Recoverer,
+		requireToken(token),
+		middleware.AllowContentType("application/json"),
+		render.SetContentType(render.ContentTypeJSON),
+	)
+
+	r.Post("/invoices/{id}/sweep", ErrorHandler(s.sweepInvoice))
+	r.Post("/invoices/{id}/refunds", ErrorHandler(s.refundInvoice))
+
+	// Transfers signed offline by the sign command.
+	r.Post("/offline/sweeps", ErrorHandler(s.exportSweeps))
+	r.Post("/offline/invoices/{id}/refunds", ErrorHandler(s.exportRefund))
+	r.Post("/offline/signed", ErrorHandler(s.importSigned))
+
+	r.Get("/admin/reconciliation", ErrorHandler(s.getReconciliation))
+	r.Get("/admin/discrepancies", ErrorHandler(s.getDiscrepancies))
+	r.Post("/admin/discrepancies/{id}/resolve", ErrorHandler(s.resolveDiscrepancy))
+
+	// Metrics, e.g. quorum disagreements.
+	r.Handle("/debug/vars", expvar.Handler())
+
+	return r
+}
+
+// requireToken rejects requests without the bearer token. It lets every request through if the token is empty.
+func requireToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if token == "" {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				renderError(w, r, NewUnauthorizedError("a valid bearer token is required"))
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -18,6 +18,8 @@ const (
 	InternalServerErrorType ErrorType = "InternalServerError"
 	ValidationErrorType     ErrorType = "ValidationError"
 	NotFoundErrorType       ErrorType = "NotFoundError"
+	ConflictErrorType       ErrorType = "ConflictError"
+	UnauthorizedErrorType   ErrorType = "UnauthorizedError"
 )
 
 type HTTPError struct {
@@ -127,3 +129,19 @@ func NewNotFoundError(detail string) error {
 		Detail: detail,
 	}
 }
+
+func NewConflictError(detail string) error {
+	return &HTTPError{
+		Type:   ConflictErrorType,
+		Status: http.StatusConflict,
+		Detail: detail,
+	}
+}
+
+func NewUnauthorizedError(detail string) error {
+	return &HTTPError{
+		Type:   UnauthorizedErrorType,
+		Status: http.StatusUnauthorized,
+		Detail: detail,
+	}
+}
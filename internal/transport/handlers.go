@@ -2,9 +2,12 @@ package transport
 
 import (
 	"fmt"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
 
+	geth "github.com/ethereum/go-ethereum/common"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
@@ -12,6 +15,7 @@ import (
 	"github.com/F0rzend/demo_ethereum_payment/internal/application"
 	"github.com/F0rzend/demo_ethereum_payment/internal/common"
 	"github.com/F0rzend/demo_ethereum_payment/internal/domain"
+	"github.com/F0rzend/demo_ethereum_payment/internal/infrastructure"
 )
 
 type HTTPHandlers struct {
@@ -37,13 +41,28 @@ func (s *HTTPHandlers) GetRouter() http.Handler {
 
 	r.Post("/invoices", ErrorHandler(s.createInvoice))
 	r.Get("/invoices/{id}", ErrorHandler(s.getInvoice))
+	r.Get("/invoices/{id}/payments", ErrorHandler(s.getInvoicePayments))
+	r.Get("/invoices/{id}/refunds", ErrorHandler(s.getInvoiceRefunds))
 
 	return r
 }
 
 func (s *HTTPHandlers) createInvoice(w http.ResponseWriter, r *http.Request) error {
+	type fiatPrice struct {
+		// Amount is a decimal string, e.g. "19.99".
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}
+
 	type request struct {
-		Price domain.WEI `json:"price"`
+		// Only one of Price and FiatPrice is set.
+		Price     domain.WEI `json:"price"`
+		FiatPrice *fiatPrice `json:"fiat_price"`
+		// ExpiresIn is the invoice lifetime in seconds.
+		ExpiresIn *uint64    `json:"expires_in"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		// Token is the address of the ERC-20 token contract, the invoice is paid in ether if it is not set.
+		Token *geth.Address `json:"token"`
 	}
 
 	var req request
@@ -52,7 +71,44 @@ func (s *HTTPHandlers) createInvoice(w http.ResponseWriter, r *http.Request) err
 		return NewValidationError("invalid request body")
 	}
 
-	id, err := s.application.CreateInvoice(req.Price)
+	expiresAt, err := invoiceExpiration(req.ExpiresIn, req.ExpiresAt, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var id domain.ID
+
+	switch {
+	case req.Price != nil && req.FiatPrice != nil:
+		return NewValidationError("only one of price and fiat_price can be set")
+	case req.FiatPrice != nil:
+		if req.Token != nil {
+			return NewValidationError("fiat_price can't be set for token invoices")
+		}
+
+		amount, amountErr := domain.ParseDecimal(req.FiatPrice.Amount)
+		if amountErr != nil || amount.Sign() <= 0 {
+			return NewValidationError("fiat_price.amount must be a positive decimal number")
+		}
+
+		currency, currencyErr := domain.ParseCurrency(req.FiatPrice.Currency)
+		if currencyErr != nil {
+			return NewValidationError("fiat_price.currency must be a three-letter currency code")
+		}
+
+		id, err = s.application.CreateFiatInvoice(r.Context(), amount, currency, expiresAt)
+	case req.Price != nil:
+		id, err = s.application.CreateInvoice(r.Context(), req.Price, expiresAt, req.Token)
+	default:
+		return NewValidationError("one of price and fiat_price must be set")
+	}
+
+	if common.IsFlaggedError(err, common.FlagNotFound) {
+		return NewValidationError(err.Error())
+	}
+	if common.IsFlaggedError(err, common.FlagConflict) {
+		return NewConflictError(err.Error())
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create invoice: %w", err)
 	}
@@ -71,44 +127,339 @@ func (s *HTTPHandlers) createInvoice(w http.ResponseWriter, r *http.Request) err
 	return nil
 }
 
+// invoiceExpiration returns the expiration time requested either as a lifetime or as a time.
+// Nil means that the default invoice TTL is used.
+func invoiceExpiration(expiresIn *uint64, expiresAt *time.Time, now time.Time) (*time.Time, error) {
+	switch {
+	case expiresIn != nil && expiresAt != nil:
+		return nil, NewValidationError("only one of expires_in and expires_at can be set")
+	case expiresIn != nil:
+		if *expiresIn == 0 || *expiresIn > uint64(math.MaxInt64/time.Second) {
+			return nil, NewValidationError("expires_in must be a positive number of seconds")
+		}
+
+		at := now.Add(time.Duration(*expiresIn) * time.Second).UTC()
+
+		return &at, nil
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return nil, NewValidationError("expires_at must be in the future")
+		}
+
+		at := expiresAt.UTC()
+
+		return &at, nil
+	default:
+		return nil, nil
+	}
+}
+
 const (
 	InvoiceIDNumberSystem = 10
 	InvoiceIDBitSize      = 32
 )
 
 func (s *HTTPHandlers) getInvoice(w http.ResponseWriter, r *http.Request) error {
-	rawID := chi.URLParam(r, "id")
-	id, err := strconv.ParseUint(rawID, InvoiceIDNumberSystem, InvoiceIDBitSize)
+	invoice, err := s.getInvoiceFromURL(r)
 	if err != nil {
-		return NewValidationError(
-			fmt.Sprintf("failed to parse invoice id %q", rawID),
-		)
+		return err
+	}
+
+	type response struct {
+		ID                    domain.ID            `json:"id"`
+		Price                 domain.WEI           `json:"price"`
+		Balance               domain.WEI           `json:"balance"`
+		Address               domain.Address       `json:"address"`
+		Token                 *tokenResponse       `json:"token"`
+		FiatPrice             *fiatPriceResponse   `json:"fiat_price"`
+		Status                domain.InvoiceStatus `json:"status"`
+		AmountDue             domain.WEI           `json:"amount_due"`
+		Excess                domain.WEI           `json:"excess"`
+		Tolerance             domain.WEI           `json:"tolerance"`
+		Confirmations         uint64               `json:"confirmations"`
+		RequiredConfirmations uint64               `json:"required_confirmations"`
+		CreatedAt             time.Time            `json:"created_at"`
+		ExpiresAt             *time.Time           `json:"expires_at"`
+		LateAmount            domain.WEI           `json:"late_amount"`
+		Refunded              domain.WEI           `json:"refunded"`
+		Refundable            domain.WEI           `json:"refundable"`
+		Sweep                 *transferResponse    `json:"sweep"`
+	}
+
+	resp := response{
+		ID:                    invoice.ID(),
+		Price:                 invoice.Price(),
+		Balance:               invoice.Balance(),
+		Address:               invoice.Address(),
+		Token:                 newTokenResponse(invoice.Token()),
+		FiatPrice:             newFiatPriceResponse(invoice.Fiat()),
+		Status:                invoice.Status(),
+		AmountDue:             invoice.AmountDue(),
+		Excess:                invoice.Excess(),
+		Tolerance:             invoice.Tolerance(),
+		Confirmations:         invoice.Confirmations(),
+		RequiredConfirmations: invoice.RequiredConfirmations(),
+		CreatedAt:             invoice.CreatedAt(),
+		ExpiresAt:             invoice.ExpiresAt(),
+		LateAmount:            invoice.LateAmount(),
+		Refunded:              invoice.Refunded(),
+		Refundable:            invoice.Refundable(),
+		Sweep:                 newTransferResponse(invoice.Sweep()),
+	}
+
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, resp)
+
+	return nil
+}
+
+func (s *HTTPHandlers) getInvoicePayments(w http.ResponseWriter, r *http.Request) error {
+	invoice, err := s.getInvoiceFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	type payment struct {
+		TxHash            domain.Hash          `json:"tx_hash"`
+		Kind              domain.PaymentKind   `json:"kind"`
+		Index             uint64               `json:"index"`
+		BlockNumber       uint64               `json:"block_number"`
+		BlockHash         domain.Hash          `json:"block_hash"`
+		Sender            geth.Address         `json:"sender"`
+		Value             domain.WEI           `json:"value"`
+		Timestamp         time.Time            `json:"timestamp"`
+		Confirmations     uint64               `json:"confirmations"`
+		Status            domain.PaymentStatus `json:"status"`
+		GasUsed           uint64               `json:"gas_used"`
+		EffectiveGasPrice domain.WEI           `json:"effective_gas_price"`
+		Late              bool                 `json:"late"`
+		Verified          bool                 `json:"verified"`
+	}
+
+	resp := make([]payment, 0, len(invoice.Payments()))
+	for _, p := range invoice.Payments() {
+		resp = append(resp, payment{
+			TxHash:            p.TxHash(),
+			Kind:              p.Kind(),
+			Index:             p.Index(),
+			BlockNumber:       p.BlockNumber(),
+			BlockHash:         p.BlockHash(),
+			Sender:            p.Sender(),
+			Value:             p.Value(),
+			Timestamp:         p.Timestamp(),
+			Confirmations:     p.Confirmations(),
+			Status:            p.Status(),
+			GasUsed:           p.GasUsed(),
+			EffectiveGasPrice: p.EffectiveGasPrice(),
+			Late:              p.IsLate(),
+			Verified:          p.IsVerified(),
+		})
+	}
+
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, resp)
+
+	return nil
+}
+
+func (s *HTTPHandlers) sweepInvoice(w http.ResponseWriter, r *http.Request) error {
+	invoice, err := s.getInvoiceFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	transfer, err := s.application.SweepInvoice(r.Context(), invoice.ID())
+	if common.IsFlaggedError(err, common.FlagConflict) {
+		return NewConflictError(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sweep invoice: %w", err)
+	}
+
+	render.Status(r, http.StatusAccepted)
+	render.Respond(w, r, newTransferResponse(transfer))
+
+	return nil
+}
+
+func (s *HTTPHandlers) refundInvoice(w http.ResponseWriter, r *http.Request) error {
+	invoice, err := s.getInvoiceFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	type request struct {
+		Amount domain.WEI `json:"amount"`
+		// Destination defaults to the payer of the invoice.
+		Destination *geth.Address `json:"destination"`
+		// SubtractFee pays the network fee from the amount.
+		SubtractFee bool `json:"subtract_fee"`
+	}
+
+	var req request
+
+	if err := render.Decode(r, &req); err != nil {
+		return NewValidationError("invalid request body")
+	}
+
+	if req.Amount == nil || req.Amount.Sign() <= 0 {
+		return NewValidationError("amount must be positive")
+	}
+
+	transfer, err := s.application.RefundInvoice(r.Context(), invoice.ID(), req.Amount, req.Destination, req.SubtractFee)
+	if common.IsFlaggedError(err, common.FlagConflict) {
+		return NewConflictError(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to refund invoice: %w", err)
+	}
+
+	render.Status(r, http.StatusAccepted)
+	render.Respond(w, r, newTransferResponse(transfer))
+
+	return nil
+}
+
+func (s *HTTPHandlers) getInvoiceRefunds(w http.ResponseWriter, r *http.Request) error {
+	invoice, err := s.getInvoiceFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	resp := make([]*transferResponse, 0)
+	for _, transfer := range invoice.Transfers() {
+		if transfer.Kind() == domain.TransferKindRefund {
+			resp = append(resp, newTransferResponse(transfer))
+		}
+	}
+
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, resp)
+
+	return nil
+}
+
+func (s *HTTPHandlers) exportSweeps(w http.ResponseWriter, r *http.Request) error {
+	bundle, err := s.application.ExportSweeps(r.Context())
+	if common.IsFlaggedError(err, common.FlagConflict) {
+		return NewConflictError(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to export sweeps: %w", err)
+	}
+
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, bundle)
+
+	return nil
+}
+
+func (s *HTTPHandlers) exportRefund(w http.ResponseWriter, r *http.Request) error {
+	invoice, err := s.getInvoiceFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	type request struct {
+		Amount domain.WEI `json:"amount"`
+		// Destination defaults to the payer of the invoice.
+		Destination *geth.Address `json:"destination"`
+		// SubtractFee pays the network fee from the amount.
+		SubtractFee bool `json:"subtract_fee"`
+	}
+
+	var req request
+
+	if err := render.Decode(r, &req); err != nil {
+		return NewValidationError("invalid request body")
+	}
+
+	if req.Amount == nil || req.Amount.Sign() <= 0 {
+		return NewValidationError("amount must be positive")
 	}
 
-	invoice, err := s.application.GetInvoice(domain.ID(id))
+	bundle, err := s.application.ExportRefund(r.Context(), invoice.ID(), req.Amount, req.Destination, req.SubtractFee)
+	if common.IsFlaggedError(err, common.FlagConflict) {
+		return NewConflictError(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to export refund: %w", err)
+	}
+
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, bundle)
+
+	return nil
+}
+
+func (s *HTTPHandlers) importSigned(w http.ResponseWriter, r *http.Request) error {
+	var bundle infrastructure.SignedBundle
+
+	if err := render.Decode(r, &bundle); err != nil {
+		return NewValidationError("invalid request body")
+	}
+
+	transfers, err := s.application.ImportSigned(r.Context(), &bundle)
 	if common.IsFlaggedError(err, common.FlagNotFound) {
-		return NewNotFoundError(
-			fmt.Sprintf("invoice with id %d not found", id),
-		)
+		return NewNotFoundError(err.Error())
+	}
+	if common.IsFlaggedError(err, common.FlagConflict) {
+		return NewConflictError(err.Error())
 	}
 	if err != nil {
-		return fmt.Errorf("failed to get invoice: %w", err)
+		return fmt.Errorf("failed to import signed bundle: %w", err)
+	}
+
+	resp := make([]*transferResponse, 0, len(transfers))
+	for _, transfer := range transfers {
+		resp = append(resp, newTransferResponse(transfer))
+	}
+
+	render.Status(r, http.StatusAccepted)
+	render.Respond(w, r, resp)
+
+	return nil
+}
+
+func (s *HTTPHandlers) getReconciliation(w http.ResponseWriter, r *http.Request) error {
+	report := s.application.GetReconciliationReport()
+	if report == nil {
+		return NewNotFoundError("invoice balances have not been reconciled yet")
+	}
+
+	type mismatch struct {
+		InvoiceID domain.ID    `json:"invoice_id"`
+		Address   geth.Address `json:"address"`
+		Expected  domain.WEI   `json:"expected"`
+		Actual    domain.WEI   `json:"actual"`
 	}
 
 	type response struct {
-		ID      domain.ID            `json:"id"`
-		Price   domain.WEI           `json:"price"`
-		Balance domain.WEI           `json:"balance"`
-		Address domain.Address       `json:"address"`
-		Status  domain.InvoiceStatus `json:"status"`
+		StartedAt   time.Time  `json:"started_at"`
+		FinishedAt  time.Time  `json:"finished_at"`
+		BlockNumber uint64     `json:"block_number"`
+		Checked     int        `json:"checked"`
+		Skipped     int        `json:"skipped"`
+		Failed      int        `json:"failed"`
+		Mismatches  []mismatch `json:"mismatches"`
 	}
 
 	resp := response{
-		ID:      invoice.ID(),
-		Price:   invoice.Price(),
-		Balance: invoice.Balance(),
-		Address: invoice.Address(),
-		Status:  invoice.Status(),
+		StartedAt:   report.StartedAt,
+		FinishedAt:  report.FinishedAt,
+		BlockNumber: report.BlockNumber,
+		Checked:     report.Checked,
+		Skipped:     report.Skipped,
+		Failed:      report.Failed,
+		Mismatches:  make([]mismatch, 0, len(report.Mismatches)),
+	}
+	for _, m := range report.Mismatches {
+		resp.Mismatches = append(resp.Mismatches, mismatch{
+			InvoiceID: m.InvoiceID,
+			Address:   m.Address,
+			Expected:  m.Expected,
+			Actual:    m.Actual,
+		})
 	}
 
 	render.Status(r, http.StatusOK)
@@ -116,3 +467,201 @@ func (s *HTTPHandlers) getInvoice(w http.ResponseWriter, r *http.Request) error
 
 	return nil
 }
+
+func (s *HTTPHandlers) getDiscrepancies(w http.ResponseWriter, r *http.Request) error {
+	status := domain.DiscrepancyStatus(r.URL.Query().Get("status"))
+
+	switch status {
+	case "", domain.DiscrepancyStatusOpen, domain.DiscrepancyStatusResolved:
+	default:
+		return NewValidationError(fmt.Sprintf("unknown discrepancy status %q", status))
+	}
+
+	discrepancies, err := s.application.GetDiscrepancies(r.Context(), status)
+	if err != nil {
+		return fmt.Errorf("failed to get discrepancies: %w", err)
+	}
+
+	resp := make([]*discrepancyResponse, 0, len(discrepancies))
+	for _, discrepancy := range discrepancies {
+		resp = append(resp, newDiscrepancyResponse(discrepancy))
+	}
+
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, resp)
+
+	return nil
+}
+
+func (s *HTTPHandlers) resolveDiscrepancy(w http.ResponseWriter, r *http.Request) error {
+	rawID := chi.URLParam(r, "id")
+	id, err := strconv.ParseUint(rawID, DiscrepancyIDNumberSystem, DiscrepancyIDBitSize)
+	if err != nil {
+		return NewValidationError(
+			fmt.Sprintf("failed to parse discrepancy id %q", rawID),
+		)
+	}
+
+	type request struct {
+		// Resolution describes how the discrepancy was handled.
+		Resolution string `json:"resolution"`
+	}
+
+	var req request
+
+	if err := render.Decode(r, &req); err != nil {
+		return NewValidationError("invalid request body")
+	}
+
+	if req.Resolution == "" {
+		return NewValidationError("resolution must be set")
+	}
+
+	discrepancy, err := s.application.ResolveDiscrepancy(r.Context(), id, req.Resolution)
+	if common.IsFlaggedError(err, common.FlagNotFound) {
+		return NewNotFoundError(
+			fmt.Sprintf("discrepancy with id %d not found", id),
+		)
+	}
+	if common.IsFlaggedError(err, common.FlagConflict) {
+		return NewConflictError(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve discrepancy: %w", err)
+	}
+
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, newDiscrepancyResponse(discrepancy))
+
+	return nil
+}
+
+const (
+	DiscrepancyIDNumberSystem = 10
+	DiscrepancyIDBitSize      = 64
+)
+
+type discrepancyResponse struct {
+	ID          uint64                   `json:"id"`
+	InvoiceID   domain.ID                `json:"invoice_id"`
+	Address     geth.Address             `json:"address"`
+	Expected    domain.WEI               `json:"expected"`
+	Actual      domain.WEI               `json:"actual"`
+	BlockNumber uint64                   `json:"block_number"`
+	Status      domain.DiscrepancyStatus `json:"status"`
+	Resolution  string                   `json:"resolution,omitempty"`
+	CreatedAt   time.Time                `json:"created_at"`
+	ResolvedAt  *time.Time               `json:"resolved_at"`
+}
+
+func newDiscrepancyResponse(discrepancy *domain.Discrepancy) *discrepancyResponse {
+	return &discrepancyResponse{
+		ID:          discrepancy.ID(),
+		InvoiceID:   discrepancy.InvoiceID(),
+		Address:     discrepancy.Address(),
+		Expected:    discrepancy.Expected(),
+		Actual:      discrepancy.Actual(),
+		BlockNumber: discrepancy.BlockNumber(),
+		Status:      discrepancy.Status(),
+		Resolution:  discrepancy.Resolution(),
+		CreatedAt:   discrepancy.CreatedAt(),
+		ResolvedAt:  discrepancy.ResolvedAt(),
+	}
+}
+
+type tokenResponse struct {
+	Address  geth.Address `json:"address"`
+	Symbol   string       `json:"symbol"`
+	Decimals uint8        `json:"decimals"`
+}
+
+func newTokenResponse(token *domain.Token) *tokenResponse {
+	if token == nil {
+		return nil
+	}
+
+	return &tokenResponse{
+		Address:  token.Address(),
+		Symbol:   token.Symbol(),
+		Decimals: token.Decimals(),
+	}
+}
+
+type fiatPriceResponse struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+	// Rate is the price of one ether in the currency locked at the invoice creation.
+	Rate          string    `json:"rate"`
+	RateTimestamp time.Time `json:"rate_timestamp"`
+	RateSource    string    `json:"rate_source"`
+}
+
+func newFiatPriceResponse(price *domain.FiatPrice) *fiatPriceResponse {
+	if price == nil {
+		return nil
+	}
+
+	return &fiatPriceResponse{
+		Amount:        domain.FormatDecimal(price.Amount()),
+		Currency:      price.Currency(),
+		Rate:          domain.FormatDecimal(price.Rate().Rate()),
+		RateTimestamp: price.Rate().Timestamp(),
+		RateSource:    price.Rate().Source(),
+	}
+}
+
+type transferResponse struct {
+	Kind              domain.TransferKind   `json:"kind"`
+	TxHash            domain.Hash           `json:"tx_hash"`
+	To                geth.Address          `json:"to"`
+	Value             domain.WEI            `json:"value"`
+	Nonce             uint64                `json:"nonce"`
+	MaxFee            domain.WEI            `json:"max_fee"`
+	CreatedAt         time.Time             `json:"created_at"`
+	Status            domain.TransferStatus `json:"status"`
+	BlockNumber       uint64                `json:"block_number,omitempty"`
+	GasUsed           uint64                `json:"gas_used,omitempty"`
+	EffectiveGasPrice domain.WEI            `json:"effective_gas_price,omitempty"`
+}
+
+func newTransferResponse(transfer *domain.Transfer) *transferResponse {
+	if transfer == nil {
+		return nil
+	}
+
+	return &transferResponse{
+		Kind:              transfer.Kind(),
+		TxHash:            transfer.TxHash(),
+		To:                transfer.To(),
+		Value:             transfer.Value(),
+		Nonce:             transfer.Nonce(),
+		MaxFee:            transfer.MaxFee(),
+		CreatedAt:         transfer.CreatedAt(),
+		Status:            transfer.Status(),
+		BlockNumber:       transfer.BlockNumber(),
+		GasUsed:           transfer.GasUsed(),
+		EffectiveGasPrice: transfer.EffectiveGasPrice(),
+	}
+}
+
+func (s *HTTPHandlers) getInvoiceFromURL(r *http.Request) (*domain.Invoice, error) {
+	rawID := chi.URLParam(r, "id")
+	id, err := strconv.ParseUint(rawID, InvoiceIDNumberSystem, InvoiceIDBitSize)
+	if err != nil {
+		return nil, NewValidationError(
+			fmt.Sprintf("failed to parse invoice id %q", rawID),
+		)
+	}
+
+	invoice, err := s.application.GetInvoice(r.Context(), domain.ID(id))
+	if common.IsFlaggedError(err, common.FlagNotFound) {
+		return nil, NewNotFoundError(
+			fmt.Sprintf("invoice with id %d not found", id),
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invoice: %w", err)
+	}
+
+	return invoice, nil
+}
@@ -19,28 +19,38 @@ const (
 )
 
 type HTTPServer struct {
+	name   string
 	server *http.Server
 }
 
 func NewHTTPServer(ctx context.Context, address string, app *application.Application) *HTTPServer {
-	handlers := NewHTTPHandlers(app)
+	return newHTTPServer(ctx, "server", address, NewHTTPHandlers(app).GetRouter())
+}
+
+// NewAdminHTTPServer serves the endpoints which move funds and the operator tools.
+// It must listen on an internal address, every request must carry the token if it is set.
+func NewAdminHTTPServer(ctx context.Context, address string, token string, app *application.Application) *HTTPServer {
+	return newHTTPServer(ctx, "admin server", address, NewHTTPHandlers(app).GetAdminRouter(token))
+}
 
+func newHTTPServer(ctx context.Context, name string, address string, handler http.Handler) *HTTPServer {
 	server := &http.Server{
 		Addr:              address,
 		ReadHeaderTimeout: ReadHeaderTimeout,
-		Handler:           handlers.GetRouter(),
+		Handler:           handler,
 		BaseContext: func(_ net.Listener) context.Context {
 			return ctx
 		},
 	}
 
 	return &HTTPServer{
+		name:   name,
 		server: server,
 	}
 }
 
 func (s *HTTPServer) Run() error {
-	log.Println("server started")
+	log.Printf("%s started on %s\n", s.name, s.server.Addr)
 
 	err := s.server.ListenAndServe()
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -71,7 +81,7 @@ func (s *HTTPServer) ShutdownOnContextDone(
 			return fmt.Errorf("failed to shutdown server: %w", err)
 		}
 
-		log.Println("server stopped")
+		log.Printf("%s stopped\n", s.name)
 
 		return nil
 	}
@@ -25,7 +25,7 @@ func (s *TestSuite) TestApplication() {
 	waitForProcessing(s.T())
 
 	invoice = sendGetInvoiceRequest(s.T(), s.e(), invoiceID)
-	invoice.Status.Equal(InvoiceStatusPending)
+	invoice.Status.Equal(InvoiceStatusPartiallyPaid)
 
 	tx = invoice.Deposit(s.eth, transactionValue)
 	tx.WaitConfirmation(ctx, s.eth)
@@ -33,6 +33,9 @@ func (s *TestSuite) TestApplication() {
 
 	invoice = sendGetInvoiceRequest(s.T(), s.e(), invoiceID)
 	invoice.Status.Equal(InvoiceStatusPaid)
+
+	payments := sendGetInvoicePaymentsRequest(s.T(), s.e(), invoiceID)
+	payments.Length().Equal(2)
 }
 
 func sendCreateInvoiceRequest(t *testing.T, e *httpexpect.Expect, price uint64) uint64 {
@@ -73,6 +76,18 @@ func sendGetInvoiceRequest(t *testing.T, e *httpexpect.Expect, invoiceID uint64)
 	}
 }
 
+func sendGetInvoicePaymentsRequest(t *testing.T, e *httpexpect.Expect, invoiceID uint64) *httpexpect.Array {
+	t.Helper()
+
+	paymentsPath := fmt.Sprintf("/invoices/%d/payments", invoiceID)
+
+	return e.
+		GET(paymentsPath).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array()
+}
+
 const transactionProcessingTime = 5 * time.Second
 
 func waitForProcessing(t *testing.T) {
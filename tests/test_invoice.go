@@ -14,8 +14,9 @@ import (
 type JSON = map[string]any
 
 const (
-	InvoiceStatusPending = "pending"
-	InvoiceStatusPaid    = "paid"
+	InvoiceStatusPending       = "pending"
+	InvoiceStatusPartiallyPaid = "partially_paid"
+	InvoiceStatusPaid          = "paid"
 )
 
 type TestInvoice struct {